@@ -0,0 +1,226 @@
+// Copyright © 2014 Terry Mao All rights reserved.
+// This file is part of gosnowflake.
+
+// gosnowflake is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// gosnowflake is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with gosnowflake.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"github.com/Terry-Mao/gosnowflake/logger"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"strings"
+	"syscall"
+)
+
+/*
+   admin http server
+   ============
+   every admin.bind (and the deprecated stat.bind and pprof.bind) serves:
+
+   GET  /stat             the json stats
+   GET  /metrics          the prometheus metrics
+   GET  /config           the json config, the token is hidden
+   GET  /healthz          the json health checks, 200 if live, otherwise 503
+   GET  /readyz           the json health checks, 200 if ready, otherwise 503
+   GET  /debug/pprof/...  pprof, including trace
+   POST /admin/reload     reload the config, as SIGHUP
+   POST /admin/reopen     reopen the log files, as SIGUSR1
+   POST /admin/upgrade    upgrade the binary, as SIGUSR2
+   POST /admin/shutdown   shut down gracefully, as SIGTERM
+
+   a request is allowed from an admin.allow address, or with the admin.token
+   as "Authorization: Bearer <token>". the token and the allowlist are
+   reloadable.
+*/
+
+const (
+	adminTokenHidden = "******"
+)
+
+var (
+	// admin action => signal
+	adminActions = map[string]os.Signal{
+		"reload":   syscall.SIGHUP,
+		"reopen":   syscall.SIGUSR1,
+		"upgrade":  syscall.SIGUSR2,
+		"shutdown": syscall.SIGTERM,
+	}
+)
+
+// InitAdmin start the admin http server on all admin binds.
+func InitAdmin(workers *Workers) error {
+	handler := &adminHandler{mux: newAdminServeMux(workers)}
+	for _, addr := range adminBinds(Conf()) {
+		Logger.Info("start listen admin addr", logger.F("addr", addr))
+		// the listener may be inherited from the old process
+		l, err := listen(addr)
+		if err != nil {
+			Logger.Error("listen() error", logger.F("addr", addr), logger.Err(err))
+			return err
+		}
+		go func(addr string, l net.Listener) {
+			if err := http.Serve(l, handler); err != nil {
+				Logger.Info("http.Serve() stop", logger.F("addr", addr), logger.Err(err))
+			}
+		}(addr, l)
+	}
+	return nil
+}
+
+// adminBinds get the admin binds, the stat.bind and pprof.bind are served as
+// the admin.bind.
+func adminBinds(c *Config) []string {
+	binds, dup := []string{}, map[string]bool{}
+	for _, bind := range append(append(append([]string{}, c.AdminBind...), c.StatBind...), c.PprofBind...) {
+		if !dup[bind] {
+			dup[bind] = true
+			binds = append(binds, bind)
+		}
+	}
+	return binds
+}
+
+// newAdminServeMux new the admin handlers.
+func newAdminServeMux(workers *Workers) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/stat", statHandler(workers))
+	mux.HandleFunc("/metrics", metricsHandler(workers))
+	mux.HandleFunc("/config", configHandler)
+	mux.HandleFunc("/healthz", healthHandler(workers, false))
+	mux.HandleFunc("/readyz", healthHandler(workers, true))
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.HandleFunc("/admin/", actionHandler)
+	return mux
+}
+
+// adminHandler check the admin access of every request.
+type adminHandler struct {
+	mux *http.ServeMux
+}
+
+func (h *adminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !adminAllowed(Conf(), r) {
+		Logger.Warn("admin request forbidden", logger.F("method", r.Method), logger.F("path", r.URL.Path), logger.F("remote", r.RemoteAddr))
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	h.mux.ServeHTTP(w, r)
+}
+
+// adminAllowed check the request has the admin token or comes from an
+// allowed address.
+func adminAllowed(c *Config, r *http.Request) bool {
+	if c.AdminToken != "" {
+		auth := r.Header.Get("Authorization")
+		if strings.HasPrefix(auth, "Bearer ") && subtle.ConstantTimeCompare([]byte(auth[len("Bearer "):]), []byte(c.AdminToken)) == 1 {
+			return true
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	nets, err := parseAllow(c.AdminAllow)
+	if err != nil {
+		return false
+	}
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseAllow parse the allowed addresses, an ip or a cidr.
+func parseAllow(allow []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(allow))
+	for _, a := range allow {
+		if !strings.Contains(a, "/") {
+			ip := net.ParseIP(a)
+			if ip == nil {
+				return nil, fmt.Errorf("admin allow: \"%s\" is not an ip or cidr", a)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(a)
+		if err != nil {
+			return nil, fmt.Errorf("admin allow: \"%s\" is not an ip or cidr", a)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// configHandler get the config in json, the admin token is hidden.
+func configHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	c := *Conf()
+	if c.AdminToken != "" {
+		c.AdminToken = adminTokenHidden
+	}
+	d, err := json.MarshalIndent(&c, "", "    ")
+	if err != nil {
+		Logger.Error("json.MarshalIndent() error", logger.Err(err))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Write(d)
+}
+
+// actionHandler do the admin action by sending the signal to the signal
+// handler, so the actions and the signals are serialized.
+func actionHandler(w http.ResponseWriter, r *http.Request) {
+	action := strings.TrimPrefix(r.URL.Path, "/admin/")
+	sig, ok := adminActions[action]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	Logger.Info("admin action", logger.F("action", action), logger.F("remote", r.RemoteAddr))
+	if err := SendSignal(sig); err != nil {
+		Logger.Error("SendSignal() error", logger.F("signal", sig.String()), logger.Err(err))
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+	w.Write([]byte(action + " accepted\n"))
+}
@@ -0,0 +1,134 @@
+// Copyright © 2014 Terry Mao All rights reserved.
+// This file is part of gosnowflake.
+
+// gosnowflake is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// gosnowflake is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with gosnowflake.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestAdminAllowed(t *testing.T) {
+	if _, err := parseAllow([]string{"10.0.0.0/33"}); err == nil {
+		t.Fatal("parseAllow() of an invalid cidr must fail")
+	}
+	if _, err := parseAllow([]string{"localhost"}); err == nil {
+		t.Fatal("parseAllow() of a hostname must fail")
+	}
+	c := &Config{AdminAllow: []string{"127.0.0.1", "::1", "10.0.0.0/8"}, AdminToken: "secret"}
+	for _, r := range []struct {
+		remote  string
+		auth    string
+		allowed bool
+	}{
+		{"127.0.0.1:1234", "", true},
+		{"[::1]:1234", "", true},
+		{"10.1.2.3:1234", "", true},
+		{"192.168.1.1:1234", "", false},
+		{"192.168.1.1:1234", "Bearer secret", true},
+		{"192.168.1.1:1234", "Bearer wrong", false},
+		{"192.168.1.1:1234", "secret", false},
+	} {
+		req := httptest.NewRequest("GET", "/stat", nil)
+		req.RemoteAddr = r.remote
+		if r.auth != "" {
+			req.Header.Set("Authorization", r.auth)
+		}
+		if allowed := adminAllowed(c, req); allowed != r.allowed {
+			t.Fatalf("adminAllowed(%s, \"%s\") = %t, expected %t", r.remote, r.auth, allowed, r.allowed)
+		}
+	}
+	// no token, allowlist only
+	c.AdminToken = ""
+	req := httptest.NewRequest("GET", "/stat", nil)
+	req.RemoteAddr = "192.168.1.1:1234"
+	req.Header.Set("Authorization", "Bearer ")
+	if adminAllowed(c, req) {
+		t.Fatal("adminAllowed() with an empty token must fail")
+	}
+}
+
+func TestAdminHandler(t *testing.T) {
+	old := Conf()
+	SetConf(&Config{AdminAllow: []string{"127.0.0.1"}, AdminToken: "secret", AdminBind: []string{"127.0.0.1:6971"}, StatBind: []string{"127.0.0.1:6971", "127.0.0.1:6972"}})
+	defer SetConf(old)
+	if binds := adminBinds(Conf()); strings.Join(binds, ",") != "127.0.0.1:6971,127.0.0.1:6972" {
+		t.Fatalf("adminBinds() = %v", binds)
+	}
+	handler := &adminHandler{mux: newAdminServeMux(&Workers{})}
+	do := func(method, path, remote string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		req.RemoteAddr = remote
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+	if w := do("GET", "/config", "192.168.1.1:1234"); w.Code != http.StatusForbidden {
+		t.Fatalf("GET /config from a remote address status: %d", w.Code)
+	}
+	w := do("GET", "/config", "127.0.0.1:1234")
+	c := &Config{}
+	if err := json.Unmarshal(w.Body.Bytes(), c); err != nil {
+		t.Fatal(err)
+	}
+	if c.AdminToken != adminTokenHidden {
+		t.Fatalf("GET /config token: \"%s\", expected hidden", c.AdminToken)
+	}
+	for _, path := range []string{"/debug/pprof/", "/debug/pprof/trace?seconds=0.01"} {
+		if w = do("GET", path, "127.0.0.1:1234"); w.Code != http.StatusOK {
+			t.Fatalf("GET %s status: %d", path, w.Code)
+		}
+	}
+	// the admin actions go to the signal handler
+	if w = do("POST", "/admin/reload", "127.0.0.1:1234"); w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("POST /admin/reload without a signal handler status: %d", w.Code)
+	}
+	signalMutex.Lock()
+	signalChan = make(chan os.Signal, 1)
+	signalMutex.Unlock()
+	defer func() {
+		signalMutex.Lock()
+		signalChan = nil
+		signalMutex.Unlock()
+	}()
+	if w = do("GET", "/admin/reload", "127.0.0.1:1234"); w.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("GET /admin/reload status: %d", w.Code)
+	}
+	if w = do("POST", "/admin/unknown", "127.0.0.1:1234"); w.Code != http.StatusNotFound {
+		t.Fatalf("POST /admin/unknown status: %d", w.Code)
+	}
+	if w = do("POST", "/admin/reload", "127.0.0.1:1234"); w.Code != http.StatusAccepted {
+		t.Fatalf("POST /admin/reload status: %d", w.Code)
+	}
+	// pending
+	if w = do("POST", "/admin/reopen", "127.0.0.1:1234"); w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("POST /admin/reopen while busy status: %d", w.Code)
+	}
+	select {
+	case s := <-signalChan:
+		if s != syscall.SIGHUP {
+			t.Fatalf("signal: %s, expected %s", s, syscall.SIGHUP)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no signal sent")
+	}
+}
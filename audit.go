@@ -0,0 +1,447 @@
+// Copyright © 2014 Terry Mao All rights reserved.
+// This file is part of gosnowflake.
+
+// gosnowflake is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// gosnowflake is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with gosnowflake.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/Terry-Mao/gosnowflake/logger"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+/*
+   audit log
+   ============
+   every id issued by the rpc is recorded in a span line:
+
+   <unix milliseconds> <datacenter> <worker> <first seq> <last seq> <caller>
+
+   the consecutive ids of a worker in a millisecond issued to the same caller
+   are merged into one span, the caller is the rpc client address. every time
+   the file is opened, a header line is written:
+
+   # gosnowflake audit host=<hostname> pid=<pid> build=<version> epoch=<twepoch> layout=<datacenter/worker/sequence bits>
+
+   the spans are buffered in memory and written by a goroutine. the audit is
+   lossless: if the buffer is full the response waits up to "audit:wait" for
+   room, then it's refused with ErrAuditFull, so an id is never handed out
+   unrecorded, counted in gosnowflake_audit_refused_total and logged. with
+   "audit:drop" the response never waits, the span is dropped instead,
+   counted in gosnowflake_audit_dropped_total and logged. the file is rotated
+   to file.1 ... file.<rotate.keep> once it exceeds rotate.size.
+
+   "gosnowflake -conf=<conf> -audit.lookup=<id>" finds the issuing span of
+   the id in the audit files.
+*/
+
+const (
+	auditHeader    = "# gosnowflake audit"
+	auditWriteSize = 64 * 1024 // write once the pending spans exceed
+)
+
+var (
+	ErrAuditFull = errors.New("audit buffer full, refusing to issue id")
+	// global audit writer, nil if disabled
+	auditWriter *AuditWriter
+	// the id to look up
+	auditLookup int64
+)
+
+func init() {
+	flag.Int64Var(&auditLookup, "audit.lookup", 0, " find the issuing span of the id in the audit files and exit")
+}
+
+// auditSpan is the consecutive ids of a worker issued to a caller in a
+// millisecond.
+type auditSpan struct {
+	timestamp    int64 // unix milliseconds
+	datacenterId int64
+	workerId     int64
+	first        int64 // first sequence
+	last         int64 // last sequence
+	caller       string
+}
+
+// follow check the span continues the previous one.
+func (s *auditSpan) follow(p *auditSpan) bool {
+	return p != nil && s.timestamp == p.timestamp && s.datacenterId == p.datacenterId && s.workerId == p.workerId && s.caller == p.caller && s.first == p.last+1
+}
+
+// InitAudit start the audit writer if "audit:file" is set.
+func InitAudit() (err error) {
+	conf := Conf()
+	if conf.AuditFile == "" {
+		Logger.Info("audit file not set, skip the audit log")
+		return
+	}
+	Logger.Info("start audit log", logger.F("file", conf.AuditFile))
+	wait := conf.AuditWait
+	if conf.AuditDrop {
+		Logger.Warn("audit drop enabled, the spans are dropped if the buffer is full")
+		wait = 0
+	}
+	auditWriter, err = NewAuditWriter(conf.AuditFile, conf.AuditSize, conf.AuditKeep, conf.AuditBuffer, conf.AuditFlush, wait, conf.Twepoch)
+	return
+}
+
+// CloseAudit write the buffered spans and close the audit file.
+func CloseAudit() {
+	auditWriter.Close()
+}
+
+// AuditWriter write the issued id spans to a rotating file.
+type AuditWriter struct {
+	file    string
+	size    int64 // rotate size, 0 is never
+	keep    int   // rotated files
+	twepoch int64
+	flush   time.Duration
+	wait    time.Duration // the max wait for the buffer, 0 drops the spans
+	spans   chan *auditSpan
+	dropped int64
+	refused int64
+	stop    chan bool
+	done    chan bool
+	// owned by the writer goroutine
+	fd      *os.File
+	written int64
+	buf     bytes.Buffer
+	pending *auditSpan
+}
+
+// NewAuditWriter open the audit file and start writing the recorded spans
+// every flush interval. Record waits at most wait for the full buffer, a zero
+// wait drops the spans instead.
+func NewAuditWriter(file string, size int64, keep, buffer int, flush, wait time.Duration, twepoch int64) (*AuditWriter, error) {
+	w := &AuditWriter{
+		file:    file,
+		size:    size,
+		keep:    keep,
+		twepoch: twepoch,
+		flush:   flush,
+		wait:    wait,
+		spans:   make(chan *auditSpan, buffer),
+		stop:    make(chan bool),
+		done:    make(chan bool),
+	}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	go w.run()
+	return w, nil
+}
+
+// Record record the ids issued to the caller, if the buffer stays full for
+// the wait, ErrAuditFull is returned and the ids must not be handed out.
+func (w *AuditWriter) Record(ids []int64, caller string) error {
+	if w == nil {
+		return nil
+	}
+	var span *auditSpan
+	for _, id := range ids {
+		next := &auditSpan{caller: caller}
+		next.timestamp, next.datacenterId, next.workerId, next.first = decodeId(id, w.twepoch)
+		next.last = next.first
+		if next.follow(span) {
+			span.last = next.last
+			continue
+		}
+		if err := w.send(span); err != nil {
+			return err
+		}
+		span = next
+	}
+	return w.send(span)
+}
+
+// send buffer the span, wait for the full buffer up to the wait, or drop the
+// span at once if the wait is 0.
+func (w *AuditWriter) send(span *auditSpan) error {
+	if span == nil {
+		return nil
+	}
+	select {
+	case w.spans <- span:
+		return nil
+	default:
+	}
+	if w.wait == 0 {
+		atomic.AddInt64(&w.dropped, 1)
+		metricAuditDropped.Add(1)
+		return nil
+	}
+	timer := time.NewTimer(w.wait)
+	defer timer.Stop()
+	select {
+	case w.spans <- span:
+		return nil
+	case <-timer.C:
+		atomic.AddInt64(&w.refused, 1)
+		metricAuditRefused.Add(1)
+		return ErrAuditFull
+	}
+}
+
+// Close write the buffered spans and close the file.
+func (w *AuditWriter) Close() {
+	if w == nil {
+		return
+	}
+	close(w.stop)
+	<-w.done
+}
+
+// run write the spans until stopped.
+func (w *AuditWriter) run() {
+	ticker := time.NewTicker(w.flush)
+	defer ticker.Stop()
+	defer close(w.done)
+	for {
+		select {
+		case span := <-w.spans:
+			w.add(span)
+		case <-ticker.C:
+			w.write()
+			if dropped := atomic.SwapInt64(&w.dropped, 0); dropped > 0 {
+				Logger.Error("audit buffer full, spans dropped", logger.F("dropped", dropped))
+			}
+			if refused := atomic.SwapInt64(&w.refused, 0); refused > 0 {
+				Logger.Error("audit buffer full, responses refused", logger.F("refused", refused))
+			}
+		case <-w.stop:
+			// the spans recorded before stopped
+			for len(w.spans) > 0 {
+				w.add(<-w.spans)
+			}
+			w.write()
+			if err := w.fd.Close(); err != nil {
+				Logger.Error("audit file close error", logger.F("file", w.file), logger.Err(err))
+			}
+			return
+		}
+	}
+}
+
+// add merge the span into the pending one, or format the pending one.
+func (w *AuditWriter) add(span *auditSpan) {
+	if span.follow(w.pending) {
+		w.pending.last = span.last
+		return
+	}
+	w.format()
+	w.pending = span
+	if w.buf.Len() >= auditWriteSize {
+		w.write()
+	}
+}
+
+// format format the pending span into the buffer.
+func (w *AuditWriter) format() {
+	if s := w.pending; s != nil {
+		fmt.Fprintf(&w.buf, "%d %d %d %d %d %s\n", s.timestamp, s.datacenterId, s.workerId, s.first, s.last, s.caller)
+		w.pending = nil
+	}
+}
+
+// write write the buffered lines at once and rotate the file if it's full,
+// the lines of the old and the new processes don't interleave while
+// upgrading.
+func (w *AuditWriter) write() {
+	w.format()
+	if w.buf.Len() == 0 {
+		return
+	}
+	n, err := w.fd.Write(w.buf.Bytes())
+	w.written += int64(n)
+	w.buf.Reset()
+	if err != nil {
+		Logger.Error("audit file write error", logger.F("file", w.file), logger.Err(err))
+		return
+	}
+	if w.size > 0 && w.written >= w.size {
+		if err = w.rotate(); err != nil {
+			Logger.Error("audit file rotate error", logger.F("file", w.file), logger.Err(err))
+		}
+	}
+}
+
+// open open the audit file to append and write the header, on a new line if
+// the last record was cut off, e.g. by a crash.
+func (w *AuditWriter) open() error {
+	fd, err := os.OpenFile(w.file, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := fd.Stat()
+	if err != nil {
+		fd.Close()
+		return err
+	}
+	newline := ""
+	if fi.Size() > 0 {
+		last := make([]byte, 1)
+		if _, err = fd.ReadAt(last, fi.Size()-1); err != nil {
+			fd.Close()
+			return err
+		}
+		if last[0] != '\n' {
+			newline = "\n"
+		}
+	}
+	hostname, _ := os.Hostname()
+	n, err := fmt.Fprintf(fd, "%s%s host=%s pid=%d build=%s epoch=%d layout=%d/%d/%d\n", newline, auditHeader, hostname, os.Getpid(), Version, w.twepoch, datacenterIdBits, workerIdBits, sequenceBits)
+	if err != nil {
+		fd.Close()
+		return err
+	}
+	w.fd = fd
+	w.written = fi.Size() + int64(n)
+	return nil
+}
+
+// rotate rename the file to file.1, file.1 to file.2 and so on, the oldest
+// one is overwritten, then open a new file.
+func (w *AuditWriter) rotate() error {
+	if err := w.fd.Close(); err != nil {
+		Logger.Error("audit file close error", logger.F("file", w.file), logger.Err(err))
+	}
+	for i := w.keep - 1; i > 0; i-- {
+		if err := os.Rename(auditRotated(w.file, i), auditRotated(w.file, i+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := os.Rename(w.file, auditRotated(w.file, 1)); err != nil {
+		return err
+	}
+	return w.open()
+}
+
+// auditRotated get the ith rotated file name.
+func auditRotated(file string, i int) string {
+	return file + "." + strconv.Itoa(i)
+}
+
+// RunAuditLookup print the issuing span of the id, return the exit code.
+func RunAuditLookup(id int64) int {
+	conf := Conf()
+	if conf.AuditFile == "" {
+		fmt.Fprintln(os.Stderr, "audit file not set")
+		return 2
+	}
+	file := conf.AuditFile
+	if !filepath.IsAbs(file) {
+		file = filepath.Join(conf.Dir, file)
+	}
+	found, err := LookupAudit(os.Stdout, os.Stderr, file, conf.AuditKeep, id)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "audit lookup error(%v)\n", err)
+		return 2
+	}
+	if !found {
+		fmt.Fprintf(os.Stderr, "id %d not found in the audit files\n", id)
+		return 1
+	}
+	return 0
+}
+
+// LookupAudit find the spans issued the id in the audit file and the rotated
+// ones from the oldest, print them with the headers. the malformed lines,
+// e.g. a record cut off by a crash, are skipped and reported to skipped.
+func LookupAudit(out, skipped io.Writer, file string, keep int, id int64) (found bool, err error) {
+	files := []string{}
+	for i := keep; i > 0; i-- {
+		files = append(files, auditRotated(file, i))
+	}
+	files = append(files, file)
+	for _, name := range files {
+		var ok bool
+		if ok, err = lookupAuditFile(out, skipped, name, id); err != nil {
+			if os.IsNotExist(err) {
+				err = nil
+				continue
+			}
+			return
+		}
+		found = found || ok
+	}
+	return
+}
+
+// lookupAuditFile find the spans issued the id in the audit file.
+func lookupAuditFile(out, skipped io.Writer, name string, id int64) (found bool, err error) {
+	fd, err := os.Open(name)
+	if err != nil {
+		return
+	}
+	defer fd.Close()
+	var (
+		header  string
+		twepoch int64
+		nums    = []int64{0, 0, 0, 0, 0} // timestamp, datacenter, worker, first, last
+	)
+	scanner := bufio.NewScanner(fd)
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		if strings.HasPrefix(text, auditHeader) {
+			header = text
+			for _, kv := range strings.Fields(text[len(auditHeader):]) {
+				if strings.HasPrefix(kv, "epoch=") {
+					twepoch, _ = strconv.ParseInt(kv[len("epoch="):], 10, 64)
+				}
+			}
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+		if perr := parseAuditSpan(fields, nums); perr != nil {
+			fmt.Fprintf(skipped, "%s:%d: malformed line skipped: %v\n", name, line, perr)
+			continue
+		}
+		timestamp, datacenterId, workerId, sequence := decodeId(id, twepoch)
+		if nums[0] == timestamp && nums[1] == datacenterId && nums[2] == workerId && nums[3] <= sequence && sequence <= nums[4] {
+			found = true
+			fmt.Fprintf(out, "%s:%d: %s\n\tissued at %s to %s\n\t%s\n", name, line, text, time.Unix(0, timestamp*int64(time.Millisecond)).UTC().Format("2006-01-02 15:04:05.000 MST"), strings.Join(fields[5:], " "), header)
+		}
+	}
+	err = scanner.Err()
+	return
+}
+
+// parseAuditSpan parse the timestamp, datacenter, worker, first and last
+// sequence of the span record into nums.
+func parseAuditSpan(fields []string, nums []int64) (err error) {
+	if len(fields) < len(nums) {
+		return fmt.Errorf("%d fields, expected %d", len(fields), len(nums))
+	}
+	for i := range nums {
+		if nums[i], err = strconv.ParseInt(fields[i], 10, 64); err != nil {
+			return
+		}
+	}
+	return
+}
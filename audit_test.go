@@ -0,0 +1,145 @@
+// Copyright © 2014 Terry Mao All rights reserved.
+// This file is part of gosnowflake.
+
+// gosnowflake is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// gosnowflake is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with gosnowflake.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAudit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gosnowflake-audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "audit.log")
+	w, err := NewAuditWriter(file, 0, 2, 1024, time.Hour, time.Second, twepoch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	worker, err := NewIdWorker(3, 2, twepoch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids, err := worker.NextIds(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the spans of a caller in a millisecond are merged
+	for _, id := range ids[:5] {
+		w.Record([]int64{id}, "10.0.0.1:1234")
+	}
+	w.Record(ids[5:], "10.0.0.2:1234")
+	w.Close()
+	d, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(d)), "\n")
+	if !strings.HasPrefix(lines[0], auditHeader) || !strings.Contains(lines[0], "layout=5/5/12") {
+		t.Fatalf("audit header: \"%s\"", lines[0])
+	}
+	spans := 0
+	for _, line := range lines[1:] {
+		if !strings.HasPrefix(line, "#") {
+			spans++
+		}
+	}
+	if spans < 2 || spans > 4 {
+		t.Fatalf("audit spans: %d, expected merged into 2 to 4 (milliseconds crossed)\n%s", spans, d)
+	}
+	for i, id := range ids {
+		out := &bytes.Buffer{}
+		found, err := LookupAudit(out, ioutil.Discard, file, 2, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		caller := "10.0.0.1:1234"
+		if i >= 5 {
+			caller = "10.0.0.2:1234"
+		}
+		if !found || !strings.Contains(out.String(), " to "+caller+"\n") || !strings.Contains(out.String(), auditHeader) {
+			t.Fatalf("LookupAudit(%d) found: %t\n%s", id, found, out.String())
+		}
+	}
+	// another worker
+	other, _ := NewIdWorker(4, 2, twepoch)
+	id, _ := other.NextId()
+	if found, err := LookupAudit(ioutil.Discard, ioutil.Discard, file, 2, id); err != nil || found {
+		t.Fatalf("LookupAudit(%d) of an unissued id found: %t, error(%v)", id, found, err)
+	}
+	// a record cut off by a crash is skipped, the next header starts a new line
+	fd, err := os.OpenFile(file, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = fd.WriteString("1234 3 x"); err != nil {
+		t.Fatal(err)
+	}
+	fd.Close()
+	if w, err = NewAuditWriter(file, 0, 2, 1024, time.Hour, time.Second, twepoch); err != nil {
+		t.Fatal(err)
+	}
+	w.Record([]int64{id}, "10.0.0.3:1234")
+	w.Close()
+	if d, err = ioutil.ReadFile(file); err != nil || !strings.Contains(string(d), "1234 3 x\n"+auditHeader) {
+		t.Fatalf("audit header after a cut off record: \"%s\", error(%v)", d, err)
+	}
+	skipped := &bytes.Buffer{}
+	if found, err := LookupAudit(ioutil.Discard, skipped, file, 2, id); err != nil || !found {
+		t.Fatalf("LookupAudit(%d) after a cut off record found: %t, error(%v)", id, found, err)
+	}
+	if n := strings.Count(skipped.String(), "malformed line skipped"); n != 1 || !strings.Contains(skipped.String(), file+":") {
+		t.Fatalf("malformed lines skipped: %d, expected 1\n%s", n, skipped.String())
+	}
+	// rotate after every write
+	w, err = NewAuditWriter(file, 1, 2, 1024, time.Hour, time.Second, twepoch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Record([]int64{id}, "10.0.0.3:1234")
+	w.Close()
+	if found, err := LookupAudit(ioutil.Discard, ioutil.Discard, file, 2, id); err != nil || !found {
+		t.Fatalf("LookupAudit(%d) after rotated found: %t, error(%v)", id, found, err)
+	}
+	if _, err = os.Stat(auditRotated(file, 1)); err != nil {
+		t.Fatalf("rotated audit file error(%v)", err)
+	}
+	// a full buffer refuses the ids after the wait
+	w = &AuditWriter{twepoch: twepoch, wait: 10 * time.Millisecond, spans: make(chan *auditSpan, 1)}
+	start := time.Now()
+	if err = w.Record([]int64{ids[0], ids[9]}, "10.0.0.1:1234"); err != ErrAuditFull {
+		t.Fatalf("Record() error(%v), expected %v", err, ErrAuditFull)
+	}
+	if wait := time.Since(start); w.refused != 1 || w.dropped != 0 || wait < w.wait {
+		t.Fatalf("audit refused: %d, dropped: %d after %s, expected 1 refused after %s", w.refused, w.dropped, wait, w.wait)
+	}
+	// the opt-in drop never blocks
+	w = &AuditWriter{twepoch: twepoch, spans: make(chan *auditSpan, 1)}
+	if err = w.Record([]int64{ids[0], ids[9]}, "10.0.0.1:1234"); err != nil {
+		t.Fatalf("Record() error(%v), expected dropped", err)
+	}
+	if w.dropped != 1 {
+		t.Fatalf("audit dropped: %d, expected 1", w.dropped)
+	}
+}
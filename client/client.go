@@ -17,80 +17,160 @@
 package client
 
 import (
-	log "github.com/alecthomas/log4go"
-	"encoding/json"
+	"context"
 	"errors"
+	"fmt"
+	"github.com/Terry-Mao/gosnowflake/logger"
+	"github.com/Terry-Mao/gosnowflake/registry"
 	myrpc "github.com/Terry-Mao/gosnowflake/rpc"
-	"github.com/samuel/go-zookeeper/zk"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 	"math/rand"
 	"net/rpc"
-	"path"
-	"sort"
-	"strconv"
 	"sync"
 	"time"
 )
 
 const (
-	zkNodeDelaySleep    = 1 * time.Second // zk error delay sleep
-	zkNodeDelayChild    = 3 * time.Second // zk node delay get children
+	zkNodeDelaySleep    = 1 * time.Second // registry error delay sleep
 	rpcClientPingSleep  = 1 * time.Second // rpc client ping need sleep
 	rpcClientRetrySleep = 1 * time.Second // rpc client retry connect need sleep
+	tracerName          = "github.com/Terry-Mao/gosnowflake/client"
 
-	RPCPing    = "SnowflakeRPC.Ping"
-	RPCNextId  = "SnowflakeRPC.NextId"
-	RPCNextIds = "SnowflakeRPC.NextIds"
+	RPCPing         = "SnowflakeRPC.Ping"
+	RPCHealth       = "SnowflakeRPC.Health"
+	RPCInfo         = "SnowflakeRPC.Info"
+	RPCNextId       = "SnowflakeRPC.NextId"
+	RPCTracedNextId = "SnowflakeRPC.TracedNextId"
+	RPCNextIds      = "SnowflakeRPC.NextIds"
 )
 
 var (
 	ErrNoRpcClient = errors.New("rpc: no rpc client service")
-	// zk
-	mutex     sync.Mutex
-	zkConn    *zk.Conn
-	zkPath    string
-	zkServers []string
-	zkTimeout time.Duration
+	ErrInfoLayout  = errors.New("rpc: service bit layout mismatch")
+	ErrInfoEpoch   = errors.New("rpc: service epoch mismatch")
+	ErrInfoDc      = errors.New("rpc: service datacenter mismatch")
+	ErrInfoProto   = errors.New("rpc: service doesn't serve rpc")
+	ErrInfoWorker  = errors.New("rpc: service doesn't lead the worker")
+	// logger
+	log logger.Logger = logger.Log4go{}
+	// tracer
+	tracer = otel.Tracer(tracerName)
+	// expectation
+	expect = Expect{Layout: registry.DefaultLayout, MaxSkew: time.Second}
+	// registry
+	mutex sync.Mutex
+	reg   registry.Registry
 	// worker
 	workerIdMap = map[int64]*Client{}
 )
 
-// Init init the gosnowflake client.
+// SetLogger set the logger of the client and the registry, a nil logger
+// discards the messages. It must be called before Init.
+func SetLogger(l logger.Logger) {
+	if l == nil {
+		l = logger.Nop{}
+	}
+	log = l
+	registry.SetLogger(l)
+}
+
+// SetTracerProvider set the tracer provider of the client spans, a nil
+// provider is the opentelemetry global one. It must be called before Init.
+func SetTracerProvider(tp trace.TracerProvider) {
+	if tp == nil {
+		tp = otel.GetTracerProvider()
+	}
+	tracer = tp.Tracer(tracerName)
+}
+
+// Init init the gosnowflake client with the zookeeper registry, zpath is the
+// path the workers registered under, the root path of the legacy layout. use
+// InitDatacenter for the datacenter layout.
 func Init(zservers []string, zpath string, ztimeout time.Duration) (err error) {
 	mutex.Lock()
 	defer mutex.Unlock()
-	if zkConn != nil {
+	if reg != nil {
 		return
 	}
-	zkPath = zpath
-	zkServers = zservers
-	zkTimeout = ztimeout
-	conn, session, err := zk.Connect(zkServers, zkTimeout)
-	if err != nil {
-		log.Error("zk.Connect(\"%v\", %d) error(%v)", zkServers, zkTimeout, err)
+	if reg, err = registry.NewZookeeperWatcher(zservers, zpath, "", ztimeout); err != nil {
+		log.Error("registry.NewZookeeperWatcher() error", logger.F("addrs", zservers), logger.F("path", zpath), logger.F("timeout", ztimeout), logger.Err(err))
+		return
+	}
+	return
+}
+
+// InitDatacenter init the gosnowflake client with the zookeeper registry of
+// the datacenter layout, the workers under the datacenter path of the root.
+// the workers which have no node there are watched under the legacy root
+// path, "" if none, so the clients follow the services while they migrate.
+func InitDatacenter(zservers []string, root string, datacenterId int64, legacy string, ztimeout time.Duration) (err error) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	if reg != nil {
+		return
+	}
+	zpath := registry.DatacenterPath(root, datacenterId)
+	if reg, err = registry.NewZookeeperWatcher(zservers, zpath, legacy, ztimeout); err != nil {
+		log.Error("registry.NewZookeeperWatcher() error", logger.F("addrs", zservers), logger.F("path", zpath), logger.F("legacy", legacy), logger.F("timeout", ztimeout), logger.Err(err))
+		return
+	}
+	return
+}
+
+// InitEtcd init the gosnowflake client with the etcd v3 registry, epath is
+// the datacenter path, see registry.DatacenterPath.
+func InitEtcd(eservers []string, epath string, etimeout time.Duration) (err error) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	if reg != nil {
+		return
+	}
+	if reg, err = registry.NewEtcd(eservers, epath, etimeout); err != nil {
+		log.Error("registry.NewEtcd() error", logger.F("addrs", eservers), logger.F("path", epath), logger.F("timeout", etimeout), logger.Err(err))
 		return
 	}
-	zkConn = conn
-	go func() {
-		for {
-			event := <-session
-			log.Info("zk connect get a event: %s", event.Type.String())
-		}
-	}()
 	return
 }
 
+// InitRegistry init the gosnowflake client with a registry backend.
+func InitRegistry(r registry.Registry) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	if reg != nil {
+		return
+	}
+	reg = r
+}
+
+// Expect is the client's expectation of the gosnowflake services, verified by
+// SnowflakeRPC.Info when connecting. The services registered by old versions
+// are not verified.
+type Expect struct {
+	Layout  registry.Layout // the snowflake id bit layout
+	Epoch   int64           // the twepoch unix milliseconds, 0 is any
+	MaxSkew time.Duration   // the max clock skew from the client, only warn, 0 is any
+}
+
+// SetExpect set the expectation of the services, the default is the
+// registry.DefaultLayout and any epoch with a 1s clock skew warning.
+func SetExpect(e Expect) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	expect = e
+}
+
 // Client is gosnowfalke client.
 type Client struct {
 	workerId int64
 	clients  []*rpc.Client // key is workerId
+	addrs    []string      // addresses of the clients
 	stop     chan bool
 	leader   string
-}
-
-// Peer store data in zookeeper.
-type Peer struct {
-	RPC    []string `json:"rpc"`
-	Thrift []string `json:"thrift"`
+	tracing  bool // the leader continues the trace of NextId
 }
 
 // NewClient new a gosnowfalke client.
@@ -106,31 +186,81 @@ func NewClient(workerId int64) (c *Client) {
 		clients:  nil,
 		leader:   "",
 	}
-	go c.watchWorkerId(workerId, strconv.FormatInt(workerId, 10))
+	go c.watchWorkerId(workerId)
 	workerIdMap[workerId] = c
 	return
 }
 
 // Id generate a snowflake id.
 func (c *Client) Id() (id int64, err error) {
-	client, err := c.client()
+	return c.IdContext(context.Background())
+}
+
+// IdContext generate a snowflake id, the call is traced as spans of ctx and
+// the trace is continued by the service.
+func (c *Client) IdContext(ctx context.Context) (id int64, err error) {
+	ctx, span := tracer.Start(ctx, "gosnowflake.Client.Id", trace.WithAttributes(attribute.Int64("snowflake.worker_id", c.workerId)))
+	defer func() {
+		endSpan(span, err)
+	}()
+	client, addr, err := c.pick(ctx)
 	if err != nil {
 		return
 	}
-	if err = client.Call(RPCNextId, c.workerId, &id); err != nil {
-		log.Error("rpc.Call(\"%s\", %d, &id) error(%v)", RPCNextId, c.workerId, err)
+	// the old services only serve the untraced NextId
+	method := RPCNextId
+	traced := c.tracing && trace.SpanContextFromContext(ctx).IsValid()
+	if traced {
+		method = RPCTracedNextId
+	}
+	ctx, call := tracer.Start(ctx, method, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attribute.String("snowflake.peer", addr)))
+	if traced {
+		err = client.Call(method, &myrpc.NextIdArgs{WorkerId: c.workerId, Trace: traceCarrier(ctx)}, &id)
+	} else {
+		err = client.Call(method, c.workerId, &id)
+	}
+	endSpan(call, err)
+	if err != nil {
+		log.Error("rpc.Call() error", logger.F("method", method), logger.F("worker_id", c.workerId), logger.Err(err))
 	}
 	return
 }
 
 // Ids generate a snowflake id.
 func (c *Client) Ids(num int) (ids []int64, err error) {
+	return c.IdsContext(context.Background(), num)
+}
+
+// IdsContext generate snowflake ids, the call is traced as spans of ctx and
+// the trace is continued by the service.
+func (c *Client) IdsContext(ctx context.Context, num int) (ids []int64, err error) {
+	ctx, span := tracer.Start(ctx, "gosnowflake.Client.Ids", trace.WithAttributes(attribute.Int64("snowflake.worker_id", c.workerId), attribute.Int("snowflake.num", num)))
+	defer func() {
+		endSpan(span, err)
+	}()
+	client, addr, err := c.pick(ctx)
+	if err != nil {
+		return
+	}
+	ctx, call := tracer.Start(ctx, RPCNextIds, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attribute.String("snowflake.peer", addr)))
+	// the old services ignore the trace
+	err = client.Call(RPCNextIds, &myrpc.NextIdsArgs{WorkerId: c.workerId, Num: num, Trace: traceCarrier(ctx)}, &ids)
+	endSpan(call, err)
+	if err != nil {
+		log.Error("rpc.Call() error", logger.F("method", RPCNextIds), logger.F("worker_id", c.workerId), logger.F("num", num), logger.Err(err))
+	}
+	return
+}
+
+// Health get the health checks of the leader, see myrpc.HealthReply.
+func (c *Client) Health() (reply *myrpc.HealthReply, err error) {
 	client, err := c.client()
 	if err != nil {
 		return
 	}
-	if err = client.Call(RPCNextIds, &myrpc.NextIdsArgs{WorkerId: c.workerId, Num: num}, &ids); err != nil {
-		log.Error("rpc.Call(\"%s\", %d, &id) error(%v)", RPCNextId, c.workerId, err)
+	reply = &myrpc.HealthReply{}
+	if err = client.Call(RPCHealth, 0, reply); err != nil {
+		log.Error("rpc.Call() error", logger.F("method", RPCHealth), logger.F("worker_id", c.workerId), logger.Err(err))
 	}
 	return
 }
@@ -141,7 +271,7 @@ func closeRpc(clients []*rpc.Client, stop chan bool) {
 	for _, client := range clients {
 		if client != nil {
 			if err := client.Close(); err != nil {
-				log.Error("client.Close() error(%v)", err)
+				log.Error("client.Close() error", logger.Err(err))
 			}
 		}
 	}
@@ -161,88 +291,182 @@ func (c *Client) Close() {
 
 // client get a rand rpc client.
 func (c *Client) client() (*rpc.Client, error) {
-	clientNum := len(c.clients)
-	if clientNum == 0 {
-		return nil, ErrNoRpcClient
-	} else if clientNum == 1 {
-		return c.clients[0], nil
-	} else {
-		return c.clients[rand.Intn(clientNum)], nil
+	client, _, err := c.choose()
+	return client, err
+}
+
+// pick get a rand rpc client and its address, traced as a span of ctx.
+func (c *Client) pick(ctx context.Context) (client *rpc.Client, addr string, err error) {
+	_, span := tracer.Start(ctx, "gosnowflake.Client.pick")
+	client, addr, err = c.choose()
+	span.SetAttributes(attribute.String("snowflake.peer", addr), attribute.Int("snowflake.clients", len(c.clients)))
+	endSpan(span, err)
+	return
+}
+
+// choose get a rand rpc client and its address.
+func (c *Client) choose() (*rpc.Client, string, error) {
+	clients, addrs := c.clients, c.addrs
+	i := 0
+	if len(clients) == 0 {
+		return nil, "", ErrNoRpcClient
+	} else if len(clients) > 1 {
+		i = rand.Intn(len(clients))
+	}
+	// the leader may be changing
+	if i >= len(addrs) {
+		return clients[i], "", nil
+	}
+	return clients[i], addrs[i], nil
+}
+
+// traceCarrier get the w3c trace context of ctx for the rpc args, nil if ctx
+// is not traced.
+func traceCarrier(ctx context.Context) map[string]string {
+	if !trace.SpanContextFromContext(ctx).IsValid() {
+		return nil
+	}
+	carrier := propagation.MapCarrier{}
+	propagation.TraceContext{}.Inject(ctx, carrier)
+	return carrier
+}
+
+// endSpan end the span, records the error if any.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// compatible check the registered peer against the expectation, any
+// datacenter is expected.
+func compatible(peer *registry.Peer) error {
+	mutex.Lock()
+	e := expect
+	mutex.Unlock()
+	expected := &registry.Peer{Layout: e.Layout, Epoch: e.Epoch, Datacenter: peer.Datacenter}
+	if e.Epoch == 0 {
+		expected.Epoch = peer.Epoch
 	}
+	return peer.Compatible(expected)
 }
 
-// watchWorkerId watch the zk node change.
-func (c *Client) watchWorkerId(workerId int64, workerIdStr string) {
-	workerIdPath := path.Join(zkPath, workerIdStr)
-	log.Debug("workerIdPath: %s", workerIdPath)
+// verify verify the service at addr against the expectation and the
+// registered peer.
+func (c *Client) verify(client *rpc.Client, addr string, peer *registry.Peer) (err error) {
+	if peer.Version == 0 {
+		return
+	}
+	mutex.Lock()
+	e := expect
+	mutex.Unlock()
+	info := &myrpc.InfoReply{}
+	start := time.Now()
+	if err = client.Call(RPCInfo, 0, info); err != nil {
+		log.Error("client.Call() error", logger.F("method", RPCInfo), logger.F("peer", addr), logger.Err(err))
+		return
+	}
+	rtt := time.Since(start)
+	served := false
+	for _, proto := range info.Protocols {
+		if proto == registry.ProtocolRPC {
+			served = true
+		}
+	}
+	if !served {
+		return ErrInfoProto
+	}
+	if info.Layout != e.Layout {
+		return fmt.Errorf("%v: %s, expected %s", ErrInfoLayout, info.Layout, e.Layout)
+	}
+	if (e.Epoch != 0 && info.Epoch != e.Epoch) || info.Epoch != peer.Epoch {
+		return fmt.Errorf("%v: %d, expected %d, registered %d", ErrInfoEpoch, info.Epoch, e.Epoch, peer.Epoch)
+	}
+	if info.DatacenterId != peer.Datacenter {
+		return fmt.Errorf("%v: %d, registered %d", ErrInfoDc, info.DatacenterId, peer.Datacenter)
+	}
+	led := false
+	for _, w := range info.Workers {
+		if w.WorkerId == c.workerId && (w.Role == "" || w.Role == registry.RoleLeader) {
+			led = true
+		}
+	}
+	if !led {
+		return fmt.Errorf("%v: %d", ErrInfoWorker, c.workerId)
+	}
+	// the service's clock is compensated by half of the round trip time
+	skew := time.Duration(info.Timestamp-start.Add(rtt/2).UnixNano()/int64(time.Millisecond)) * time.Millisecond
+	if e.MaxSkew > 0 && (skew > e.MaxSkew || skew < -e.MaxSkew) {
+		log.Warn("service clock skewed from the client", logger.F("peer", addr), logger.F("build", info.Build), logger.F("skew", skew))
+	}
+	log.Info("service verified", logger.F("peer", addr), logger.F("build", info.Build), logger.F("layout", info.Layout.String()), logger.F("epoch", info.Epoch), logger.F("skew", skew))
+	return
+}
+
+// watchWorkerId watch the registry worker change.
+func (c *Client) watchWorkerId(workerId int64) {
 	for {
-		rpcs, _, watch, err := zkConn.ChildrenW(workerIdPath)
+		leader, watch, err := reg.WatchWorker(workerId)
 		if err != nil {
-			log.Error("zkConn.ChildrenW(%s) error(%v)", workerIdPath, err)
-			time.Sleep(zkNodeDelaySleep)
-			continue
-		}
-		if len(rpcs) == 0 {
-			log.Error("zkConn.ChildrenW(%s) no nodes", workerIdPath)
+			log.Error("reg.WatchWorker() error", logger.F("worker_id", workerId), logger.Err(err))
 			time.Sleep(zkNodeDelaySleep)
 			continue
 		}
 		// leader selection
-		sort.Strings(rpcs)
-		newLeader := rpcs[0]
-		if c.leader == newLeader {
-			log.Info("workerId: %s add a new standby gosnowflake node", workerIdStr)
+		if err = leader.Peer.Validate(); err != nil {
+			log.Error("leader can't be used", logger.F("worker_id", workerId), logger.F("leader", leader.Name), logger.F("hostname", leader.Peer.Hostname), logger.F("peer", leader.Peer.RPC), logger.Err(err))
+		} else if err = compatible(leader.Peer); err != nil {
+			log.Error("leader misconfigured", logger.F("worker_id", workerId), logger.F("leader", leader.Name), logger.F("hostname", leader.Peer.Hostname), logger.F("peer", leader.Peer.RPC), logger.Err(err))
+		} else if c.leader == leader.Name {
+			log.Info("add a new standby gosnowflake node", logger.F("worker_id", workerId))
 		} else {
-			log.Info("workerId: %s oldLeader: \"%s\", newLeader: \"%s\" not equals, continue leader selection", workerIdStr, c.leader, newLeader)
-			// get new leader info
-			workerNodePath := path.Join(zkPath, workerIdStr, newLeader)
-			bs, _, err := zkConn.Get(workerNodePath)
-			if err != nil {
-				log.Error("zkConn.Get(%s) error(%v)", workerNodePath, err)
-				time.Sleep(zkNodeDelaySleep)
-				continue
-			}
-			peer := &Peer{}
-			if err = json.Unmarshal(bs, peer); err != nil {
-				log.Error("json.Unmarshal(%s, peer) error(%v)", string(bs), err)
-				time.Sleep(zkNodeDelaySleep)
-				continue
-			}
+			log.Info("leader changed, continue leader selection", logger.F("worker_id", workerId), logger.F("old_leader", c.leader), logger.F("leader", leader.Name))
 			// init rpc
-			tmpClients := make([]*rpc.Client, len(peer.RPC))
+			tmpClients := make([]*rpc.Client, 0, len(leader.Peer.RPC))
+			tmpAddrs := make([]string, 0, len(leader.Peer.RPC))
 			tmpStop := make(chan bool, 1)
-			for i, addr := range peer.RPC {
+			for _, addr := range leader.Peer.RPC {
 				clt, err := rpc.Dial("tcp", addr)
 				if err != nil {
-					log.Error("rpc.Dial(tcp, \"%s\") error(%v)", addr, err)
+					log.Error("rpc.Dial() error", logger.F("worker_id", workerId), logger.F("peer", addr), logger.Err(err))
 					continue
 				}
-				tmpClients[i] = clt
-				go c.pingAndRetry(tmpStop, clt, addr)
+				if err = c.verify(clt, addr, leader.Peer); err != nil {
+					log.Error("leader can't be used", logger.F("worker_id", workerId), logger.F("leader", leader.Name), logger.F("peer", addr), logger.Err(err))
+					clt.Close()
+					continue
+				}
+				tmpClients = append(tmpClients, clt)
+				tmpAddrs = append(tmpAddrs, addr)
+				go c.pingAndRetry(tmpStop, clt, addr, leader.Peer)
 			}
 			// old rpc clients
 			oldClients := c.clients
 			oldStop := c.stop
 			// atomic replace variable
-			c.leader = newLeader
+			c.leader = leader.Name
 			c.clients = tmpClients
+			c.addrs = tmpAddrs
+			c.tracing = leader.Peer.Serve(registry.ProtocolTrace)
 			c.stop = tmpStop
 			// if exist, free resource
 			if oldClients != nil {
 				closeRpc(oldClients, oldStop)
 			}
 		}
-		// new zk event
-		event := <-watch
-		log.Error("zk node(\"%s\") changed %s", workerIdPath, event.Type.String())
+		// new registry event
+		<-watch
+		log.Info("nodes changed", logger.F("worker_id", workerId))
 	}
 }
 
 // pingAndRetry ping the rpc connect and re connect when has an error.
-func (c *Client) pingAndRetry(stop <-chan bool, client *rpc.Client, addr string) {
+func (c *Client) pingAndRetry(stop <-chan bool, client *rpc.Client, addr string, peer *registry.Peer) {
 	defer func() {
 		if err := client.Close(); err != nil {
-			log.Error("client.Close() error(%v)", err)
+			log.Error("client.Close() error", logger.Err(err))
 		}
 	}()
 	var (
@@ -254,28 +478,37 @@ func (c *Client) pingAndRetry(stop <-chan bool, client *rpc.Client, addr string)
 	for {
 		select {
 		case <-stop:
-			log.Info("addr: \"%s\" pingAndRetry goroutine exit", addr)
+			log.Info("pingAndRetry goroutine exit", logger.F("worker_id", c.workerId), logger.F("peer", addr))
 			return
 		default:
 		}
 		if !failed {
 			if err = client.Call(RPCPing, 0, &status); err != nil {
-				log.Error("client.Call(%s) error(%v)", RPCPing, err)
+				log.Error("client.Call() error", logger.F("method", RPCPing), logger.F("worker_id", c.workerId), logger.F("peer", addr), logger.Err(err))
 				failed = true
 				continue
 			} else {
+				if status != myrpc.PingOK {
+					log.Warn("service not ready, see "+RPCHealth, logger.F("worker_id", c.workerId), logger.F("peer", addr), logger.F("status", status))
+				}
 				failed = false
 				time.Sleep(rpcClientPingSleep)
 				continue
 			}
 		}
 		if tmp, err = rpc.Dial("tcp", addr); err != nil {
-			log.Error("rpc.Dial(tcp, %s) error(%v)", addr, err)
+			log.Error("rpc.Dial() error", logger.F("worker_id", c.workerId), logger.F("peer", addr), logger.Err(err))
+			time.Sleep(rpcClientRetrySleep)
+			continue
+		}
+		if err = c.verify(tmp, addr, peer); err != nil {
+			log.Error("service can't be used", logger.F("worker_id", c.workerId), logger.F("peer", addr), logger.Err(err))
+			tmp.Close()
 			time.Sleep(rpcClientRetrySleep)
 			continue
 		}
 		client = tmp
 		failed = false
-		log.Info("client reconnect %s ok", addr)
+		log.Info("client reconnect ok", logger.F("worker_id", c.workerId), logger.F("peer", addr))
 	}
 }
@@ -17,9 +17,20 @@
 package client
 
 import (
+	"bytes"
+	"context"
 	"flag"
 	"fmt"
 	"github.com/Terry-Mao/goconf"
+	"github.com/Terry-Mao/gosnowflake/logger"
+	"github.com/Terry-Mao/gosnowflake/registry"
+	myrpc "github.com/Terry-Mao/gosnowflake/rpc"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"net"
+	"net/rpc"
+	"strings"
 	"testing"
 	"time"
 )
@@ -88,3 +99,182 @@ func Test(t *testing.T) {
 		t.Error("workerId exists")
 	}
 }
+
+// infoRPC answers the info.
+type infoRPC struct {
+	info myrpc.InfoReply
+}
+
+func (s *infoRPC) Info(ignore int, reply *myrpc.InfoReply) error {
+	*reply = s.info
+	reply.Timestamp = time.Now().UnixNano() / int64(time.Millisecond)
+	return nil
+}
+
+func TestVerify(t *testing.T) {
+	service := &infoRPC{}
+	server := rpc.NewServer()
+	if err := server.RegisterName("SnowflakeRPC", service); err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go server.Accept(l)
+	addr := l.Addr().String()
+	clt, err := rpc.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clt.Close()
+	buf := &bytes.Buffer{}
+	SetLogger(logger.NewJSON(buf, logger.LevelInfo))
+	defer SetLogger(logger.Log4go{})
+	c := &Client{workerId: 1}
+	peer := &registry.Peer{Version: registry.PeerVersion, RPC: []string{addr}, Datacenter: 2, Layout: registry.DefaultLayout, Epoch: 1288834974657, Protocols: []string{registry.ProtocolRPC}}
+	valid := myrpc.InfoReply{DatacenterId: 2, Layout: registry.DefaultLayout, Epoch: 1288834974657, Workers: []*myrpc.WorkerInfo{{WorkerId: 0, Role: registry.RoleStandby}, {WorkerId: 1, Role: registry.RoleLeader}}, Protocols: []string{registry.ProtocolRPC}}
+	for i, r := range []struct {
+		modify func(info *myrpc.InfoReply)
+		err    error
+	}{
+		{func(info *myrpc.InfoReply) {}, nil},
+		{func(info *myrpc.InfoReply) { info.Layout = registry.Layout{WorkerIdBits: 10, SequenceBits: 12} }, ErrInfoLayout},
+		{func(info *myrpc.InfoReply) { info.Epoch = 0 }, ErrInfoEpoch},
+		{func(info *myrpc.InfoReply) { info.DatacenterId = 3 }, ErrInfoDc},
+		{func(info *myrpc.InfoReply) { info.Protocols = []string{registry.ProtocolThrift} }, ErrInfoProto},
+		{func(info *myrpc.InfoReply) { info.Workers = info.Workers[:1] }, ErrInfoWorker},
+		{func(info *myrpc.InfoReply) { info.Workers = []*myrpc.WorkerInfo{{WorkerId: 1, Role: registry.RoleStandby}} }, ErrInfoWorker},
+		// the static registry has no role
+		{func(info *myrpc.InfoReply) { info.Workers = []*myrpc.WorkerInfo{{WorkerId: 1}} }, nil},
+	} {
+		service.info = valid
+		service.info.Workers = append([]*myrpc.WorkerInfo{}, valid.Workers...)
+		r.modify(&service.info)
+		err = c.verify(clt, addr, peer)
+		if (err == nil) != (r.err == nil) || (err != nil && !strings.HasPrefix(err.Error(), r.err.Error())) {
+			t.Fatalf("case %d: verify() error(%v), expected %v", i, err, r.err)
+		}
+	}
+	// the injected logger
+	if !strings.Contains(buf.String(), `"msg":"service verified","peer":"`+addr+`"`) {
+		t.Fatalf("client log: %s", buf.String())
+	}
+	// the expected epoch
+	service.info = valid
+	SetExpect(Expect{Layout: registry.DefaultLayout, Epoch: 1})
+	defer SetExpect(Expect{Layout: registry.DefaultLayout, MaxSkew: time.Second})
+	if err = c.verify(clt, addr, peer); err == nil {
+		t.Fatal("verify() of an unexpected epoch must fail")
+	}
+	if err = compatible(peer); err == nil {
+		t.Fatal("compatible() of an unexpected epoch must fail")
+	}
+	SetExpect(Expect{Layout: registry.DefaultLayout})
+	if err = compatible(peer); err != nil {
+		t.Fatalf("compatible() error(%v)", err)
+	}
+	SetExpect(Expect{Layout: registry.Layout{WorkerIdBits: 10, SequenceBits: 12}})
+	if err = compatible(peer); err == nil {
+		t.Fatal("compatible() of an unexpected layout must fail")
+	}
+	// the old service is not verified
+	if err = c.verify(clt, addr, &registry.Peer{RPC: []string{addr}}); err != nil {
+		t.Fatalf("verify() of an old service error(%v)", err)
+	}
+}
+
+// traceRPC records the trace context of the calls, nil if untraced.
+type traceRPC struct {
+	traces []map[string]string
+}
+
+func (s *traceRPC) NextId(workerId int64, id *int64) error {
+	s.traces = append(s.traces, nil)
+	*id = 1
+	return nil
+}
+
+func (s *traceRPC) TracedNextId(args *myrpc.NextIdArgs, id *int64) error {
+	s.traces = append(s.traces, args.Trace)
+	*id = 1
+	return nil
+}
+
+func (s *traceRPC) NextIds(args *myrpc.NextIdsArgs, ids *[]int64) error {
+	s.traces = append(s.traces, args.Trace)
+	*ids = make([]int64, args.Num)
+	return nil
+}
+
+func TestTrace(t *testing.T) {
+	service := &traceRPC{}
+	server := rpc.NewServer()
+	if err := server.RegisterName("SnowflakeRPC", service); err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go server.Accept(l)
+	addr := l.Addr().String()
+	clt, err := rpc.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clt.Close()
+	recorder := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	SetTracerProvider(tp)
+	defer SetTracerProvider(nil)
+	c := &Client{workerId: 1, clients: []*rpc.Client{clt}, addrs: []string{addr}, tracing: true}
+	ctx, root := tp.Tracer("test").Start(context.Background(), "request")
+	if _, err = c.IdContext(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.IdsContext(ctx, 2); err != nil {
+		t.Fatal(err)
+	}
+	root.End()
+	// the rpc spans are the parents of the service's
+	spans := map[string]sdktrace.ReadOnlySpan{}
+	for _, span := range recorder.Ended() {
+		spans[span.Name()] = span
+	}
+	for i, name := range []string{RPCTracedNextId, RPCNextIds} {
+		call, ok := spans[name]
+		if !ok {
+			t.Fatalf("no span %s: %v", name, spans)
+		}
+		if call.SpanKind() != trace.SpanKindClient || call.SpanContext().TraceID() != root.SpanContext().TraceID() {
+			t.Fatalf("span %s not a client span of the trace", name)
+		}
+		expected := "00-" + call.SpanContext().TraceID().String() + "-" + call.SpanContext().SpanID().String() + "-01"
+		if traceparent := service.traces[i]["traceparent"]; traceparent != expected {
+			t.Fatalf("%s traceparent: \"%s\", expected \"%s\"", name, traceparent, expected)
+		}
+	}
+	if pick, ok := spans["gosnowflake.Client.pick"]; !ok || pick.Parent().SpanID() != spans["gosnowflake.Client.Ids"].SpanContext().SpanID() {
+		t.Fatalf("no connection choice span of Ids: %v", spans)
+	}
+	// the old service only serves the untraced NextId
+	c.tracing = false
+	if _, err = c.IdContext(ctx); err != nil {
+		t.Fatal(err)
+	}
+	// not traced
+	SetTracerProvider(nil)
+	c.tracing = true
+	if _, err = c.Id(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.Ids(2); err != nil {
+		t.Fatal(err)
+	}
+	if len(service.traces) != 5 || service.traces[2] != nil || service.traces[3] != nil || service.traces[4] != nil {
+		t.Fatalf("traces: %v, expected the last 3 untraced", service.traces)
+	}
+}
@@ -0,0 +1,122 @@
+// Copyright © 2014 Terry Mao All rights reserved.
+// This file is part of gosnowflake.
+
+// gosnowflake is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// gosnowflake is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with gosnowflake.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"github.com/Terry-Mao/gosnowflake/logger"
+	"sort"
+	"sync"
+)
+
+var (
+	// global clock guard, shared by all clock checks
+	clockGuard = NewClockGuard()
+)
+
+// ClockGuard stop serving while any clock check (or the registry session, see
+// guardRegistryState) fails, all workers are deregistered so the clients fail
+// over to the standby workers, and they are registered again once all checks
+// recover.
+type ClockGuard struct {
+	mutex   sync.RWMutex
+	workers *Workers
+	faults  map[string]error // check => fault
+	closed  bool
+	// the registry io is serialized out of the mutex, so the checks and
+	// NextId never wait for the registry
+	ioMutex      sync.Mutex
+	deregistered bool // guarded by ioMutex
+}
+
+// NewClockGuard new a clock guard without fault.
+func NewClockGuard() *ClockGuard {
+	return &ClockGuard{faults: map[string]error{}}
+}
+
+// SetWorkers set the guarded workers, they are deregistered at once if any
+// check already failed.
+func (g *ClockGuard) SetWorkers(workers *Workers) {
+	g.mutex.Lock()
+	g.workers = workers
+	g.mutex.Unlock()
+	g.apply()
+}
+
+// Fault set the fault of the check, a nil err clears it.
+func (g *ClockGuard) Fault(check string, err error) {
+	g.mutex.Lock()
+	faulted := len(g.faults) > 0
+	if err != nil {
+		g.faults[check] = err
+	} else {
+		delete(g.faults, check)
+	}
+	if !faulted && len(g.faults) > 0 {
+		Logger.Error("clock check failed, stop serving", logger.F("check", check), logger.Err(err))
+	} else if faulted && len(g.faults) == 0 {
+		Logger.Info("clock check recovered, rejoin", logger.F("check", check))
+	}
+	g.mutex.Unlock()
+	g.apply()
+}
+
+// Close stop deregistering and registering the workers, the faults are
+// still recorded.
+func (g *ClockGuard) Close() {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.closed = true
+}
+
+// Err get the fault of the first failed check, nil if all checks pass.
+func (g *ClockGuard) Err() error {
+	g.mutex.RLock()
+	defer g.mutex.RUnlock()
+	if len(g.faults) == 0 {
+		return nil
+	}
+	checks := make([]string, 0, len(g.faults))
+	for check := range g.faults {
+		checks = append(checks, check)
+	}
+	sort.Strings(checks)
+	return g.faults[checks[0]]
+}
+
+// apply deregister the workers if any check fails, register them again if
+// all checks pass. the faults are read again after the last io, so the
+// registry always ends as the latest faults even if they change meanwhile.
+func (g *ClockGuard) apply() {
+	g.ioMutex.Lock()
+	defer g.ioMutex.Unlock()
+	g.mutex.RLock()
+	workers, faulted, closed := g.workers, len(g.faults) > 0, g.closed
+	g.mutex.RUnlock()
+	if closed || workers == nil || faulted == g.deregistered {
+		return
+	}
+	if faulted {
+		workers.Deregister()
+	} else {
+		for _, workerId := range workers.WorkerIds() {
+			if err := RegWorkerId(workerId); err != nil {
+				Logger.Error("RegWorkerId() error", logger.F("worker_id", workerId), logger.Err(err))
+			}
+		}
+	}
+	g.deregistered = faulted
+}
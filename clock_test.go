@@ -0,0 +1,80 @@
+// Copyright © 2014 Terry Mao All rights reserved.
+// This file is part of gosnowflake.
+
+// gosnowflake is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// gosnowflake is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with gosnowflake.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"github.com/Terry-Mao/gosnowflake/registry"
+	"testing"
+	"time"
+)
+
+// slowRegistry blocks the deregistration until released.
+type slowRegistry struct {
+	registry.Registry
+	release chan bool
+}
+
+func (r *slowRegistry) Deregister(workerId int64) error {
+	<-r.release
+	return r.Registry.Deregister(workerId)
+}
+
+func TestClockGuard(t *testing.T) {
+	conf, oldReg := Conf(), reg
+	defer func() {
+		SetConf(conf)
+		reg = oldReg
+	}()
+	SetConf(&Config{Registry: registry.BackendMemory, WorkerId: []int64{0}, Twepoch: twepoch})
+	slow := &slowRegistry{Registry: registry.NewMemoryStore().Session(), release: make(chan bool)}
+	reg = slow
+	defer reg.Close()
+	workers, err := NewWorkers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := NewClockGuard()
+	g.SetWorkers(workers)
+	done := make(chan bool)
+	go func() {
+		g.Fault(clockCheckPeers, ErrClockSkew)
+		done <- true
+	}()
+	// the fault is seen while the registry is still busy
+	deadline := time.Now().Add(time.Second)
+	for g.Err() != ErrClockSkew {
+		if time.Now().After(deadline) {
+			t.Fatal("the fault is not seen while the workers deregister")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	// recovered meanwhile, the workers end registered
+	recovered := make(chan bool)
+	go func() {
+		g.Fault(clockCheckPeers, nil)
+		recovered <- true
+	}()
+	close(slow.release)
+	<-done
+	<-recovered
+	if err = g.Err(); err != nil {
+		t.Fatalf("clock guard error(%v), expected recovered", err)
+	}
+	if role, _ := reg.Role(0); role != registry.RoleLeader {
+		t.Fatalf("role: %s, expected %s", role, registry.RoleLeader)
+	}
+}
@@ -17,35 +17,112 @@
 package main
 
 import (
+	"errors"
 	"flag"
+	"fmt"
 	"github.com/Terry-Mao/goconf"
+	"github.com/Terry-Mao/gosnowflake/logger"
+	"net"
+	"os"
 	"runtime"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 )
 
+const (
+	// workerAuto claim the lowest free worker id from the registry.
+	workerAuto = "auto"
+	// workerHostnameOrdinal derive the worker id from the hostname ordinal,
+	// such as the kubernetes statefulset pod "snowflake-7" => 7.
+	workerHostnameOrdinal = "hostname-ordinal"
+	// workerIPLowBits derive the worker id from the low bits of the host
+	// ipv4 address, see workerIP.
+	workerIPLowBits = "ip-low-bits"
+	// routeProbeAddr is dialed by udp to get the source address of the
+	// default route, no packet is sent (TEST-NET-1).
+	routeProbeAddr = "192.0.2.1:9"
+)
+
+var (
+	// the name prefixes of the bridge and virtual interfaces
+	bridgePrefixes = []string{"docker", "br-", "virbr", "veth", "cni", "flannel", "cali", "lxcbr"}
+)
+
 var (
 	// global config object
 	goConf   = goconf.New()
-	MyConf   *Config
+	myConf   atomic.Value // *Config
 	confPath string
 )
 
+// Conf get the current config, the reload swaps it as a whole, keep the
+// returned one for a consistent view.
+func Conf() *Config {
+	c, _ := myConf.Load().(*Config)
+	return c
+}
+
+// SetConf set the current config.
+func SetConf(c *Config) {
+	myConf.Store(c)
+}
+
 type Config struct {
 	PidFile      string        `goconf:"base:pid"`
 	Dir          string        `goconf:"base:dir"`
+	User         string        `goconf:"base:user"`
+	Group        string        `goconf:"base:group"`
 	Log          string        `goconf:"base:log"`
+	LogFormat    string        `goconf:"base:log.format"`
+	LogLevel     string        `goconf:"base:log.level"`
 	MaxProc      int           `goconf:"base:maxproc"`
 	RPCBind      []string      `goconf:"base:rpc.bind:,"`
 	ThriftBind   []string      `goconf:"base:thrift.bind:,"`
 	StatBind     []string      `goconf:"base:stat.bind:,"`
 	PprofBind    []string      `goconf:"base:pprof.bind:,"`
+	AdminBind    []string      `goconf:"admin:bind:,"`
+	AdminToken   string        `goconf:"admin:token"`
+	AdminAllow   []string      `goconf:"admin:allow:,"`
+	DrainTimeout time.Duration `goconf:"base:shutdown.timeout:time"`
 	DatacenterId int64         `goconf:"snowflake:datacenter"`
-	WorkerId     []int64       `goconf:"snowflake:worker"`
+	Cluster      string        `goconf:"snowflake:cluster"`
+	Worker       []string      `goconf:"snowflake:worker:,"`
+	WorkerIface  string        `goconf:"snowflake:worker.iface"`
 	Start        string        `goconf:"snowflake:start"`
+	MaxBorrow    time.Duration `goconf:"snowflake:hlc.borrow:time"`
 	ZKAddr       []string      `goconf:"zookeeper:addr"`
-	ZKTimeout    time.Duration `goconf:"zookeeper:timeout:time`
+	ZKTimeout    time.Duration `goconf:"zookeeper:timeout:time"`
 	ZKPath       string        `goconf:"zookeeper:path"`
+	ZKLegacy     string        `goconf:"zookeeper:legacy.path"`
+	EtcdAddr     []string      `goconf:"etcd:addr:,"`
+	EtcdTimeout  time.Duration `goconf:"etcd:timeout:time"`
+	EtcdPath     string        `goconf:"etcd:path"`
+	Registry     string        `goconf:"registry:backend"`
+	StaticFile   string        `goconf:"registry:static.file"`
+	SkewInterval time.Duration `goconf:"clock:peer.interval:time"`
+	MaxSkew      time.Duration `goconf:"clock:peer.skew:time"`
+	SkewTimeout  time.Duration `goconf:"clock:peer.timeout:time"`
+	PeerQuorum   int           `goconf:"clock:peer.quorum"`
+	NTPServers   []string      `goconf:"clock:ntp.servers:,"`
+	NTPInterval  time.Duration `goconf:"clock:ntp.interval:time"`
+	NTPMaxOffset time.Duration `goconf:"clock:ntp.offset:time"`
+	NTPTimeout   time.Duration `goconf:"clock:ntp.timeout:time"`
+	AuditFile    string        `goconf:"audit:file"`
+	AuditSize    int64         `goconf:"audit:rotate.size:memory"`
+	AuditKeep    int           `goconf:"audit:rotate.keep"`
+	AuditBuffer  int           `goconf:"audit:buffer"`
+	AuditFlush   time.Duration `goconf:"audit:flush:time"`
+	AuditWait    time.Duration `goconf:"audit:wait:time"`
+	AuditDrop    bool          `goconf:"audit:drop"`
+	TraceExport  string        `goconf:"trace:exporter"`
+	TraceAddr    string        `goconf:"trace:otlp.endpoint"`
+	TraceTLS     bool          `goconf:"trace:otlp.tls"`
 	Twepoch      int64
+	WorkerId     []int64 // static worker ids
+	DeriveWorker []int64 // worker ids derived from the host, claimed from the registry
+	AutoWorker   int     // worker ids claimed from the registry
 }
 
 func init() {
@@ -54,31 +131,227 @@ func init() {
 
 // Init init the configuration file.
 func InitConfig() (err error) {
-	var twepoch time.Time
-	MyConf = &Config{
+	if err = goConf.Parse(confPath); err != nil {
+		return
+	}
+	c, err := loadConfig(goConf)
+	if err != nil {
+		return
+	}
+	SetConf(c)
+	return
+}
+
+// loadConfig unmarshal the parsed configuration file over the defaults.
+func loadConfig(gc *goconf.Config) (*Config, error) {
+	c := &Config{
 		PidFile:      "/tmp/gosnowflake.pid",
 		Dir:          "/dev/null",
 		Log:          "./log/xml",
+		LogFormat:    logFormatLog4go,
+		LogLevel:     "info",
 		MaxProc:      runtime.NumCPU(),
 		RPCBind:      []string{"localhost:8080"},
 		ThriftBind:   []string{"localhost:8081"},
+		DrainTimeout: time.Second * 10,
+		AdminAllow:   []string{"127.0.0.1", "::1"},
 		DatacenterId: 0,
-		WorkerId:     []int64{0},
+		Worker:       []string{"0"},
 		Start:        "2010-11-04 09:42:54",
 		ZKAddr:       []string{"localhost:2181"},
 		ZKTimeout:    time.Second * 15,
 		ZKPath:       "/gosnowflake-servers",
+		EtcdAddr:     []string{"localhost:2379"},
+		EtcdTimeout:  time.Second * 15,
+		EtcdPath:     "/gosnowflake-servers",
+		Registry:     "zookeeper",
+		StaticFile:   "./gosnowflake-peers.json",
+		SkewInterval: time.Second * 10,
+		MaxSkew:      time.Second,
+		SkewTimeout:  time.Second,
+		PeerQuorum:   50,
+		NTPInterval:  time.Minute,
+		NTPMaxOffset: time.Second,
+		NTPTimeout:   time.Second,
+		AuditSize:    100 << 20,
+		AuditKeep:    10,
+		AuditBuffer:  65536,
+		AuditFlush:   time.Second,
+		AuditWait:    time.Second,
+		TraceExport:  traceExporterNone,
+		TraceAddr:    "localhost:4317",
 	}
-	if err = goConf.Parse(confPath); err != nil {
-		return
+	if err := gc.Unmarshal(c); err != nil {
+		return nil, err
 	}
-	if err = goConf.Unmarshal(MyConf); err != nil {
-		return
+	if c.PeerQuorum < 0 || c.PeerQuorum > 100 {
+		return nil, fmt.Errorf("clock peer.quorum: %d out of range [0, 100]", c.PeerQuorum)
 	}
-	if twepoch, err = time.Parse("2006-01-02 15:04:05", MyConf.Start); err != nil {
-		return
-	} else {
-		MyConf.Twepoch = twepoch.UnixNano() / int64(time.Millisecond)
+	if c.LogFormat != logFormatLog4go && c.LogFormat != logFormatJSON {
+		return nil, fmt.Errorf("base log.format: \"%s\" is not \"%s\" or \"%s\"", c.LogFormat, logFormatLog4go, logFormatJSON)
 	}
-	return
+	if _, err := logger.ParseLevel(c.LogLevel); err != nil {
+		return nil, err
+	}
+	if c.AuditKeep < 1 || c.AuditBuffer < 1 || c.AuditFlush <= 0 || c.AuditWait <= 0 {
+		return nil, fmt.Errorf("audit rotate.keep: %d, buffer: %d, flush: %s and wait: %s must be positive", c.AuditKeep, c.AuditBuffer, c.AuditFlush, c.AuditWait)
+	}
+	if c.TraceExport != traceExporterNone && c.TraceExport != traceExporterStdout && c.TraceExport != traceExporterOTLP {
+		return nil, fmt.Errorf("trace exporter: \"%s\" is not \"%s\", \"%s\" or \"%s\"", c.TraceExport, traceExporterNone, traceExporterStdout, traceExporterOTLP)
+	}
+	if _, err := parseAllow(c.AdminAllow); err != nil {
+		return nil, err
+	}
+	twepoch, err := time.Parse("2006-01-02 15:04:05", c.Start)
+	if err != nil {
+		return nil, err
+	}
+	c.Twepoch = twepoch.UnixNano() / int64(time.Millisecond)
+	if err = c.parseWorker(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// parseWorker resolve the worker list into static, derived and auto worker
+// ids.
+func (c *Config) parseWorker() error {
+	c.WorkerId = nil
+	c.DeriveWorker = nil
+	c.AutoWorker = 0
+	for _, worker := range c.Worker {
+		switch worker {
+		case workerAuto:
+			c.AutoWorker++
+		case workerHostnameOrdinal:
+			hostname, err := os.Hostname()
+			if err != nil {
+				return err
+			}
+			workerId, err := hostnameOrdinal(hostname)
+			if err != nil {
+				return err
+			}
+			c.DeriveWorker = append(c.DeriveWorker, workerId)
+		case workerIPLowBits:
+			ip, err := workerIP(c.WorkerIface, c.RPCBind)
+			if err != nil {
+				return err
+			}
+			c.DeriveWorker = append(c.DeriveWorker, ipLowBits(ip))
+		default:
+			workerId, err := strconv.ParseInt(worker, 10, 64)
+			if err != nil {
+				return fmt.Errorf("snowflake worker: \"%s\" is not a worker id, \"%s\", \"%s\" or \"%s\"", worker, workerAuto, workerHostnameOrdinal, workerIPLowBits)
+			}
+			c.WorkerId = append(c.WorkerId, workerId)
+		}
+	}
+	return nil
+}
+
+// hostnameOrdinal get the number after the last "-" of the hostname.
+func hostnameOrdinal(hostname string) (int64, error) {
+	// strip the domain
+	if i := strings.Index(hostname, "."); i > 0 {
+		hostname = hostname[:i]
+	}
+	i := strings.LastIndex(hostname, "-")
+	if i < 0 {
+		return 0, fmt.Errorf("snowflake worker: hostname \"%s\" has no ordinal suffix", hostname)
+	}
+	workerId, err := strconv.ParseInt(hostname[i+1:], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("snowflake worker: hostname \"%s\" has no ordinal suffix", hostname)
+	}
+	if workerId > maxWorkerId {
+		return 0, fmt.Errorf("snowflake worker: hostname \"%s\" ordinal %d out of range [0, %d]", hostname, workerId, maxWorkerId)
+	}
+	return workerId, nil
+}
+
+// ipLowBits get the low worker id bits of the ipv4.
+func ipLowBits(ip net.IP) int64 {
+	return int64(ip.To4()[3]) & maxWorkerId
+}
+
+// workerIP get the ipv4 the worker id is derived from: the address of the
+// named interface if set, else the ip of a rpc bind, else the source address
+// of the default route. the loopback, link-local and bridge interface (such
+// as docker0, which has the same address on every host) addresses are
+// rejected unless the interface is named.
+func workerIP(iface string, binds []string) (net.IP, error) {
+	if iface != "" {
+		i, err := net.InterfaceByName(iface)
+		if err != nil {
+			return nil, fmt.Errorf("snowflake worker.iface: \"%s\" error(%v)", iface, err)
+		}
+		addrs, err := i.Addrs()
+		if err != nil {
+			return nil, err
+		}
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok && usableIPv4(ipNet.IP) {
+				return ipNet.IP.To4(), nil
+			}
+		}
+		return nil, fmt.Errorf("snowflake worker.iface: \"%s\" has no usable ipv4 address", iface)
+	}
+	for _, bind := range binds {
+		host, _, err := net.SplitHostPort(bind)
+		if err != nil {
+			continue
+		}
+		if ip := net.ParseIP(host); usableIPv4(ip) && !onBridge(ip) {
+			return ip.To4(), nil
+		}
+	}
+	conn, err := net.Dial("udp4", routeProbeAddr)
+	if err != nil {
+		return nil, fmt.Errorf("snowflake worker: no default route, set worker.iface: %v", err)
+	}
+	defer conn.Close()
+	if ip := conn.LocalAddr().(*net.UDPAddr).IP; usableIPv4(ip) && !onBridge(ip) {
+		return ip.To4(), nil
+	}
+	return nil, errors.New("snowflake worker: no usable ipv4 address of the default route, set worker.iface")
+}
+
+// usableIPv4 check the ip is an ipv4 neither loopback, link-local nor
+// unspecified.
+func usableIPv4(ip net.IP) bool {
+	return ip.To4() != nil && !ip.IsLoopback() && !ip.IsLinkLocalUnicast() && !ip.IsUnspecified()
+}
+
+// onBridge check the ip belongs to a bridge or virtual interface.
+func onBridge(ip net.IP) bool {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return false
+	}
+	for _, i := range ifaces {
+		addrs, err := i.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+				return bridgeIface(i.Name)
+			}
+		}
+	}
+	return false
+}
+
+// bridgeIface check the interface is a linux bridge or a known virtual one.
+func bridgeIface(name string) bool {
+	if _, err := os.Stat("/sys/class/net/" + name + "/bridge"); err == nil {
+		return true
+	}
+	for _, prefix := range bridgePrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
 }
@@ -0,0 +1,80 @@
+// Copyright © 2014 Terry Mao All rights reserved.
+// This file is part of gosnowflake.
+
+// gosnowflake is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// gosnowflake is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with gosnowflake.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestHostnameOrdinal(t *testing.T) {
+	for hostname, expected := range map[string]int64{
+		"snowflake-7":                       7,
+		"snowflake-0.snowflake.default.svc": 0,
+		"gosnowflake-prod-31.example.com":   31,
+		"snowflake-worker-12":               12,
+	} {
+		workerId, err := hostnameOrdinal(hostname)
+		if err != nil {
+			t.Fatalf("hostnameOrdinal(\"%s\") error(%v)", hostname, err)
+		}
+		if workerId != expected {
+			t.Fatalf("hostnameOrdinal(\"%s\") = %d, expected %d", hostname, workerId, expected)
+		}
+	}
+	for _, hostname := range []string{"snowflake", "snowflake-a", "snowflake-32"} {
+		if _, err := hostnameOrdinal(hostname); err == nil {
+			t.Fatalf("hostnameOrdinal(\"%s\") expected error", hostname)
+		}
+	}
+}
+
+func TestIPLowBits(t *testing.T) {
+	if workerId := ipLowBits(net.ParseIP("10.0.1.45")); workerId != 45&maxWorkerId {
+		t.Fatalf("ipLowBits() = %d, expected %d", workerId, 45&maxWorkerId)
+	}
+	for ip, usable := range map[string]bool{"10.0.1.45": true, "127.0.0.1": false, "169.254.1.2": false, "0.0.0.0": false, "::1": false, "fe80::1": false} {
+		if usableIPv4(net.ParseIP(ip)) != usable {
+			t.Fatalf("usableIPv4(%s) expected %v", ip, usable)
+		}
+	}
+	for name, bridge := range map[string]bool{"docker0": true, "br-4f2a": true, "veth12ab": true, "eth0": false} {
+		if bridgeIface(name) != bridge {
+			t.Fatalf("bridgeIface(%s) expected %v", name, bridge)
+		}
+	}
+	// the rpc bind ip
+	ip, err := workerIP("", []string{":8080", "127.0.0.1:8080", "10.0.1.45:8080"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ip.Equal(net.ParseIP("10.0.1.45")) {
+		t.Fatalf("workerIP() = %s, expected the rpc bind 10.0.1.45", ip)
+	}
+	// the loopback interface has no usable address
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, i := range ifaces {
+		if i.Flags&net.FlagLoopback != 0 {
+			if _, err = workerIP(i.Name, nil); err == nil {
+				t.Fatalf("workerIP(\"%s\") expected error", i.Name)
+			}
+		}
+	}
+}
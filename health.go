@@ -0,0 +1,200 @@
+// Copyright © 2014 Terry Mao All rights reserved.
+// This file is part of gosnowflake.
+
+// gosnowflake is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// gosnowflake is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with gosnowflake.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/Terry-Mao/gosnowflake/logger"
+	"github.com/Terry-Mao/gosnowflake/registry"
+	myrpc "github.com/Terry-Mao/gosnowflake/rpc"
+	"net/http"
+	"sync"
+	"time"
+)
+
+/*
+   health check
+   ============
+   rpc         fail if the rpc server is not listening or a worker is blocked,
+               the only check of liveness.
+   registry    fail if the registry session is not open.
+   worker.<id> fail unless the worker is registered as the leader, a standby
+               must not serve.
+   clock       fail on any clock guard fault (peers, ntp), warn if the clock
+               moved backwards recently or the peer skew is over half of
+               "clock:peer.skew".
+   epoch       fail if the timestamp bits overflowed, warn if less than a
+               year is left.
+
+   live is the rpc check, ready is live and no check failed. they are served
+   by "SnowflakeRPC.Health" and the admin "/healthz" and "/readyz".
+*/
+
+const (
+	healthRegressionWindow = 5 * time.Minute
+	healthEpochHeadroom    = 365 * 24 * time.Hour
+	healthCacheExpire      = time.Second
+)
+
+var (
+	// global health cache for the rpc, clients ping every second
+	healthCache = &HealthCache{}
+)
+
+// checkHealth run all health checks.
+func checkHealth(workers *Workers) *myrpc.HealthReply {
+	now := time.Now()
+	reply := &myrpc.HealthReply{}
+	rpcCheck := &myrpc.HealthCheck{Name: "rpc", Status: myrpc.HealthOK}
+	if serving(workers) {
+		reply.Live = true
+	} else {
+		rpcCheck.Status, rpcCheck.Detail = myrpc.HealthFail, "not listening"
+	}
+	reply.Checks = append(reply.Checks, rpcCheck, checkRegistryHealth())
+	reply.Checks = append(reply.Checks, checkWorkersHealth(workers)...)
+	reply.Checks = append(reply.Checks, checkClockHealth(workers, now), checkEpochHealth(now))
+	reply.Ready = reply.Live
+	for _, c := range reply.Checks {
+		if c.Status == myrpc.HealthFail {
+			reply.Ready = false
+		}
+	}
+	return reply
+}
+
+// checkRegistryHealth check the registry session.
+func checkRegistryHealth() *myrpc.HealthCheck {
+	c := &myrpc.HealthCheck{Name: "registry", Status: myrpc.HealthOK}
+	if reg == nil {
+		c.Status, c.Detail = myrpc.HealthFail, "not initialized"
+	} else if state := reg.State(); state != registry.StateOpen {
+		c.Status, c.Detail = myrpc.HealthFail, fmt.Sprintf("%s session %s", Conf().Registry, state)
+	}
+	return c
+}
+
+// checkWorkersHealth check every worker leads its workerId.
+func checkWorkersHealth(workers *Workers) []*myrpc.HealthCheck {
+	ids := workers.WorkerIds()
+	checks := make([]*myrpc.HealthCheck, 0, len(ids))
+	for _, workerId := range ids {
+		c := &myrpc.HealthCheck{Name: fmt.Sprintf("worker.%d", workerId), Status: myrpc.HealthFail}
+		checks = append(checks, c)
+		if reg == nil {
+			c.Detail = "no registry"
+			continue
+		}
+		role, err := reg.Role(workerId)
+		switch {
+		case err == registry.ErrNotSupported:
+			c.Status, c.Detail = myrpc.HealthOK, fmt.Sprintf("%s registry, role unknown", Conf().Registry)
+		case err != nil:
+			Logger.Error("reg.Role() error", logger.F("worker_id", workerId), logger.Err(err))
+			c.Detail = err.Error()
+		case role == registry.RoleLeader:
+			c.Status = myrpc.HealthOK
+		default:
+			c.Detail = role
+		}
+	}
+	return checks
+}
+
+// checkClockHealth check the clock guard, the recent clock regressions and
+// the peer skew.
+func checkClockHealth(workers *Workers, now time.Time) *myrpc.HealthCheck {
+	conf := Conf()
+	skew := MyStat.PeerSkew()
+	c := &myrpc.HealthCheck{Name: "clock", Status: myrpc.HealthOK, Detail: fmt.Sprintf("peer skew %dms, ntp offset %dms", skew, MyStat.NTPOffset())}
+	if err := clockGuard.Err(); err != nil {
+		c.Status, c.Detail = myrpc.HealthFail, err.Error()
+		return c
+	}
+	for _, ws := range collectWorkerStats(workers) {
+		if ws.Regressed == 0 {
+			continue
+		}
+		if ago := time.Duration(now.UnixNano()/int64(time.Millisecond)-ws.Regressed) * time.Millisecond; ago < healthRegressionWindow {
+			c.Status, c.Detail = myrpc.HealthWarn, fmt.Sprintf("workerId: %d clock moved backwards %s ago", ws.WorkerId, ago)
+			return c
+		}
+	}
+	if getSkewMonitor() != nil && conf.MaxSkew > 0 {
+		if skew < 0 {
+			skew = -skew
+		}
+		if time.Duration(skew)*time.Millisecond > conf.MaxSkew/2 {
+			c.Status = myrpc.HealthWarn
+		}
+	}
+	return c
+}
+
+// checkEpochHealth check the time left until the timestamp bits overflow.
+func checkEpochHealth(now time.Time) *myrpc.HealthCheck {
+	left := time.Duration(epochHeadroom(Conf().Twepoch, now.UnixNano()/int64(time.Millisecond))) * time.Millisecond
+	c := &myrpc.HealthCheck{Name: "epoch", Status: myrpc.HealthOK, Detail: fmt.Sprintf("%d days left", int64(left/(24*time.Hour)))}
+	if left <= 0 {
+		c.Status, c.Detail = myrpc.HealthFail, "timestamp bits overflowed"
+	} else if left < healthEpochHeadroom {
+		c.Status = myrpc.HealthWarn
+	}
+	return c
+}
+
+// HealthCache cache the health checks for a while.
+type HealthCache struct {
+	mutex  sync.Mutex
+	reply  *myrpc.HealthReply
+	expire time.Time
+}
+
+// Get get the cached health checks, run them again if expired.
+func (c *HealthCache) Get(workers *Workers) *myrpc.HealthReply {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if now := time.Now(); c.reply == nil || now.After(c.expire) {
+		c.reply = checkHealth(workers)
+		c.expire = now.Add(healthCacheExpire)
+	}
+	return c.reply
+}
+
+// healthHandler get the health checks in json, the status is 503 if not live
+// (or not ready if ready is true).
+func healthHandler(workers *Workers, ready bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		reply := checkHealth(workers)
+		d, err := json.Marshal(reply)
+		if err != nil {
+			Logger.Error("json.Marshal() error", logger.Err(err))
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		if (ready && !reply.Ready) || !reply.Live {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		w.Write(d)
+	}
+}
@@ -0,0 +1,171 @@
+// Copyright © 2014 Terry Mao All rights reserved.
+// This file is part of gosnowflake.
+
+// gosnowflake is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// gosnowflake is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with gosnowflake.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/Terry-Mao/gosnowflake/registry"
+	myrpc "github.com/Terry-Mao/gosnowflake/rpc"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// healthStatus get the status of the named check, empty if missing.
+func healthStatus(reply *myrpc.HealthReply, name string) string {
+	for _, c := range reply.Checks {
+		if c.Name == name {
+			return c.Status
+		}
+	}
+	return ""
+}
+
+// setupStandby set the config and a memory registry on which another
+// process, the returned session, leads the worker 1, then start the workers
+// of the config without rpc server. the config, registry and rpc server are
+// restored when the test ends.
+func setupStandby(t *testing.T, c *Config) (*Workers, registry.Registry) {
+	conf, oldReg, oldServer := Conf(), reg, rpcServer
+	t.Cleanup(func() {
+		SetConf(conf)
+		reg = oldReg
+		rpcServer = oldServer
+	})
+	SetConf(c)
+	rpcServer = nil
+	store := registry.NewMemoryStore()
+	other := store.Session()
+	t.Cleanup(func() { other.Close() })
+	if err := other.Register(1, &registry.Peer{RPC: []string{"10.0.0.1:8080"}}); err != nil {
+		t.Fatal(err)
+	}
+	session := store.Session()
+	t.Cleanup(func() { session.Close() })
+	reg = session
+	workers, err := NewWorkers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return workers, other
+}
+
+func TestHealth(t *testing.T) {
+	workers, other := setupStandby(t, &Config{Registry: registry.BackendMemory, WorkerId: []int64{0, 1}, Twepoch: twepoch})
+	if reply := checkHealth(workers); reply.Live || reply.Ready || healthStatus(reply, "rpc") != myrpc.HealthFail {
+		t.Fatalf("health without the rpc server: %+v", reply)
+	}
+	rpcServer = NewRPCServer()
+	defer rpcServer.Close(0)
+	if err := rpcServer.Listen("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	reply := checkHealth(workers)
+	if !reply.Live || reply.Ready {
+		t.Fatalf("health with a standby worker: %+v", reply)
+	}
+	for name, status := range map[string]string{"rpc": myrpc.HealthOK, "registry": myrpc.HealthOK, "worker.0": myrpc.HealthOK, "worker.1": myrpc.HealthFail, "clock": myrpc.HealthOK, "epoch": myrpc.HealthOK} {
+		if s := healthStatus(reply, name); s != status {
+			t.Fatalf("health check \"%s\": \"%s\", expected \"%s\"", name, s, status)
+		}
+	}
+	handler := newAdminServeMux(workers)
+	for path, code := range map[string]int{"/healthz": http.StatusOK, "/readyz": http.StatusServiceUnavailable} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		r := &myrpc.HealthReply{}
+		if err := json.Unmarshal(w.Body.Bytes(), r); err != nil {
+			t.Fatal(err)
+		}
+		if w.Code != code || len(r.Checks) != len(reply.Checks) {
+			t.Fatalf("GET %s status: %d, expected %d, checks: %d", path, w.Code, code, len(r.Checks))
+		}
+	}
+	// the other process gone, we lead the worker 1
+	other.Close()
+	deadline := time.Now().Add(time.Second)
+	for !checkHealth(workers).Ready {
+		if time.Now().After(deadline) {
+			t.Fatalf("health after taking over the worker 1: %+v", checkHealth(workers))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// a recent clock regression warns
+	worker, _ := workers.Get(0)
+	worker.mutex.Lock()
+	worker.regressed = timeGen() - 1000
+	worker.mutex.Unlock()
+	if reply = checkHealth(workers); !reply.Ready || healthStatus(reply, "clock") != myrpc.HealthWarn {
+		t.Fatalf("health after a clock regression: %+v", reply)
+	}
+	worker.mutex.Lock()
+	worker.regressed = timeGen() - int64(healthRegressionWindow/time.Millisecond) - 1000
+	worker.mutex.Unlock()
+	if reply = checkHealth(workers); healthStatus(reply, "clock") != myrpc.HealthOK {
+		t.Fatalf("health after an old clock regression: %+v", reply)
+	}
+	// a clock fault fails
+	old := clockGuard
+	clockGuard = NewClockGuard()
+	defer func() { clockGuard = old }()
+	clockGuard.Fault(clockCheckPeers, errors.New("skewed"))
+	if reply = checkHealth(workers); reply.Ready || healthStatus(reply, "clock") != myrpc.HealthFail {
+		t.Fatalf("health with a clock fault: %+v", reply)
+	}
+	// the epoch headroom
+	now := time.Now()
+	ms := now.UnixNano() / int64(time.Millisecond)
+	for _, c := range []struct {
+		twepoch int64
+		status  string
+	}{
+		{twepoch, myrpc.HealthOK},
+		{ms - maxTimestamp + int64(30*24*time.Hour/time.Millisecond), myrpc.HealthWarn},
+		{ms - maxTimestamp - 1, myrpc.HealthFail},
+	} {
+		Conf().Twepoch = c.twepoch
+		if s := checkEpochHealth(now).Status; s != c.status {
+			t.Fatalf("checkEpochHealth() twepoch: %d, status: \"%s\", expected \"%s\"", c.twepoch, s, c.status)
+		}
+	}
+}
+
+func TestRegistryHealth(t *testing.T) {
+	conf, oldReg := Conf(), reg
+	defer func() {
+		SetConf(conf)
+		reg = oldReg
+	}()
+	SetConf(&Config{Registry: registry.BackendZookeeper})
+	// the zookeeper states are mapped, no zookeeper listens
+	z, err := registry.NewZookeeperWatcher([]string{"127.0.0.1:1"}, "/gosnowflake-test", "", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer z.Close()
+	reg = z
+	if c := checkRegistryHealth(); c.Status != myrpc.HealthFail || c.Detail != "zookeeper session "+registry.StateConnecting {
+		t.Fatalf("registry health: %+v", c)
+	}
+	reg = registry.NewMemoryStore().Session()
+	defer reg.Close()
+	if c := checkRegistryHealth(); c.Status != myrpc.HealthOK {
+		t.Fatalf("registry health: %+v", c)
+	}
+}
@@ -19,9 +19,12 @@
 package main
 
 import (
-	log "github.com/alecthomas/log4go"
+	"context"
 	"errors"
 	"fmt"
+	"github.com/Terry-Mao/gosnowflake/logger"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"sync"
 	"time"
 )
@@ -38,26 +41,37 @@ const (
 	timestampLeftShift = sequenceBits + workerIdBits + datacenterIdBits
 	sequenceMask       = -1 ^ (-1 << sequenceBits)
 	maxNextIdsNum      = 100
+	maxTimestamp       = -1 ^ (-1 << (63 - timestampLeftShift)) // milliseconds since twepoch
+	maxSequenceWait    = 2                                      // milliseconds the sequence overflow waits the wall clock
 )
 
 type IdWorker struct {
 	sequence      int64
 	lastTimestamp int64
+	lastWall      int64 // the wall clock of the last call
 	workerId      int64
 	twepoch       int64
 	datacenterId  int64
+	maxBorrow     int64 // hybrid logical clock max lead milliseconds, 0 is disabled
+	borrowing     bool
 	mutex         sync.Mutex
+	// stat
+	issued    int64
+	errors    int64
+	backwards int64 // wall clock moved backwards events
+	exhausted int64 // sequence exhausted in a millisecond
+	regressed int64 // wall milliseconds of the last clock backwards, 0 if never
 }
 
 // NewIdWorker new a snowflake id generator object.
 func NewIdWorker(workerId, datacenterId int64, twepoch int64) (*IdWorker, error) {
 	idWorker := &IdWorker{}
 	if workerId > maxWorkerId || workerId < 0 {
-		log.Error("worker Id can't be greater than %d or less than 0", maxWorkerId)
+		Logger.Error("worker id out of range", logger.F("worker_id", workerId), logger.F("max", maxWorkerId))
 		return nil, errors.New(fmt.Sprintf("worker Id: %d error", workerId))
 	}
 	if datacenterId > maxDatacenterId || datacenterId < 0 {
-		log.Error("datacenter Id can't be greater than %d or less than 0", maxDatacenterId)
+		Logger.Error("datacenter id out of range", logger.F("datacenter_id", datacenterId), logger.F("max", maxDatacenterId))
 		return nil, errors.New(fmt.Sprintf("datacenter Id: %d error", datacenterId))
 	}
 	idWorker.workerId = workerId
@@ -66,10 +80,26 @@ func NewIdWorker(workerId, datacenterId int64, twepoch int64) (*IdWorker, error)
 	idWorker.sequence = 0
 	idWorker.twepoch = twepoch
 	idWorker.mutex = sync.Mutex{}
-	log.Debug("worker starting. timestamp left shift %d, datacenter id bits %d, worker id bits %d, sequence bits %d, workerid %d", timestampLeftShift, datacenterIdBits, workerIdBits, sequenceBits, workerId)
+	Logger.Debug("worker starting", logger.F("worker_id", workerId), logger.F("timestamp_left_shift", timestampLeftShift), logger.F("datacenter_id_bits", datacenterIdBits), logger.F("worker_id_bits", workerIdBits), logger.F("sequence_bits", sequenceBits))
 	return idWorker, nil
 }
 
+// epochHeadroom get the milliseconds left until the timestamp overflows the
+// timestamp bits, negative if already overflowed.
+func epochHeadroom(twepoch, now int64) int64 {
+	return twepoch + maxTimestamp - now
+}
+
+// decodeId split the id into the unix milliseconds, datacenterId, workerId
+// and sequence.
+func decodeId(id, twepoch int64) (timestamp, datacenterId, workerId, sequence int64) {
+	timestamp = (id >> timestampLeftShift) + twepoch
+	datacenterId = (id >> datacenterIdShift) & maxDatacenterId
+	workerId = (id >> workerIdShift) & maxWorkerId
+	sequence = id & sequenceMask
+	return
+}
+
 // timeGen generate a unix millisecond.
 func timeGen() int64 {
 	return time.Now().UnixNano() / int64(time.Millisecond)
@@ -84,52 +114,139 @@ func tilNextMillis(lastTimestamp int64) int64 {
 	return timestamp
 }
 
-// NextId get a snowflake id.
-func (id *IdWorker) NextId() (int64, error) {
+// Lead get the milliseconds the worker is running ahead of the wall clock.
+func (id *IdWorker) Lead() int64 {
+	id.mutex.Lock()
+	defer id.mutex.Unlock()
+	if lead := id.lastTimestamp - timeGen(); lead > 0 {
+		return lead
+	}
+	return 0
+}
+
+// Stat get the worker's counters and current state.
+func (id *IdWorker) Stat() *WorkerStat {
 	id.mutex.Lock()
 	defer id.mutex.Unlock()
+	return &WorkerStat{
+		WorkerId:      id.workerId,
+		Issued:        id.issued,
+		Errors:        id.errors,
+		Backwards:     id.backwards,
+		Exhausted:     id.exhausted,
+		Regressed:     id.regressed,
+		LastTimestamp: id.lastTimestamp,
+		Sequence:      id.sequence,
+	}
+}
+
+// next generate the next id, must hold the mutex.
+//
+// if the hybrid logical clock is enabled (maxBorrow > 0), when the clock
+// moves backwards or the sequence overflows, the worker keeps advancing the
+// logical timestamp from the last timestamp, borrowing the future
+// milliseconds up to maxBorrow, and converges back once the wall clock
+// catches up. the sequence overflow beyond the bound is rejected instead of
+// spinning under the mutex until the wall clock catches up, only a wait of
+// maxSequenceWait milliseconds is allowed.
+//
+// only a drop of the wall clock itself is counted as a clock regression,
+// not the logical timestamp running ahead of it on purpose.
+//
+// the waits for the next millisecond are traced as spans of ctx, the
+// rejection as an event.
+func (id *IdWorker) next(ctx context.Context) (int64, error) {
 	timestamp := timeGen()
+	wall := timestamp
+	if wall < id.lastWall {
+		id.backwards++
+		id.regressed = wall
+		metricClockBackwards.Observe(float64(id.lastWall-wall) / 1000)
+	}
+	id.lastWall = wall
 	if timestamp < id.lastTimestamp {
-		log.Error("clock is moving backwards.  Rejecting requests until %d.", id.lastTimestamp)
-		return 0, errors.New(fmt.Sprintf("Clock moved backwards.  Refusing to generate id for %d milliseconds", id.lastTimestamp-timestamp))
+		if id.lastTimestamp-timestamp > id.maxBorrow {
+			id.errors++
+			trace.SpanFromContext(ctx).AddEvent("clock moved backwards", trace.WithAttributes(attribute.Int64("snowflake.backwards_ms", id.lastTimestamp-timestamp)))
+			Logger.Error("clock is moving backwards, rejecting requests", logger.F("worker_id", id.workerId), logger.F("until", id.lastTimestamp), logger.F("backwards_ms", id.lastTimestamp-timestamp))
+			return 0, errors.New(fmt.Sprintf("Clock moved backwards.  Refusing to generate id for %d milliseconds", id.lastTimestamp-timestamp))
+		}
+		timestamp = id.lastTimestamp
 	}
 	if id.lastTimestamp == timestamp {
 		id.sequence = (id.sequence + 1) & sequenceMask
 		if id.sequence == 0 {
-			timestamp = tilNextMillis(id.lastTimestamp)
+			id.exhausted++
+			if id.maxBorrow > 0 && timestamp+1-wall <= id.maxBorrow {
+				timestamp++
+			} else if timestamp+1-wall > maxSequenceWait {
+				id.sequence = sequenceMask
+				id.errors++
+				trace.SpanFromContext(ctx).AddEvent("sequence exhausted ahead of the clock", trace.WithAttributes(attribute.Int64("snowflake.lead_ms", timestamp-wall)))
+				Logger.Error("sequence exhausted ahead of the clock, rejecting requests", logger.F("worker_id", id.workerId), logger.F("until", timestamp), logger.F("lead_ms", timestamp-wall))
+				return 0, errors.New(fmt.Sprintf("Sequence exhausted %d milliseconds ahead of the clock.  Refusing to generate id", timestamp-wall))
+			} else {
+				// the logical clock still ahead after the clock moved
+				// backwards waits the wall clock catches up
+				name := spanSequenceWait
+				if id.lastTimestamp > wall {
+					name = spanClockWait
+				}
+				_, span := startSpan(ctx, name, trace.SpanKindInternal, attribute.Int64("snowflake.worker_id", id.workerId), attribute.Int64("snowflake.lead_ms", id.lastTimestamp-wall))
+				start := time.Now()
+				timestamp = tilNextMillis(id.lastTimestamp)
+				metricSequenceWait.Observe(time.Since(start).Seconds())
+				span.End()
+			}
 		}
 	} else {
 		id.sequence = 0
 	}
+	if borrowing := timestamp > wall; borrowing != id.borrowing {
+		id.borrowing = borrowing
+		if borrowing {
+			Logger.Warn("running ahead of the wall clock", logger.F("worker_id", id.workerId), logger.F("lead_ms", timestamp-wall))
+		} else {
+			Logger.Info("converged with the wall clock", logger.F("worker_id", id.workerId))
+		}
+	}
 	id.lastTimestamp = timestamp
+	id.issued++
 	return ((timestamp - id.twepoch) << timestampLeftShift) | (id.datacenterId << datacenterIdShift) | (id.workerId << workerIdShift) | id.sequence, nil
 }
 
+// NextId get a snowflake id.
+func (id *IdWorker) NextId() (int64, error) {
+	return id.NextIdContext(context.Background())
+}
+
+// NextIdContext get a snowflake id, the waits are traced as spans of ctx.
+func (id *IdWorker) NextIdContext(ctx context.Context) (int64, error) {
+	id.mutex.Lock()
+	defer id.mutex.Unlock()
+	return id.next(ctx)
+}
+
 // NextIds get snowflake ids.
 func (id *IdWorker) NextIds(num int) ([]int64, error) {
+	return id.NextIdsContext(context.Background(), num)
+}
+
+// NextIdsContext get snowflake ids, the waits are traced as spans of ctx.
+func (id *IdWorker) NextIdsContext(ctx context.Context, num int) ([]int64, error) {
 	if num > maxNextIdsNum || num < 0 {
-		log.Error("NextIds num can't be greater than %d or less than 0", maxNextIdsNum)
+		Logger.Error("NextIds num out of range", logger.F("worker_id", id.workerId), logger.F("num", num), logger.F("max", maxNextIdsNum))
 		return nil, errors.New(fmt.Sprintf("NextIds num: %d error", num))
 	}
 	ids := make([]int64, num)
 	id.mutex.Lock()
 	defer id.mutex.Unlock()
 	for i := 0; i < num; i++ {
-		timestamp := timeGen()
-		if timestamp < id.lastTimestamp {
-			log.Error("clock is moving backwards.  Rejecting requests until %d.", id.lastTimestamp)
-			return nil, errors.New(fmt.Sprintf("Clock moved backwards.  Refusing to generate id for %d milliseconds", id.lastTimestamp-timestamp))
-		}
-		if id.lastTimestamp == timestamp {
-			id.sequence = (id.sequence + 1) & sequenceMask
-			if id.sequence == 0 {
-				timestamp = tilNextMillis(id.lastTimestamp)
-			}
-		} else {
-			id.sequence = 0
+		tid, err := id.next(ctx)
+		if err != nil {
+			return nil, err
 		}
-		id.lastTimestamp = timestamp
-		ids[i] = ((timestamp - id.twepoch) << timestampLeftShift) | (id.datacenterId << datacenterIdShift) | (id.workerId << workerIdShift) | id.sequence
+		ids[i] = tid
 	}
 	return ids, nil
 }
@@ -19,6 +19,7 @@ package main
 import (
 	log "github.com/alecthomas/log4go"
 	"testing"
+	"time"
 )
 
 func TestID(t *testing.T) {
@@ -53,3 +54,96 @@ func BenchmarkID(b *testing.B) {
 		}
 	}
 }
+
+func TestHybridLogicalClock(t *testing.T) {
+	id, err := NewIdWorker(0, 0, twepoch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// clock moved backwards 50ms
+	id.lastTimestamp = timeGen() + 50
+	if _, err = id.NextId(); err == nil {
+		t.Fatal("NextId() expected clock backwards error")
+	}
+	id.maxBorrow = 100
+	last := id.lastTimestamp
+	sid, err := id.NextId()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if timestamp := sid>>timestampLeftShift + twepoch; timestamp != last {
+		t.Fatalf("id timestamp: %d, expected the logical timestamp %d", timestamp, last)
+	}
+	if lead := id.Lead(); lead <= 0 || lead > 50 {
+		t.Fatalf("lead: %dms, expected (0, 50]", lead)
+	}
+	// sequence overflow borrows the next millisecond
+	id.sequence = sequenceMask
+	if sid, err = id.NextId(); err != nil {
+		t.Fatal(err)
+	}
+	if timestamp := sid>>timestampLeftShift + twepoch; timestamp != last+1 {
+		t.Fatalf("id timestamp: %d, expected %d", timestamp, last+1)
+	}
+	// borrowing beyond the bound is refused
+	id.lastTimestamp = timeGen() + 200
+	if _, err = id.NextIds(10); err == nil {
+		t.Fatal("NextIds() expected clock backwards error")
+	}
+	// the sequence overflow at the bound is refused, not waited
+	id.lastTimestamp = timeGen() + 100
+	id.sequence = sequenceMask - 1
+	if _, err = id.NextId(); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if _, err = id.NextId(); err == nil {
+		t.Fatal("NextId() expected sequence exhausted error")
+	}
+	if wait := time.Since(start); wait > maxSequenceWait*time.Millisecond*10 {
+		t.Fatalf("NextId() waited %s", wait)
+	}
+	if id.sequence != sequenceMask {
+		t.Fatalf("sequence: %d, expected kept exhausted %d", id.sequence, sequenceMask)
+	}
+	// converge once the wall clock catches up
+	id.lastTimestamp = timeGen() + 5
+	time.Sleep(10 * time.Millisecond)
+	if _, err = id.NextId(); err != nil {
+		t.Fatal(err)
+	}
+	if lead := id.Lead(); lead != 0 {
+		t.Fatalf("lead: %dms, expected 0", lead)
+	}
+}
+
+func TestClockBackwards(t *testing.T) {
+	id, err := NewIdWorker(0, 0, twepoch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id.maxBorrow = 100
+	// a burst borrows the next milliseconds, no clock regression
+	for i := 0; i < 10; i++ {
+		id.sequence = sequenceMask
+		if _, err = id.NextIds(10); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if id.lastTimestamp <= id.lastWall {
+		t.Fatalf("last timestamp: %d, expected ahead of the wall clock %d", id.lastTimestamp, id.lastWall)
+	}
+	if id.backwards != 0 || id.regressed != 0 {
+		t.Fatalf("backwards: %d, regressed: %d, expected none while borrowing", id.backwards, id.regressed)
+	}
+	// the wall clock drops once
+	id.lastWall = timeGen() + 50
+	for i := 0; i < 3; i++ {
+		if _, err = id.NextId(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if id.backwards != 1 || id.regressed == 0 {
+		t.Fatalf("backwards: %d, regressed: %d, expected 1 regression", id.backwards, id.regressed)
+	}
+}
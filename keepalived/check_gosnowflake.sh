@@ -1,5 +1,7 @@
 #!/bin/bash -x
 gosnowflake_pid=/tmp/gosnowflake.pid
+# the admin.bind of gosnowflake
+gosnowflake_admin=127.0.0.1:6971
 keepalived_pid=/tmp/keepalived.pid
 role=/etc/keepalived/roles
 
@@ -11,15 +13,27 @@ function stop_keepalived {
     fi
 }
 
-# check gosnowflake service alive
+# check gosnowflake service alive, the running gosnowflake holds the pid file
+# lock (a stale pid may be reused by another process)
 function check_run_gosnowflake {
     if test ! -f ${gosnowflake_pid}
     then
         return 1
     fi
 
-    pid=$(cat ${gosnowflake_pid})
-    ps -p ${pid} > /dev/null
+    flock -n ${gosnowflake_pid} true
+    if test $? -eq 0
+    then
+        return 1
+    fi
+
+    return 0
+}
+
+# check gosnowflake service ready: rpc serving, registry session open, every
+# worker leading and the clock healthy, see /readyz
+function check_ready_gosnowflake {
+    curl -sf -m 2 -o /dev/null http://${gosnowflake_admin}/readyz
     if test $? -ne 0
     then
         return 1
@@ -47,7 +61,7 @@ case "${cur_role}" in
 ;;
 # if master check the gosnowflake service alive
 "master" )
-    check_run_gosnowflake    
+    check_run_gosnowflake && check_ready_gosnowflake
     if test "$?" -ne 0
     then
         # kill keepalved, let leader selection
@@ -0,0 +1,164 @@
+// Copyright © 2014 Terry Mao All rights reserved.
+// This file is part of gosnowflake.
+
+// gosnowflake is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// gosnowflake is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with gosnowflake.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	log "github.com/alecthomas/log4go"
+	"encoding/xml"
+	"errors"
+	"github.com/Terry-Mao/gosnowflake/logger"
+	"github.com/Terry-Mao/gosnowflake/registry"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+const (
+	logFormatLog4go = "log4go"
+	logFormatJSON   = "json"
+)
+
+var (
+	// Logger is the structured logger, see InitLog.
+	Logger logger.Logger = logger.Log4go{}
+	// logger level => log4go level
+	log4goLevels = map[logger.Level]log.Level{
+		logger.LevelDebug: log.DEBUG,
+		logger.LevelInfo:  log.INFO,
+		logger.LevelWarn:  log.WARNING,
+		logger.LevelError: log.ERROR,
+	}
+)
+
+// InitLog init the log by the log4go configuration, or write the json lines
+// to the stdout, the log4go messages are written as json lines too.
+func InitLog() {
+	conf := Conf()
+	if conf.LogFormat == logFormatJSON {
+		// validated by loadConfig
+		level, _ := logger.ParseLevel(conf.LogLevel)
+		j := logger.NewJSON(os.Stdout, level)
+		log.Close()
+		log.AddFilter("json", log4goLevels[level], j)
+		Logger = j
+	} else {
+		log.LoadConfiguration(conf.Log)
+		Logger = logger.Log4go{}
+	}
+	registry.SetLogger(Logger)
+}
+
+// ReopenLog reopen all file log writers, e.g. after logrotate moved the files
+// (SIGUSR1).
+func ReopenLog() {
+	files := map[string]string{}
+	if conf := Conf(); conf.LogFormat == logFormatLog4go {
+		var err error
+		if files, err = logFiles(conf.Log); err != nil {
+			Logger.Error("logFiles() error, keep the log files", logger.F("file", conf.Log), logger.Err(err))
+			return
+		}
+	}
+	n := reopenLog(log.Global, files)
+	Logger.Info("gosnowflake reopened the log files", logger.F("files", n))
+}
+
+// reopenLog reopen the file writers of the logger, files is the filter tag =>
+// file. a writer reopens in its own goroutine between two records, the
+// records logged meanwhile are queued and written to the new file, none is
+// dropped. note a writer with "rotate" enabled moves the file to the next
+// number itself if it still exists.
+//
+// a writer failing to reopen its file stops writing for good and blocks the
+// logging when its queue is full, so only the files checked writable are
+// reopened, the others keep writing the old file.
+func reopenLog(global log.Logger, files map[string]string) (n int) {
+	for tag, filt := range global {
+		w, ok := filt.LogWriter.(*log.FileLogWriter)
+		if !ok {
+			continue
+		}
+		name, ok := files[tag]
+		if !ok {
+			Logger.Error("log filter file unknown, keep the old file", logger.F("filter", tag))
+			continue
+		}
+		if err := checkWritable(name); err != nil {
+			Logger.Error("log file error, keep the old file", logger.F("file", name), logger.Err(err))
+			continue
+		}
+		w.Rotate()
+		n++
+	}
+	return
+}
+
+// log4goConfig is the filters of the log4go xml configuration.
+type log4goConfig struct {
+	Filters []struct {
+		Enabled    string `xml:"enabled,attr"`
+		Tag        string `xml:"tag"`
+		Type       string `xml:"type"`
+		Properties []struct {
+			Name  string `xml:"name,attr"`
+			Value string `xml:",chardata"`
+		} `xml:"property"`
+	} `xml:"filter"`
+}
+
+// logFiles get the file of the enabled file filters of the log4go xml
+// configuration, filter tag => file.
+func logFiles(name string) (map[string]string, error) {
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	c := &log4goConfig{}
+	if err = xml.Unmarshal(b, c); err != nil {
+		return nil, err
+	}
+	files := map[string]string{}
+	for _, filt := range c.Filters {
+		if filt.Enabled != "true" || filt.Type != "file" {
+			continue
+		}
+		for _, p := range filt.Properties {
+			if p.Name == "filename" {
+				files[filt.Tag] = strings.TrimSpace(p.Value)
+			}
+		}
+		if files[filt.Tag] == "" {
+			return nil, errors.New("log filter \"" + filt.Tag + "\" has no filename")
+		}
+	}
+	return files, nil
+}
+
+// checkWritable check the file can be opened for appending, it's created if
+// not exist, and its directory is writable (W_OK) for the rotation.
+func checkWritable(name string) error {
+	if err := syscall.Access(filepath.Dir(name), 2); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
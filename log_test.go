@@ -0,0 +1,138 @@
+// Copyright © 2014 Terry Mao All rights reserved.
+// This file is part of gosnowflake.
+
+// gosnowflake is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// gosnowflake is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with gosnowflake.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	log "github.com/alecthomas/log4go"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestReopenLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gosnowflake")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "gosnowflake.log")
+	w := log.NewFileLogWriter(name, false)
+	if w == nil {
+		t.Fatalf("log.NewFileLogWriter(\"%s\") failed", name)
+	}
+	w.SetFormat("%M")
+	logger := log.Logger{}
+	logger.AddFilter("file", log.DEBUG, w)
+	// log while rotating
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	n := 1000
+	go func() {
+		defer wg.Done()
+		for i := 0; i < n; i++ {
+			logger.Info("line %d", i)
+		}
+	}()
+	rotated := name + ".1"
+	if err = os.Rename(name, rotated); err != nil {
+		t.Fatal(err)
+	}
+	if reopened := reopenLog(logger, map[string]string{"file": name}); reopened != 1 {
+		t.Fatalf("reopenLog() = %d, expected 1", reopened)
+	}
+	wg.Wait()
+	logger.Info("after reopen")
+	logger.Close()
+	// all lines are either in the rotated or the new file
+	lines := map[string]bool{}
+	for _, f := range []string{rotated, name} {
+		b, err := ioutil.ReadFile(f)
+		if err != nil {
+			t.Fatalf("ioutil.ReadFile(\"%s\") error(%v)", f, err)
+		}
+		for _, line := range strings.Split(string(b), "\n") {
+			if line = strings.TrimSpace(line); line != "" {
+				lines[line] = true
+			}
+		}
+	}
+	for i := 0; i < n; i++ {
+		if line := fmt.Sprintf("line %d", i); !lines[line] {
+			t.Fatalf("\"%s\" dropped", line)
+		}
+	}
+	b, err := ioutil.ReadFile(name)
+	if err != nil || !strings.Contains(string(b), "after reopen") {
+		t.Fatalf("the new file misses the line after reopen: \"%s\", error(%v)", b, err)
+	}
+}
+
+func TestReopenLogUnwritable(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gosnowflake")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "gosnowflake.log")
+	w := log.NewFileLogWriter(name, false)
+	if w == nil {
+		t.Fatalf("log.NewFileLogWriter(\"%s\") failed", name)
+	}
+	w.SetFormat("%M")
+	logger := log.Logger{}
+	logger.AddFilter("file", log.DEBUG, w)
+	// the new file can't be created, nor can an unknown file
+	missing := filepath.Join(dir, "missing", "gosnowflake.log")
+	if reopened := reopenLog(logger, map[string]string{"file": missing}); reopened != 0 {
+		t.Fatalf("reopenLog() = %d, expected 0", reopened)
+	}
+	if reopened := reopenLog(logger, map[string]string{}); reopened != 0 {
+		t.Fatalf("reopenLog() = %d, expected 0", reopened)
+	}
+	// the old file is still written
+	logger.Info("after reopen")
+	logger.Close()
+	b, err := ioutil.ReadFile(name)
+	if err != nil || !strings.Contains(string(b), "after reopen") {
+		t.Fatalf("the old file misses the line after reopen: \"%s\", error(%v)", b, err)
+	}
+}
+
+func TestLogFiles(t *testing.T) {
+	files, err := logFiles("./log.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{
+		"debug_file": "/tmp/gosnowflake_debug.log",
+		"info_file":  "/tmp/gosnowflake_info.log",
+		"warn_file":  "/tmp/gosnowflake_warn.log",
+		"error_file": "/tmp/gosnowflake_error.log",
+	}
+	if len(files) != len(expected) {
+		t.Fatalf("logFiles() = %v, expected %v", files, expected)
+	}
+	for tag, name := range expected {
+		if files[tag] != name {
+			t.Fatalf("logFiles()[\"%s\"] = \"%s\", expected \"%s\"", tag, files[tag], name)
+		}
+	}
+}
@@ -0,0 +1,198 @@
+// Copyright © 2014 Terry Mao All rights reserved.
+// This file is part of gosnowflake.
+
+// gosnowflake is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// gosnowflake is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with gosnowflake.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package logger is the structured logger of gosnowflake, the server and the
+// client log through the Logger interface, a message comes with the fields
+// such as worker_id, peer and error.
+package logger
+
+import (
+	log "github.com/alecthomas/log4go"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level is the log level.
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var (
+	levelNames = []string{"debug", "info", "warn", "error"}
+)
+
+func (l Level) String() string {
+	if l < LevelDebug || l > LevelError {
+		return fmt.Sprintf("level(%d)", int(l))
+	}
+	return levelNames[l]
+}
+
+// ParseLevel parse the level name: debug, info, warn or error.
+func ParseLevel(name string) (Level, error) {
+	for i, n := range levelNames {
+		if strings.EqualFold(n, name) {
+			return Level(i), nil
+		}
+	}
+	return LevelInfo, fmt.Errorf("logger: unknown level \"%s\"", name)
+}
+
+// Field is a key value of a log message.
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+// F new a field.
+func F(key string, value interface{}) Field {
+	return Field{Key: key, Value: value}
+}
+
+// Err new the "error" field.
+func Err(err error) Field {
+	return Field{Key: "error", Value: err}
+}
+
+// Logger log the message with the fields.
+type Logger interface {
+	Debug(msg string, fields ...Field)
+	Info(msg string, fields ...Field)
+	Warn(msg string, fields ...Field)
+	Error(msg string, fields ...Field)
+}
+
+// Nop discard all messages.
+type Nop struct{}
+
+func (Nop) Debug(msg string, fields ...Field) {}
+func (Nop) Info(msg string, fields ...Field)  {}
+func (Nop) Warn(msg string, fields ...Field)  {}
+func (Nop) Error(msg string, fields ...Field) {}
+
+// Log4go log through the log4go global logger, the fields are appended to
+// the message as key=value.
+type Log4go struct{}
+
+func (Log4go) Debug(msg string, fields ...Field) { log.Debug("%s", format(msg, fields)) }
+func (Log4go) Info(msg string, fields ...Field)  { log.Info("%s", format(msg, fields)) }
+func (Log4go) Warn(msg string, fields ...Field)  { log.Warn("%s", format(msg, fields)) }
+func (Log4go) Error(msg string, fields ...Field) { log.Error("%s", format(msg, fields)) }
+
+// format format the message with the fields as key=value, the strings with
+// spaces are quoted.
+func format(msg string, fields []Field) string {
+	if len(fields) == 0 {
+		return msg
+	}
+	buf := bytes.NewBufferString(msg)
+	for _, f := range fields {
+		v := fmt.Sprint(f.Value)
+		if v == "" || strings.ContainsAny(v, " \t\n\"=") {
+			v = fmt.Sprintf("%q", v)
+		}
+		fmt.Fprintf(buf, " %s=%s", f.Key, v)
+	}
+	return buf.String()
+}
+
+// JSON write a json object per line:
+//
+// {"time":"2006-01-02T15:04:05.000Z07:00","level":"info","msg":"...","worker_id":1}
+//
+// it's also a log4go.LogWriter, so the log4go messages can be written in the
+// same format.
+type JSON struct {
+	mutex sync.Mutex
+	w     io.Writer
+	level Level
+}
+
+// NewJSON new a json logger writes the messages of the level or above.
+func NewJSON(w io.Writer, level Level) *JSON {
+	return &JSON{w: w, level: level}
+}
+
+func (j *JSON) Debug(msg string, fields ...Field) { j.write(time.Now(), LevelDebug, msg, fields) }
+func (j *JSON) Info(msg string, fields ...Field)  { j.write(time.Now(), LevelInfo, msg, fields) }
+func (j *JSON) Warn(msg string, fields ...Field)  { j.write(time.Now(), LevelWarn, msg, fields) }
+func (j *JSON) Error(msg string, fields ...Field) { j.write(time.Now(), LevelError, msg, fields) }
+
+// LogWrite write the log4go record.
+func (j *JSON) LogWrite(rec *log.LogRecord) {
+	level := LevelError
+	switch {
+	case rec.Level <= log.TRACE:
+		level = LevelDebug
+	case rec.Level == log.INFO:
+		level = LevelInfo
+	case rec.Level == log.WARNING:
+		level = LevelWarn
+	}
+	j.write(rec.Created, level, rec.Message, nil)
+}
+
+// Close do nothing, the writer is owned by the caller.
+func (j *JSON) Close() {}
+
+func (j *JSON) write(t time.Time, level Level, msg string, fields []Field) {
+	if level < j.level {
+		return
+	}
+	buf := &bytes.Buffer{}
+	buf.WriteString(`{"time":`)
+	writeValue(buf, t.Format("2006-01-02T15:04:05.000Z07:00"))
+	buf.WriteString(`,"level":`)
+	writeValue(buf, level.String())
+	buf.WriteString(`,"msg":`)
+	writeValue(buf, msg)
+	for _, f := range fields {
+		buf.WriteByte(',')
+		writeValue(buf, f.Key)
+		buf.WriteByte(':')
+		writeValue(buf, f.Value)
+	}
+	buf.WriteString("}\n")
+	j.mutex.Lock()
+	j.w.Write(buf.Bytes())
+	j.mutex.Unlock()
+}
+
+// writeValue write the value in json, the errors and the values can't be
+// marshaled are written as strings.
+func writeValue(buf *bytes.Buffer, v interface{}) {
+	switch vv := v.(type) {
+	case error:
+		v = vv.Error()
+	case time.Duration:
+		v = vv.String()
+	}
+	d, err := json.Marshal(v)
+	if err != nil {
+		d, _ = json.Marshal(fmt.Sprint(v))
+	}
+	buf.Write(d)
+}
@@ -0,0 +1,84 @@
+// Copyright © 2014 Terry Mao All rights reserved.
+// This file is part of gosnowflake.
+
+// gosnowflake is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// gosnowflake is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with gosnowflake.  If not, see <http://www.gnu.org/licenses/>.
+
+package logger
+
+import (
+	log "github.com/alecthomas/log4go"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseLevel(t *testing.T) {
+	for name, level := range map[string]Level{"debug": LevelDebug, "INFO": LevelInfo, "Warn": LevelWarn, "error": LevelError} {
+		if l, err := ParseLevel(name); err != nil || l != level {
+			t.Fatalf("ParseLevel(\"%s\") = %s, error(%v), expected %s", name, l, err, level)
+		}
+	}
+	if _, err := ParseLevel("trace"); err == nil {
+		t.Fatal("ParseLevel(\"trace\") must fail")
+	}
+}
+
+func TestFormat(t *testing.T) {
+	if s := format("rpc.Dial() error", []Field{F("worker_id", 1), F("peer", "127.0.0.1:8080"), Err(errors.New("connection refused")), F("empty", "")}); s != `rpc.Dial() error worker_id=1 peer=127.0.0.1:8080 error="connection refused" empty=""` {
+		t.Fatalf("format() = %s", s)
+	}
+	if s := format("no fields", nil); s != "no fields" {
+		t.Fatalf("format() = %s", s)
+	}
+}
+
+func TestJSON(t *testing.T) {
+	buf := &bytes.Buffer{}
+	j := NewJSON(buf, LevelInfo)
+	var l Logger = j
+	l.Debug("filtered")
+	l.Info("worker starting", F("worker_id", int64(3)), F("peers", []string{"a", "b"}), F("timeout", time.Second))
+	l.Error("zk.Get() error", F("path", "/gosnowflake-servers/0"), Err(errors.New("zk: node does not exist")))
+	j.LogWrite(&log.LogRecord{Level: log.WARNING, Created: time.Now(), Message: "printf message 100%"})
+	j.LogWrite(&log.LogRecord{Level: log.DEBUG, Created: time.Now(), Message: "filtered"})
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("json lines: %d, expected 3\n%s", len(lines), buf.String())
+	}
+	m := map[string]interface{}{}
+	for i, expected := range []map[string]interface{}{
+		{"level": "info", "msg": "worker starting", "worker_id": float64(3), "timeout": "1s"},
+		{"level": "error", "msg": "zk.Get() error", "path": "/gosnowflake-servers/0", "error": "zk: node does not exist"},
+		{"level": "warn", "msg": "printf message 100%"},
+	} {
+		if err := json.Unmarshal([]byte(lines[i]), &m); err != nil {
+			t.Fatalf("json.Unmarshal(\"%s\") error(%v)", lines[i], err)
+		}
+		for k, v := range expected {
+			if m[k] != v {
+				t.Fatalf("line %d \"%s\": %v, expected %v", i, k, m[k], v)
+			}
+		}
+		if _, err := time.Parse("2006-01-02T15:04:05.000Z07:00", m["time"].(string)); err != nil {
+			t.Fatalf("line %d time error(%v)", i, err)
+		}
+	}
+	// the fields keep the order
+	if !strings.HasPrefix(lines[0], `{"time":`) || !strings.Contains(lines[0], `"msg":"worker starting","worker_id":3,"peers":["a","b"]`) {
+		t.Fatalf("json line: %s", lines[0])
+	}
+}
@@ -19,7 +19,15 @@ package main
 import (
 	log "github.com/alecthomas/log4go"
 	"flag"
+	"github.com/Terry-Mao/gosnowflake/logger"
+	"os"
 	"runtime"
+	"time"
+)
+
+const (
+	// Version is the gosnowflake build version.
+	Version = "1.3"
 )
 
 func main() {
@@ -28,23 +36,41 @@ func main() {
 	if err := InitConfig(); err != nil {
 		panic(err)
 	}
-	runtime.GOMAXPROCS(MyConf.MaxProc)
+	if auditLookup != 0 {
+		os.Exit(RunAuditLookup(auditLookup))
+	}
+	runtime.GOMAXPROCS(Conf().MaxProc)
 	// init log
-	log.LoadConfiguration(MyConf.Log)
-	log.Info("gosnowflake service start [datacenter: %d]", MyConf.DatacenterId)
+	InitLog()
+	defer log.Close()
+	Logger.Info("gosnowflake service start", logger.F("version", Version), logger.F("datacenter_id", Conf().DatacenterId))
+	// listeners activated by systemd or inherited from the old process
+	InitSystemd()
+	if err := InitUpgrade(); err != nil {
+		panic(err)
+	}
 	// process
 	if err := InitProcess(); err != nil {
 		panic(err)
 	}
-	// pprof
-	InitPprof()
-	// zookeeper
-	if err := InitZK(); err != nil {
+	// trusted time
+	if err := InitNTP(); err != nil {
 		panic(err)
 	}
-	defer CloseZK()
+	// registry
+	InitMetrics()
+	if err := InitRegistry(); err != nil {
+		panic(err)
+	}
+	defer CloseRegistry()
 	// safty check
-	if err := SanityCheckPeers(); err != nil {
+	report, err := SanityCheckPeers()
+	if err != nil {
+		panic(err)
+	}
+	MyStat.SetSanity(report)
+	// take over the workers after the old process drained
+	if err := WaitUpgrade(); err != nil {
 		panic(err)
 	}
 	// workers
@@ -52,12 +78,61 @@ func main() {
 	if err != nil {
 		panic(err)
 	}
+	// audit log of the issued ids
+	if err := InitAudit(); err != nil {
+		panic(err)
+	}
+	// tracing of the rpc calls
+	if err := InitTrace(); err != nil {
+		panic(err)
+	}
 	// rpc
 	if err := InitRPC(workers); err != nil {
 		panic(err)
 	}
+	// admin http: pprof, stat, metrics
+	if err := InitAdmin(workers); err != nil {
+		panic(err)
+	}
+	CloseInherited()
+	// all listeners are bound
+	if err := DropPrivilege(); err != nil {
+		panic(err)
+	}
+	// clock monitors
+	clockGuard.SetWorkers(workers)
+	InitSkewMonitor()
+	// registered, sanity checked and listening
+	if err := NotifyReady(workers); err != nil {
+		Logger.Error("NotifyReady() error", logger.Err(err))
+	}
 	// init signals, block wait signals
 	sc := InitSignal()
-	HandleSignal(sc)
-	log.Info("gosnowflake service stop")
+	HandleSignal(sc, workers)
+	Shutdown(workers)
+	Logger.Info("gosnowflake service stop")
+}
+
+// Shutdown stop the service gracefully: deregister the workers so the
+// clients fail over at once, stop accepting and drain the in-flight calls,
+// then flush the stat and the high-water.
+func Shutdown(workers *Workers) {
+	Logger.Info("gosnowflake service shutting down")
+	upgrading := Upgrading()
+	NotifyStopping(upgrading)
+	// the clock monitors must not register the workers again
+	clockGuard.Close()
+	setSkewMonitor(nil)
+	setNTPMonitor(nil)
+	workers.Deregister()
+	rpcServer.Close(Conf().DrainTimeout)
+	CloseAudit()
+	CloseTrace()
+	workers.SaveHighWater()
+	// the new process takes over the workers
+	UpgradeDrained()
+	// the new process holds the pid file lock
+	ClosePidFile(!upgrading)
+	Logger.Info("gosnowflake stat", logger.F("uptime", time.Since(MyStat.Start()).String()), logger.F("claimed_worker_ids", MyStat.ClaimedWorkerIds()),
+		logger.F("peer_skew_ms", MyStat.PeerSkew()), logger.F("ntp_offset_ms", MyStat.NTPOffset()), logger.F("leads", workers.Lead()))
 }
@@ -0,0 +1,273 @@
+// Copyright © 2014 Terry Mao All rights reserved.
+// This file is part of gosnowflake.
+
+// gosnowflake is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// gosnowflake is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with gosnowflake.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/Terry-Mao/gosnowflake/registry"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+   prometheus metrics
+   ============
+   GET /metrics on the stat.bind returns the metrics in the prometheus text
+   format (version 0.0.4). the counters of the workers, the clock and the rpc
+   server are read at scrape time, the others are recorded on the way.
+*/
+
+var (
+	metricIssued = newCounterVec("gosnowflake_ids_issued_total",
+		"Ids issued by worker and protocol.", "worker", "protocol")
+	metricBatchSize = newHistogramVec("gosnowflake_nextids_batch_size",
+		"NextIds requested batch sizes.", []float64{1, 2, 5, 10, 20, 50, 100})
+	metricRPCDuration = newHistogramVec("gosnowflake_rpc_duration_seconds",
+		"Rpc call latencies by method.", []float64{.0001, .00025, .0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1}, "method")
+	metricRPCErrors = newCounterVec("gosnowflake_rpc_errors_total",
+		"Rpc calls returned an error by method.", "method")
+	metricClockBackwards = newHistogramVec("gosnowflake_clock_backwards_seconds",
+		"How far the clock moved backwards behind the last timestamp.", []float64{.001, .005, .01, .05, .1, .5, 1, 5, 10, 60})
+	metricSequenceWait = newHistogramVec("gosnowflake_sequence_wait_seconds",
+		"Time waited for the next millisecond after the sequence exhausted.", []float64{.0001, .00025, .0005, .001, .0025, .005, .01})
+	metricRegistryState = newCounterVec("gosnowflake_registry_state_transitions_total",
+		"Registry session state transitions by backend and the new state.", "backend", "state")
+	metricAuditDropped = newCounterVec("gosnowflake_audit_dropped_total",
+		"Audit spans dropped because the buffer is full.")
+	metricAuditRefused = newCounterVec("gosnowflake_audit_refused_total",
+		"Rpc responses refused because their ids can't be audited in time.")
+)
+
+// InitMetrics hook the registry state transitions.
+func InitMetrics() {
+	registry.StateChanged = func(backend, state string) {
+		metricRegistryState.Add(1, backend, state)
+	}
+}
+
+// metricsHandler get the metrics in the prometheus text format.
+func metricsHandler(workers *Workers) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		buf := &bytes.Buffer{}
+		writeMetrics(buf, workers)
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		w.Write(buf.Bytes())
+	}
+}
+
+// writeMetrics write all metrics.
+func writeMetrics(w io.Writer, workers *Workers) {
+	writeMetric(w, "gosnowflake_build_info", "gauge", "Build information.",
+		[]string{"version"}, [][]string{{Version}}, []float64{1})
+	writeMetric(w, "gosnowflake_uptime_seconds", "gauge", "Seconds since the process started.",
+		nil, nil, []float64{time.Since(MyStat.Start()).Seconds()})
+	// workers
+	workerIds, issued, errs, backwards, exhausted, leads := [][]string{}, []float64{}, []float64{}, []float64{}, []float64{}, []float64{}
+	lead := workers.Lead()
+	for _, ws := range collectWorkerStats(workers) {
+		workerIds = append(workerIds, []string{strconv.FormatInt(ws.WorkerId, 10)})
+		issued = append(issued, float64(ws.Issued))
+		errs = append(errs, float64(ws.Errors))
+		backwards = append(backwards, float64(ws.Backwards))
+		exhausted = append(exhausted, float64(ws.Exhausted))
+		leads = append(leads, float64(lead[ws.WorkerId])/1000)
+	}
+	writeMetric(w, "gosnowflake_worker_ids_total", "counter", "Ids generated by worker.", []string{"worker"}, workerIds, issued)
+	writeMetric(w, "gosnowflake_worker_errors_total", "counter", "Id generation errors by worker.", []string{"worker"}, workerIds, errs)
+	writeMetric(w, "gosnowflake_clock_backwards_total", "counter", "Clock moved backwards events by worker.", []string{"worker"}, workerIds, backwards)
+	writeMetric(w, "gosnowflake_sequence_exhausted_total", "counter", "Sequence exhausted in a millisecond by worker.", []string{"worker"}, workerIds, exhausted)
+	writeMetric(w, "gosnowflake_worker_lead_seconds", "gauge", "Seconds the worker runs ahead of the wall clock.", []string{"worker"}, workerIds, leads)
+	metricIssued.write(w)
+	metricBatchSize.write(w)
+	metricClockBackwards.write(w)
+	metricSequenceWait.write(w)
+	// clock
+	fault := 0.0
+	if clockGuard.Err() != nil {
+		fault = 1
+	}
+	writeMetric(w, "gosnowflake_clock_fault", "gauge", "1 if a clock check failed and the workers are deregistered.", nil, nil, []float64{fault})
+	writeMetric(w, "gosnowflake_peer_skew_seconds", "gauge", "Median clock skew from the peers, local minus peers.", nil, nil, []float64{float64(MyStat.PeerSkew()) / 1000})
+	writeMetric(w, "gosnowflake_ntp_offset_seconds", "gauge", "Clock offset from the ntp servers, servers minus local.", nil, nil, []float64{float64(MyStat.NTPOffset()) / 1000})
+	// registry
+	if reg != nil {
+		writeMetric(w, "gosnowflake_registry_state", "gauge", "The current registry session state.",
+			[]string{"backend", "state"}, [][]string{{Conf().Registry, reg.State()}}, []float64{1})
+	}
+	metricRegistryState.write(w)
+	// rpc
+	if rpcServer != nil {
+		writeMetric(w, "gosnowflake_rpc_connections", "gauge", "Open rpc connections.", nil, nil, []float64{float64(rpcServer.Conns())})
+		writeMetric(w, "gosnowflake_rpc_accepted_total", "counter", "Accepted rpc connections.", nil, nil, []float64{float64(rpcServer.Accepted())})
+		writeMetric(w, "gosnowflake_rpc_inflight", "gauge", "In-flight rpc calls.", nil, nil, []float64{float64(rpcServer.Inflight())})
+	}
+	metricRPCDuration.write(w)
+	metricRPCErrors.write(w)
+}
+
+// writeMetric write a metric family of the samples.
+func writeMetric(w io.Writer, name, typ, help string, labels []string, values [][]string, samples []float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+	for i, v := range samples {
+		var lv []string
+		if values != nil {
+			lv = values[i]
+		}
+		writeSample(w, name, labels, lv, v)
+	}
+}
+
+// writeSample write a sample line.
+func writeSample(w io.Writer, name string, labels, values []string, v float64) {
+	io.WriteString(w, name)
+	if len(labels) > 0 {
+		pairs := make([]string, len(labels))
+		for i, l := range labels {
+			pairs[i] = l + "=\"" + escapeLabel(values[i]) + "\""
+		}
+		io.WriteString(w, "{"+strings.Join(pairs, ",")+"}")
+	}
+	io.WriteString(w, " "+formatFloat(v)+"\n")
+}
+
+// escapeLabel escape the label value.
+func escapeLabel(v string) string {
+	return strings.NewReplacer("\\", `\\`, "\"", `\"`, "\n", `\n`).Replace(v)
+}
+
+// formatFloat format the sample value.
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// counterVec is a counter family partitioned by the label values.
+type counterVec struct {
+	name   string
+	help   string
+	labels []string
+	mutex  sync.Mutex
+	values map[string][]string // key => label values
+	counts map[string]float64  // key => count
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{name: name, help: help, labels: labels, values: map[string][]string{}, counts: map[string]float64{}}
+}
+
+// Add add the delta to the counter of the label values.
+func (c *counterVec) Add(delta float64, values ...string) {
+	key := strings.Join(values, "\xff")
+	c.mutex.Lock()
+	if _, ok := c.values[key]; !ok {
+		c.values[key] = values
+	}
+	c.counts[key] += delta
+	c.mutex.Unlock()
+}
+
+func (c *counterVec) write(w io.Writer) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	for _, key := range sortedKeys(c.values) {
+		writeSample(w, c.name, c.labels, c.values[key], c.counts[key])
+	}
+}
+
+// histogram is the buckets of a histogram series.
+type histogram struct {
+	values []string
+	counts []uint64 // per bucket, not cumulative
+	sum    float64
+	count  uint64
+}
+
+// histogramVec is a histogram family partitioned by the label values.
+type histogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64 // upper bounds, sorted
+	mutex   sync.Mutex
+	series  map[string]*histogram
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{name: name, help: help, labels: labels, buckets: buckets, series: map[string]*histogram{}}
+}
+
+// Observe add the observation to the histogram of the label values.
+func (h *histogramVec) Observe(v float64, values ...string) {
+	key := strings.Join(values, "\xff")
+	i := sort.SearchFloat64s(h.buckets, v)
+	h.mutex.Lock()
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogram{values: values, counts: make([]uint64, len(h.buckets)+1)}
+		h.series[key] = s
+	}
+	s.counts[i]++
+	s.sum += v
+	s.count++
+	h.mutex.Unlock()
+}
+
+func (h *histogramVec) write(w io.Writer) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	keys := make([]string, 0, len(h.series))
+	for key := range h.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	labels := append(append([]string{}, h.labels...), "le")
+	for _, key := range keys {
+		s := h.series[key]
+		cumulative := uint64(0)
+		for i, le := range append(append([]float64{}, h.buckets...), math.Inf(1)) {
+			cumulative += s.counts[i]
+			writeSample(w, h.name+"_bucket", labels, append(append([]string{}, s.values...), formatFloat(le)), float64(cumulative))
+		}
+		writeSample(w, h.name+"_sum", h.labels, s.values, s.sum)
+		writeSample(w, h.name+"_count", h.labels, s.values, float64(s.count))
+	}
+}
+
+// sortedKeys get the sorted keys of the label values map.
+func sortedKeys(m map[string][]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,117 @@
+// Copyright © 2014 Terry Mao All rights reserved.
+// This file is part of gosnowflake.
+
+// gosnowflake is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// gosnowflake is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with gosnowflake.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"github.com/Terry-Mao/gosnowflake/registry"
+	myrpc "github.com/Terry-Mao/gosnowflake/rpc"
+	"net/rpc"
+	"strings"
+	"testing"
+)
+
+func TestMetricFormat(t *testing.T) {
+	h := newHistogramVec("test_seconds", "Test histogram.", []float64{.1, 1}, "method")
+	h.Observe(.05, "a")
+	h.Observe(.5, "a")
+	h.Observe(1, "a")
+	h.Observe(2, "a")
+	c := newCounterVec("test_total", "Test counter.", "name")
+	c.Add(1, "quote\"back\\slash\nnewline")
+	c.Add(2, "quote\"back\\slash\nnewline")
+	buf := &bytes.Buffer{}
+	h.write(buf)
+	c.write(buf)
+	expected := `# HELP test_seconds Test histogram.
+# TYPE test_seconds histogram
+test_seconds_bucket{method="a",le="0.1"} 1
+test_seconds_bucket{method="a",le="1"} 3
+test_seconds_bucket{method="a",le="+Inf"} 4
+test_seconds_sum{method="a"} 3.55
+test_seconds_count{method="a"} 4
+# HELP test_total Test counter.
+# TYPE test_total counter
+test_total{name="quote\"back\\slash\nnewline"} 3
+`
+	if buf.String() != expected {
+		t.Fatalf("metrics:\n%s\nexpected:\n%s", buf.String(), expected)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	// the metrics are process wide
+	for _, c := range []*counterVec{metricIssued, metricRPCErrors, metricRegistryState} {
+		c.values, c.counts = map[string][]string{}, map[string]float64{}
+	}
+	for _, h := range []*histogramVec{metricBatchSize, metricRPCDuration} {
+		h.series = map[string]*histogram{}
+	}
+	SetConf(&Config{RPCBind: []string{"127.0.0.1:0"}, Registry: registry.BackendMemory, WorkerId: []int64{0}, Twepoch: twepoch})
+	InitMetrics()
+	defer func() { registry.StateChanged = func(backend, state string) {} }()
+	reg = registry.NewMemoryStore().Session()
+	defer reg.Close()
+	workers, err := NewWorkers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rpcServer = NewRPCServer()
+	defer rpcServer.Close(0)
+	if err = rpcServer.Listen("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	if err = rpc.Register(&SnowflakeRPC{workers: workers}); err != nil {
+		t.Fatal(err)
+	}
+	cli, err := rpc.Dial("tcp", rpcServer.Addrs()[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	var id int64
+	if err = cli.Call("SnowflakeRPC.NextId", int64(0), &id); err != nil {
+		t.Fatal(err)
+	}
+	ids := []int64{}
+	if err = cli.Call("SnowflakeRPC.NextIds", &myrpc.NextIdsArgs{WorkerId: 0, Num: 5}, &ids); err != nil {
+		t.Fatal(err)
+	}
+	if err = cli.Call("SnowflakeRPC.NextId", int64(9), &id); err == nil {
+		t.Fatal("NextId(9) of an unserved worker must fail")
+	}
+	registry.StateChanged(registry.BackendZookeeper, "StateHasSession")
+	buf := &bytes.Buffer{}
+	writeMetrics(buf, workers)
+	for _, line := range []string{
+		`gosnowflake_ids_issued_total{worker="0",protocol="rpc"} 6`,
+		`gosnowflake_worker_ids_total{worker="0"} 6`,
+		`gosnowflake_nextids_batch_size_bucket{le="2"} 0`,
+		`gosnowflake_nextids_batch_size_bucket{le="5"} 1`,
+		`gosnowflake_rpc_duration_seconds_count{method="SnowflakeRPC.NextId"} 2`,
+		`gosnowflake_rpc_duration_seconds_count{method="SnowflakeRPC.NextIds"} 1`,
+		`gosnowflake_rpc_errors_total{method="SnowflakeRPC.NextId"} 1`,
+		`gosnowflake_registry_state{backend="memory",state="open"} 1`,
+		`gosnowflake_registry_state_transitions_total{backend="zookeeper",state="StateHasSession"} 1`,
+		`gosnowflake_clock_fault 0`,
+		`gosnowflake_rpc_connections 1`,
+	} {
+		if !strings.Contains(buf.String(), line+"\n") {
+			t.Fatalf("metrics miss \"%s\":\n%s", line, buf.String())
+		}
+	}
+}
@@ -0,0 +1,278 @@
+// Copyright © 2014 Terry Mao All rights reserved.
+// This file is part of gosnowflake.
+
+// gosnowflake is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// gosnowflake is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with gosnowflake.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/Terry-Mao/gosnowflake/logger"
+	"net"
+	"sync"
+	"time"
+)
+
+/*
+   trusted time (SNTP, RFC 4330)
+   ============
+   the peers skew can't catch the whole cluster drifting together, so the
+   local clock is also checked with the configured ntp servers.
+
+   1. on start, query all servers, the median offset of the answered servers
+      must be within "clock:ntp.offset", or gosnowflake fails to start.
+   2. every "clock:ntp.interval", query again, if the offset exceeds the
+      limit, the clock guard stops serving until it recovers.
+   3. the measured offset is kept in the stat.
+*/
+
+const (
+	clockCheckNTP = "ntp"
+	ntpPort       = "123"
+	ntpPacketSize = 48
+	// seconds from the ntp epoch (1900) to the unix epoch (1970)
+	ntpEpochOffset = 2208988800
+	// LI: 0, VN: 4, Mode: 3 (client)
+	ntpClientMode = 0x23
+	ntpServerMode = 4
+)
+
+var (
+	ErrClockOffset  = errors.New("clock offset from ntp servers, refusing to generate id")
+	ErrNTPNoAnswer  = errors.New("no ntp server answered")
+	ErrNTPBadAnswer = errors.New("ntp bad answer")
+	// global ntp monitor, nil if disabled, replaced by reloading
+	ntpMonitor *NTPMonitor
+	ntpMutex   sync.RWMutex
+)
+
+// NTPMonitor periodically check the local clock with the ntp servers.
+type NTPMonitor struct {
+	mutex     sync.RWMutex
+	healthy   bool
+	offset    int64 // last median offset milliseconds, servers - local
+	servers   []string
+	interval  time.Duration
+	maxOffset time.Duration
+	timeout   time.Duration
+	stop      chan bool
+	running   sync.WaitGroup
+}
+
+// InitNTP check the local clock with the ntp servers once and start the ntp
+// monitor if "clock:ntp.interval" is set, the monitor keeps checking even if
+// the first check fails.
+func InitNTP() (err error) {
+	conf := Conf()
+	if len(conf.NTPServers) == 0 {
+		Logger.Warn("clock ntp.servers not set, skip the trusted time check")
+		return nil
+	}
+	m := NewNTPMonitor(conf.NTPServers, conf.NTPInterval, conf.NTPMaxOffset, conf.NTPTimeout)
+	setNTPMonitor(m)
+	if err = m.Check(); err != nil {
+		Logger.Error("trusted time check failed", logger.Err(err))
+	}
+	if conf.NTPInterval > 0 {
+		m.Start()
+	}
+	return
+}
+
+// getNTPMonitor get the global ntp monitor, nil if disabled.
+func getNTPMonitor() *NTPMonitor {
+	ntpMutex.RLock()
+	defer ntpMutex.RUnlock()
+	return ntpMonitor
+}
+
+// setNTPMonitor replace the global ntp monitor, the old one is stopped.
+func setNTPMonitor(m *NTPMonitor) {
+	ntpMutex.Lock()
+	old := ntpMonitor
+	ntpMonitor = m
+	ntpMutex.Unlock()
+	old.Stop()
+}
+
+// NewNTPMonitor new a healthy ntp monitor.
+func NewNTPMonitor(servers []string, interval, maxOffset, timeout time.Duration) *NTPMonitor {
+	return &NTPMonitor{
+		healthy:   true,
+		servers:   servers,
+		interval:  interval,
+		maxOffset: maxOffset,
+		timeout:   timeout,
+		stop:      make(chan bool),
+	}
+}
+
+// Run check the clock offset every interval until stopped.
+func (m *NTPMonitor) Run() {
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			m.Check()
+		case <-m.stop:
+			return
+		}
+	}
+}
+
+// Start run the monitor in a goroutine until stopped.
+func (m *NTPMonitor) Start() {
+	m.running.Add(1)
+	go func() {
+		defer m.running.Done()
+		m.Run()
+	}()
+}
+
+// Stop stop the monitor and wait for the started one to return, so a check
+// in progress never changes the clock guard after stopped.
+func (m *NTPMonitor) Stop() {
+	if m == nil {
+		return
+	}
+	close(m.stop)
+	m.running.Wait()
+}
+
+// Healthy report whether the local clock agrees with the ntp servers, a nil
+// monitor is always healthy.
+func (m *NTPMonitor) Healthy() bool {
+	if m == nil {
+		return true
+	}
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return m.healthy
+}
+
+// Offset get the last median offset milliseconds.
+func (m *NTPMonitor) Offset() int64 {
+	if m == nil {
+		return 0
+	}
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return m.offset
+}
+
+// Check query all servers once, stop serving if the offset exceeds the limit
+// and rejoin if recovered. if no server answers, the state is kept.
+func (m *NTPMonitor) Check() error {
+	offsets := []int64{}
+	for _, server := range m.servers {
+		offset, delay, err := sntpQuery(server, m.timeout)
+		if err != nil {
+			Logger.Warn("sntpQuery() error", logger.F("server", server), logger.Err(err))
+			continue
+		}
+		Logger.Debug("ntp server offset", logger.F("server", server), logger.F("offset", offset.String()), logger.F("delay", delay.String()))
+		offsets = append(offsets, int64(offset/time.Millisecond))
+	}
+	if len(offsets) == 0 {
+		return ErrNTPNoAnswer
+	}
+	offset := medianSkew(offsets)
+	MyStat.SetNTPOffset(offset)
+	maxOffset := int64(m.maxOffset / time.Millisecond)
+	healthy := offset <= maxOffset && offset >= -maxOffset
+	m.mutex.Lock()
+	m.offset = offset
+	changed := m.healthy != healthy
+	m.healthy = healthy
+	m.mutex.Unlock()
+	if changed {
+		if healthy {
+			Logger.Info("clock offset from the ntp servers recovered", logger.F("offset_ms", offset))
+			clockGuard.Fault(clockCheckNTP, nil)
+		} else {
+			Logger.Error("clock offset from the ntp servers exceeds the max", logger.F("offset_ms", offset), logger.F("max_ms", maxOffset))
+			clockGuard.Fault(clockCheckNTP, ErrClockOffset)
+		}
+	}
+	if !healthy {
+		return ErrClockOffset
+	}
+	return nil
+}
+
+// sntpQuery query the server once, get the offset of the server's clock from
+// the local clock and the round trip delay.
+func sntpQuery(server string, timeout time.Duration) (offset, delay time.Duration, err error) {
+	if _, _, err = net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, ntpPort)
+	}
+	conn, err := net.DialTimeout("udp", server, timeout)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	if err = conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return
+	}
+	req := make([]byte, ntpPacketSize)
+	req[0] = ntpClientMode
+	t1 := time.Now()
+	// the server echoes the transmit timestamp as the originate timestamp
+	transmit := toNTPTime(t1)
+	binary.BigEndian.PutUint64(req[40:], transmit)
+	if _, err = conn.Write(req); err != nil {
+		return
+	}
+	resp := make([]byte, ntpPacketSize)
+	n, err := conn.Read(resp)
+	if err != nil {
+		return
+	}
+	t4 := time.Now()
+	if n < ntpPacketSize {
+		err = ErrNTPBadAnswer
+		return
+	}
+	// mode must be server, stratum 0 is a kiss-o'-death
+	if resp[0]&0x7 != ntpServerMode || resp[1] == 0 {
+		err = fmt.Errorf("ntp bad answer mode: %d, stratum: %d", resp[0]&0x7, resp[1])
+		return
+	}
+	if binary.BigEndian.Uint64(resp[24:]) != transmit {
+		err = ErrNTPBadAnswer
+		return
+	}
+	t2 := fromNTPTime(binary.BigEndian.Uint64(resp[32:]))
+	t3 := fromNTPTime(binary.BigEndian.Uint64(resp[40:]))
+	offset = (t2.Sub(t1) + t3.Sub(t4)) / 2
+	delay = t4.Sub(t1) - t3.Sub(t2)
+	return
+}
+
+// toNTPTime convert the time to the ntp 64 bits timestamp.
+func toNTPTime(t time.Time) uint64 {
+	sec := uint64(t.Unix() + ntpEpochOffset)
+	frac := uint64(t.Nanosecond()) << 32 / uint64(time.Second)
+	return sec<<32 | frac
+}
+
+// fromNTPTime convert the ntp 64 bits timestamp to the time.
+func fromNTPTime(v uint64) time.Time {
+	sec := int64(v>>32) - ntpEpochOffset
+	nsec := int64(v&0xffffffff) * int64(time.Second) >> 32
+	return time.Unix(sec, nsec)
+}
@@ -0,0 +1,104 @@
+// Copyright © 2014 Terry Mao All rights reserved.
+// This file is part of gosnowflake.
+
+// gosnowflake is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// gosnowflake is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with gosnowflake.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// startSNTPServer start a local sntp server whose clock is ahead by offset
+// milliseconds.
+func startSNTPServer(t *testing.T, offset *int64) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		defer conn.Close()
+		buf := make([]byte, ntpPacketSize)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if n < ntpPacketSize {
+				continue
+			}
+			now := toNTPTime(time.Now().Add(time.Duration(atomic.LoadInt64(offset)) * time.Millisecond))
+			resp := make([]byte, ntpPacketSize)
+			resp[0] = 0x20 | ntpServerMode
+			resp[1] = 1
+			copy(resp[24:32], buf[40:48])
+			binary.BigEndian.PutUint64(resp[32:], now)
+			binary.BigEndian.PutUint64(resp[40:], now)
+			conn.WriteTo(resp, addr)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+func TestNTPTime(t *testing.T) {
+	now := time.Now()
+	if d := fromNTPTime(toNTPTime(now)).Sub(now); d > time.Microsecond || d < -time.Microsecond {
+		t.Fatalf("ntp time round trip diff %s", d)
+	}
+}
+
+func TestNTPMonitor(t *testing.T) {
+	offset := int64(3000)
+	server := startSNTPServer(t, &offset)
+	d, _, err := sntpQuery(server, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d < 2900*time.Millisecond || d > 3100*time.Millisecond {
+		t.Fatalf("sntpQuery() offset %s, expected about 3s", d)
+	}
+	clockGuard = NewClockGuard()
+	defer func() { clockGuard = NewClockGuard() }()
+	// a dead server is skipped
+	l, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead := l.LocalAddr().String()
+	l.Close()
+	m := NewNTPMonitor([]string{dead, server}, time.Second, time.Second, 100*time.Millisecond)
+	if err = m.Check(); err != ErrClockOffset {
+		t.Fatalf("Check() error(%v), expected %v", err, ErrClockOffset)
+	}
+	if m.Healthy() || clockGuard.Err() != ErrClockOffset {
+		t.Fatal("expected unhealthy")
+	}
+	if o := MyStat.NTPOffset(); o < 2900 || o > 3100 {
+		t.Fatalf("stat ntp offset %dms, expected about 3000ms", o)
+	}
+	atomic.StoreInt64(&offset, 0)
+	if err = m.Check(); err != nil {
+		t.Fatal(err)
+	}
+	if !m.Healthy() || clockGuard.Err() != nil {
+		t.Fatal("expected healthy")
+	}
+	if err = NewNTPMonitor([]string{dead}, time.Second, time.Second, 100*time.Millisecond).Check(); err != ErrNTPNoAnswer {
+		t.Fatalf("Check() error(%v), expected %v", err, ErrNTPNoAnswer)
+	}
+}
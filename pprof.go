@@ -1,40 +0,0 @@
-// Copyright © 2014 Terry Mao All rights reserved.
-// This file is part of gosnowflake.
-
-// gosnowflake is free software: you can redistribute it and/or modify
-// it under the terms of the GNU General Public License as published by
-// the Free Software Foundation, either version 3 of the License, or
-// (at your option) any later version.
-
-// gosnowflake is distributed in the hope that it will be useful,
-// but WITHOUT ANY WARRANTY; without even the implied warranty of
-// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
-// GNU General Public License for more details.
-
-// You should have received a copy of the GNU General Public License
-// along with gosnowflake.  If not, see <http://www.gnu.org/licenses/>.
-
-package main
-
-import (
-	log "github.com/alecthomas/log4go"
-	"net/http"
-	"net/http/pprof"
-)
-
-// InitPprof start http pprof.
-func InitPprof() {
-	pprofServeMux := http.NewServeMux()
-	pprofServeMux.HandleFunc("/debug/pprof/", pprof.Index)
-	pprofServeMux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
-	pprofServeMux.HandleFunc("/debug/pprof/profile", pprof.Profile)
-	pprofServeMux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
-	for _, addr := range MyConf.PprofBind {
-		go func() {
-			if err := http.ListenAndServe(addr, pprofServeMux); err != nil {
-				log.Error("http.ListenAndServe(\"%s\", pproServeMux) error(%v)", addr)
-				panic(err)
-			}
-		}()
-	}
-}
@@ -17,61 +17,221 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"github.com/Terry-Mao/gosnowflake/logger"
 	"io/ioutil"
 	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
 )
 
-const (
-	defaultUser  = "nobody"
-	defaultGroup = "nobody"
+var (
+	ErrPidLocked = errors.New("pid file locked by another process")
+	// the locked pid file, held until exit
+	pidFile *os.File
 )
 
-// InitProcess create pid file, set working dir, setgid and setuid.
+// InitProcess lock and write the pid file, set working dir.
 func InitProcess() (err error) {
+	conf := Conf()
 	// change working dir
-	if err = os.Chdir(MyConf.Dir); err != nil {
+	if err = os.Chdir(conf.Dir); err != nil {
 		return
 	}
-	// create pid file
-	if err = ioutil.WriteFile(MyConf.PidFile, []byte(fmt.Sprintf("%d\n", os.Getpid())), 0644); err != nil {
+	// the upgraded process inherits the locked pid file, writes its pid after
+	// taking over
+	if pidFile == nil {
+		if pidFile, err = lockPidFile(conf.PidFile); err != nil {
+			return
+		}
+		if err = writePid(pidFile); err != nil {
+			return
+		}
+	}
+	if conf.User == "" {
 		return
 	}
-	/*
-		// setuid and setgid
-		ug := strings.SplitN(MyConf.User, " ", 2)
-		usr := defaultUser
-		grp := defaultGroup
-		if len(ug) == 0 {
-			// default user and group (nobody)
-		} else if len(ug) == 1 {
-			usr = ug[0]
-			grp = ""
-		} else if len(ug) == 2 {
-			usr = ug[0]
-			grp = ug[1]
+	// the pid file stays writable after dropping privileges
+	uid, gid, err := lookupUser(conf.User, conf.Group)
+	if err != nil {
+		return
+	}
+	if os.Getuid() == 0 {
+		if err = os.Chown(conf.PidFile, uid, gid); err != nil {
+			Logger.Error("os.Chown() error", logger.F("file", conf.PidFile), logger.F("uid", uid), logger.F("gid", gid), logger.Err(err))
+			return
+		}
+	}
+	return
+}
+
+// lockPidFile open the pid file and lock it exclusively, fail if another live
+// process holds the lock. the lock is released by the kernel when the process
+// exits, so a stale pid file never blocks. the file removed by the holder
+// while we opened it is opened again, so the lock is always taken on the file
+// of the name.
+func lockPidFile(name string) (*os.File, error) {
+	for {
+		f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			Logger.Error("os.OpenFile() error", logger.F("file", name), logger.Err(err))
+			return nil, err
 		}
-		uid := 0
-		gid := 0
-		ui, err := user.Lookup(usr)
+		if err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+			b, _ := ioutil.ReadAll(f)
+			f.Close()
+			if err == syscall.EWOULDBLOCK {
+				Logger.Error("pid file locked by another process", logger.F("file", name), logger.F("pid", strings.TrimSpace(string(b))))
+				return nil, ErrPidLocked
+			}
+			Logger.Error("syscall.Flock() error", logger.F("file", name), logger.Err(err))
+			return nil, err
+		}
+		locked, err := f.Stat()
 		if err != nil {
-			return err
+			f.Close()
+			Logger.Error("pid file.Stat() error", logger.Err(err))
+			return nil, err
+		}
+		if fi, err := os.Stat(name); err == nil && os.SameFile(fi, locked) {
+			return f, nil
 		}
-		uid, _ = strconv.Atoi(ui.Uid)
-		// group no set
-		if grp == "" {
-			gid, _ = strconv.Atoi(ui.Gid)
-		} else {
-			// use user's group instread
-			// TODO LookupGroup
-			gid, _ = strconv.Atoi(ui.Gid)
+		f.Close()
+	}
+}
+
+// writePid write the pid of the process to the locked pid file.
+func writePid(f *os.File) error {
+	if err := f.Truncate(0); err != nil {
+		Logger.Error("pid file.Truncate() error", logger.Err(err))
+		return err
+	}
+	if _, err := f.WriteAt([]byte(fmt.Sprintf("%d\n", os.Getpid())), 0); err != nil {
+		Logger.Error("pid file.WriteAt() error", logger.Err(err))
+		return err
+	}
+	return nil
+}
+
+// ClosePidFile release the pid file lock, the file is removed while still
+// locked unless it's handed to the upgraded process (clear is false), which
+// holds the lock then. if the directory is not writable after dropping
+// privileges, the pid is cleared instead.
+func ClosePidFile(clear bool) {
+	if pidFile == nil {
+		return
+	}
+	if clear {
+		if err := os.Remove(pidFile.Name()); err != nil {
+			Logger.Error("os.Remove() error, clear the pid", logger.F("file", pidFile.Name()), logger.Err(err))
+			if err = pidFile.Truncate(0); err != nil {
+				Logger.Error("pid file.Truncate() error", logger.Err(err))
+			}
 		}
-		if err := syscall.Setgid(gid); err != nil {
+	}
+	pidFile.Close()
+	pidFile = nil
+}
+
+// DropPrivilege setgid and setuid to the base:user and base:group, it must be
+// called after all listeners are bound.
+func DropPrivilege() error {
+	conf := Conf()
+	if conf.User == "" {
+		return nil
+	}
+	uid, gid, err := lookupUser(conf.User, conf.Group)
+	if err != nil {
+		return err
+	}
+	// the upgraded process inherits the dropped privileges
+	if os.Getuid() == uid && os.Getgid() == gid {
+		return nil
+	}
+	// the log and audit files opened as root must stay writable, a log
+	// file reopened by SIGUSR1 or an audit file rotated later fails else
+	files, err := privilegeFiles(conf)
+	if err != nil {
+		return err
+	}
+	for _, name := range files {
+		if err = os.Chown(name, uid, gid); err != nil && !os.IsNotExist(err) {
+			Logger.Error("os.Chown() error", logger.F("file", name), logger.F("uid", uid), logger.F("gid", gid), logger.Err(err))
 			return err
 		}
-		if err := syscall.Setuid(uid); err != nil {
+	}
+	if err = syscall.Setgroups([]int{gid}); err != nil {
+		Logger.Error("syscall.Setgroups() error", logger.F("gid", gid), logger.Err(err))
+		return err
+	}
+	if err = syscall.Setgid(gid); err != nil {
+		Logger.Error("syscall.Setgid() error", logger.F("gid", gid), logger.Err(err))
+		return err
+	}
+	if err = syscall.Setuid(uid); err != nil {
+		Logger.Error("syscall.Setuid() error", logger.F("uid", uid), logger.Err(err))
+		return err
+	}
+	// the working directory must stay writable (W_OK)
+	if err = syscall.Access(".", 2); err != nil {
+		Logger.Error("working dir not writable", logger.F("dir", conf.Dir), logger.F("user", conf.User), logger.F("gid", gid), logger.Err(err))
+		return err
+	}
+	for _, name := range files {
+		if err = checkWritable(name); err != nil {
+			Logger.Error("file not writable", logger.F("file", name), logger.F("user", conf.User), logger.F("gid", gid), logger.Err(err))
 			return err
 		}
-	*/
+	}
+	Logger.Info("drop privileges", logger.F("user", conf.User), logger.F("uid", uid), logger.F("gid", gid))
+	return nil
+}
+
+// privilegeFiles get the log and audit files written by the process.
+func privilegeFiles(conf *Config) (files []string, err error) {
+	if conf.LogFormat == logFormatLog4go {
+		logs, err := logFiles(conf.Log)
+		if err != nil {
+			Logger.Error("logFiles() error", logger.F("file", conf.Log), logger.Err(err))
+			return nil, err
+		}
+		for _, name := range logs {
+			files = append(files, name)
+		}
+	}
+	if conf.AuditFile != "" {
+		files = append(files, conf.AuditFile)
+	}
+	return
+}
+
+// lookupUser get the uid of the user and the gid of the group, the user's
+// primary group if the group is empty.
+func lookupUser(name, group string) (uid, gid int, err error) {
+	u, err := user.Lookup(name)
+	if err != nil {
+		Logger.Error("user.Lookup() error", logger.F("user", name), logger.Err(err))
+		return
+	}
+	if uid, err = strconv.Atoi(u.Uid); err != nil {
+		Logger.Error("strconv.Atoi() error", logger.F("uid", u.Uid), logger.Err(err))
+		return
+	}
+	gidStr := u.Gid
+	if group != "" {
+		g, err := user.LookupGroup(group)
+		if err != nil {
+			Logger.Error("user.LookupGroup() error", logger.F("group", group), logger.Err(err))
+			return 0, 0, err
+		}
+		gidStr = g.Gid
+	}
+	if gid, err = strconv.Atoi(gidStr); err != nil {
+		Logger.Error("strconv.Atoi() error", logger.F("gid", gidStr), logger.Err(err))
+		return
+	}
 	return
 }
@@ -0,0 +1,129 @@
+// Copyright © 2014 Terry Mao All rights reserved.
+// This file is part of gosnowflake.
+
+// gosnowflake is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// gosnowflake is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with gosnowflake.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestLookupUser(t *testing.T) {
+	u, err := user.Current()
+	if err != nil {
+		t.Skipf("user.Current() error(%v)", err)
+	}
+	uid, gid, err := lookupUser(u.Username, "")
+	if err != nil {
+		t.Fatalf("lookupUser(\"%s\") error(%v)", u.Username, err)
+	}
+	if strconv.Itoa(uid) != u.Uid || strconv.Itoa(gid) != u.Gid {
+		t.Fatalf("lookupUser(\"%s\") = %d:%d, expected %s:%s", u.Username, uid, gid, u.Uid, u.Gid)
+	}
+	if g, err := user.LookupGroupId(u.Gid); err == nil {
+		if _, gid, err = lookupUser(u.Username, g.Name); err != nil || strconv.Itoa(gid) != g.Gid {
+			t.Fatalf("lookupUser(\"%s\", \"%s\") = %d, error(%v), expected %s", u.Username, g.Name, gid, err, g.Gid)
+		}
+	}
+	if _, _, err = lookupUser("gosnowflake-no-such-user", ""); err == nil {
+		t.Fatal("lookupUser() of an unknown user must fail")
+	}
+	if _, _, err = lookupUser(u.Username, "gosnowflake-no-such-group"); err == nil {
+		t.Fatal("lookupUser() of an unknown group must fail")
+	}
+}
+
+func TestDropPrivilegeSame(t *testing.T) {
+	u, err := user.Current()
+	if err != nil {
+		t.Skipf("user.Current() error(%v)", err)
+	}
+	old := Conf()
+	SetConf(&Config{User: u.Username, Dir: "./"})
+	defer SetConf(old)
+	// already the user, e.g. the upgraded process
+	if err = DropPrivilege(); err != nil {
+		t.Fatalf("DropPrivilege() error(%v), uid: %d", err, os.Getuid())
+	}
+}
+
+func TestPidFileLock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gosnowflake")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "gosnowflake.pid")
+	// a stale pid file doesn't block
+	if err = ioutil.WriteFile(name, []byte("1234567\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := lockPidFile(name)
+	if err != nil {
+		t.Fatalf("lockPidFile() error(%v)", err)
+	}
+	if err = writePid(f); err != nil {
+		t.Fatalf("writePid() error(%v)", err)
+	}
+	b, err := ioutil.ReadFile(name)
+	if err != nil || strings.TrimSpace(string(b)) != strconv.Itoa(os.Getpid()) {
+		t.Fatalf("pid file: \"%s\", error(%v), expected %d", b, err, os.Getpid())
+	}
+	// flock locks the open file, so a second open conflicts in one process
+	if _, err = lockPidFile(name); err != ErrPidLocked {
+		t.Fatalf("lockPidFile() of a locked pid file error(%v), expected %v", err, ErrPidLocked)
+	}
+	// the upgraded process shares the lock
+	fd, err := syscall.Dup(int(f.Fd()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if _, err = lockPidFile(name); err != ErrPidLocked {
+		t.Fatalf("lockPidFile() of a shared lock error(%v), expected %v", err, ErrPidLocked)
+	}
+	syscall.Close(fd)
+	f, err = lockPidFile(name)
+	if err != nil {
+		t.Fatalf("lockPidFile() after unlock error(%v)", err)
+	}
+	// the upgrading process keeps the file for the new process
+	fd, err = syscall.Dup(int(f.Fd()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pidFile = f
+	ClosePidFile(false)
+	if _, err = os.Stat(name); err != nil {
+		t.Fatalf("pid file error(%v), expected kept", err)
+	}
+	pidFile = os.NewFile(uintptr(fd), name)
+	ClosePidFile(true)
+	if _, err = os.Stat(name); !os.IsNotExist(err) {
+		t.Fatalf("pid file error(%v), expected removed", err)
+	}
+	// a new file is locked after removed
+	if f, err = lockPidFile(name); err != nil {
+		t.Fatalf("lockPidFile() after closed error(%v)", err)
+	}
+	f.Close()
+}
@@ -0,0 +1,302 @@
+// Copyright © 2014 Terry Mao All rights reserved.
+// This file is part of gosnowflake.
+
+// gosnowflake is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// gosnowflake is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with gosnowflake.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/Terry-Mao/gosnowflake/logger"
+	"github.com/Terry-Mao/gosnowflake/registry"
+	"os"
+	"sync"
+	"time"
+)
+
+/*
+   1. peers: get all worker's registered peers.
+   2. SanityCheckPeers: check current process with all peers, see skew.go
+      for the probe.
+   3. RegWorkerId: register current process as a standby or leader, this will
+      cause all watchers receive a node add event then start leader selection.
+      if node = leader then ignore
+      else init rpc
+   4. when process exit, the registered node will disappear, then trigger a
+      node del event to all watchers, start leader selection.
+      if node = leader then ignore
+      else if node != leader then init rpc
+      else if don't exist any node then retry wait node add event.
+
+   the registry backend is selected by "registry:backend", every datacenter
+   registers under its own path, see registry/zookeeper.go for the zookeeper
+   layout.
+*/
+
+const (
+	clockCheckRegistry = "registry"
+)
+
+var (
+	reg          registry.Registry
+	regCloseOnce sync.Once
+)
+
+// InitRegistry init the registry backend.
+func InitRegistry() (err error) {
+	conf := Conf()
+	guardRegistryState()
+	if reg, err = registry.New(&registry.Config{
+		Backend:     conf.Registry,
+		Datacenter:  conf.DatacenterId,
+		ZKAddr:      conf.ZKAddr,
+		ZKTimeout:   conf.ZKTimeout,
+		ZKPath:      conf.ZKPath,
+		ZKLegacy:    conf.ZKLegacy,
+		EtcdAddr:    conf.EtcdAddr,
+		EtcdTimeout: conf.EtcdTimeout,
+		EtcdPath:    conf.EtcdPath,
+		StaticFile:  conf.StaticFile,
+	}); err != nil {
+		Logger.Error("registry.New() error", logger.F("registry", conf.Registry), logger.Err(err))
+		return
+	}
+	// two clusters must not share a datacenter id
+	if conf.Cluster == "" {
+		Logger.Warn("snowflake cluster not set, skip the datacenter owner check", logger.F("datacenter_id", conf.DatacenterId))
+		return
+	}
+	if err = reg.ClaimDatacenter(conf.Cluster); err != nil {
+		Logger.Error("reg.ClaimDatacenter() error", logger.F("cluster", conf.Cluster), logger.F("datacenter_id", conf.DatacenterId), logger.Err(err))
+		reg.Close()
+		return
+	}
+	return
+}
+
+// guardRegistryState hook the registry session states: once the session
+// expired, the registered workers are dropped and the standby workers take
+// over, so stop serving by the clock guard, the workers are registered again
+// once the session is open.
+func guardRegistryState() {
+	stateChanged := registry.StateChanged
+	registry.StateChanged = func(backend, state string) {
+		stateChanged(backend, state)
+		switch state {
+		case registry.StateExpired:
+			clockGuard.Fault(clockCheckRegistry, registry.ErrSessionExpired)
+		case registry.StateOpen:
+			clockGuard.Fault(clockCheckRegistry, nil)
+		}
+	}
+}
+
+// localPeer get the current process registry data.
+func localPeer() *registry.Peer {
+	conf := Conf()
+	hostname, err := os.Hostname()
+	if err != nil {
+		Logger.Warn("os.Hostname() error", logger.Err(err))
+	}
+	protocols := []string{}
+	if len(conf.RPCBind) > 0 {
+		protocols = append(protocols, registry.ProtocolRPC, registry.ProtocolTrace)
+	}
+	return &registry.Peer{
+		Version:    registry.PeerVersion,
+		RPC:        conf.RPCBind,
+		Thrift:     conf.ThriftBind,
+		Datacenter: conf.DatacenterId,
+		Hostname:   hostname,
+		Start:      MyStat.Start().UnixNano() / int64(time.Millisecond),
+		Build:      Version,
+		Layout: registry.Layout{
+			WorkerIdBits:     workerIdBits,
+			DatacenterIdBits: datacenterIdBits,
+			SequenceBits:     sequenceBits,
+		},
+		Epoch:     conf.Twepoch,
+		Protocols: protocols,
+	}
+}
+
+// RegWorkerId as a leader worker or a standby worker.
+func RegWorkerId(workerId int64) (err error) {
+	Logger.Info("trying to claim the worker id", logger.F("worker_id", workerId))
+	if err = reg.Register(workerId, localPeer()); err != nil {
+		Logger.Error("reg.Register() error", logger.F("worker_id", workerId), logger.Err(err))
+		return
+	}
+	return
+}
+
+// ClaimDerivedWorkerIds claim the worker ids derived from the host, it fails
+// if any id is claimed or registered by other peers.
+func ClaimDerivedWorkerIds(ids []int64) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	peers, err := getPeers()
+	if err != nil {
+		return err
+	}
+	for _, workerId := range ids {
+		if _, ok := peers[workerId]; ok {
+			Logger.Error("derived worker id already registered", logger.F("worker_id", workerId), logger.F("peers", len(peers[workerId])))
+			return fmt.Errorf("derived workerId: %d conflicts", workerId)
+		}
+		if err = reg.Claim(workerId); err != nil {
+			if err == registry.ErrNotSupported {
+				// the registry validates the worker on register
+				Logger.Warn("registry can't claim the derived worker id", logger.F("registry", Conf().Registry), logger.F("worker_id", workerId))
+				continue
+			}
+			Logger.Error("reg.Claim() error", logger.F("worker_id", workerId), logger.Err(err))
+			if err == registry.ErrClaimed {
+				return fmt.Errorf("derived workerId: %d conflicts", workerId)
+			}
+			return err
+		}
+		Logger.Info("claimed the derived worker id", logger.F("worker_id", workerId))
+	}
+	return nil
+}
+
+// ClaimWorkerIds claim the lowest free worker ids, an id is free if it's
+// neither claimed nor registered by any peer.
+func ClaimWorkerIds(num int) ([]int64, error) {
+	conf := Conf()
+	if num == 0 {
+		return nil, nil
+	}
+	peers, err := getPeers()
+	if err != nil {
+		return nil, err
+	}
+	used := make(map[int64]bool, len(conf.WorkerId)+len(conf.DeriveWorker))
+	for _, workerId := range conf.WorkerId {
+		used[workerId] = true
+	}
+	for _, workerId := range conf.DeriveWorker {
+		used[workerId] = true
+	}
+	claimed := make([]int64, 0, num)
+	for workerId := int64(0); workerId <= maxWorkerId && len(claimed) < num; workerId++ {
+		if _, ok := peers[workerId]; used[workerId] || ok {
+			continue
+		}
+		if err = reg.Claim(workerId); err != nil {
+			if err == registry.ErrClaimed {
+				continue
+			}
+			Logger.Error("reg.Claim() error", logger.F("worker_id", workerId), logger.Err(err))
+			return nil, err
+		}
+		Logger.Info("claimed the worker id", logger.F("worker_id", workerId))
+		claimed = append(claimed, workerId)
+	}
+	if len(claimed) < num {
+		Logger.Error("not enough free worker ids claimed", logger.F("claimed", len(claimed)), logger.F("needed", num))
+		return nil, fmt.Errorf("no free workerId, claimed %v", claimed)
+	}
+	return claimed, nil
+}
+
+// getPeers get workers all registered peers which can be talked to, the
+// invalid peers are dropped but their workers are kept registered. it fails
+// if any peer is misconfigured, it would issue colliding ids.
+func getPeers() (map[int64][]*registry.Peer, error) {
+	peers, err := reg.Peers()
+	if err != nil {
+		Logger.Error("reg.Peers() error", logger.Err(err))
+		return nil, err
+	}
+	local := localPeer()
+	for id, workers := range peers {
+		valid := workers[:0]
+		for _, peer := range workers {
+			if err = peer.Validate(); err != nil {
+				Logger.Warn("peer invalid, skipped", logger.F("worker_id", id), logger.F("hostname", peer.Hostname), logger.F("addrs", peer.RPC), logger.Err(err))
+				continue
+			}
+			if err = peer.Compatible(local); err != nil {
+				Logger.Error("peer misconfigured", logger.F("worker_id", id), logger.F("hostname", peer.Hostname), logger.F("addrs", peer.RPC), logger.F("build", peer.Build), logger.F("start", peer.Start), logger.Err(err))
+				return nil, err
+			}
+			valid = append(valid, peer)
+		}
+		peers[id] = valid
+	}
+	return peers, nil
+}
+
+// SanityReport is the result of SanityCheckPeers.
+type SanityReport struct {
+	Peers   []*PeerReport `json:"peers"`
+	Passed  int           `json:"passed"`
+	Failed  int           `json:"failed"`
+	Quorum  int           `json:"quorum"`   // percent of the peers must pass
+	MaxSkew int64         `json:"max_skew"` // milliseconds
+	Pass    bool          `json:"pass"`
+}
+
+// SanityCheckPeers probe all peers concurrently, check the datacenterId and
+// the clock skew of every peer. a peer with other datacenterId always fails
+// the check, unreachable or skewed peers are tolerated if at least the
+// quorum percent of the peers pass.
+func SanityCheckPeers() (*SanityReport, error) {
+	conf := Conf()
+	peers, err := getPeers()
+	if err != nil {
+		return nil, err
+	}
+	report := &SanityReport{
+		Peers:   probePeers(peers, conf.SkewTimeout),
+		Quorum:  conf.PeerQuorum,
+		MaxSkew: int64(conf.MaxSkew / time.Millisecond),
+	}
+	for _, r := range report.Peers {
+		if r.err == nil && r.DatacenterId != conf.DatacenterId {
+			Logger.Error("peer in another datacenter", logger.F("hostname", r.Hostname), logger.F("addr", r.Addr), logger.F("worker_ids", r.WorkerIds), logger.F("datacenter_id", r.DatacenterId), logger.F("ours", conf.DatacenterId))
+			return report, errors.New("Datacenter id insanity")
+		}
+		if r.err == nil && (r.Skew > report.MaxSkew+r.precision || r.Skew < -report.MaxSkew-r.precision) {
+			r.fail(fmt.Errorf("clock skew %dms exceeds %dms", r.Skew, report.MaxSkew))
+		}
+		if r.err != nil {
+			report.Failed++
+			Logger.Warn("peer sanity check failed", logger.F("hostname", r.Hostname), logger.F("addr", r.Addr), logger.F("worker_ids", r.WorkerIds), logger.Err(r.err))
+			continue
+		}
+		report.Passed++
+		Logger.Info("peer sanity check passed", logger.F("hostname", r.Hostname), logger.F("addr", r.Addr), logger.F("worker_ids", r.WorkerIds), logger.F("skew_ms", r.Skew), logger.F("rtt_ms", r.RTT))
+	}
+	report.Pass = report.Passed*100 >= report.Quorum*len(report.Peers)
+	if !report.Pass {
+		Logger.Error("sanity check failed", logger.F("passed", report.Passed), logger.F("peers", len(report.Peers)), logger.F("quorum_pct", report.Quorum))
+		return report, errors.New("peers sanity check failed")
+	}
+	Logger.Info("sanity check passed", logger.F("passed", report.Passed), logger.F("peers", len(report.Peers)), logger.F("quorum_pct", report.Quorum))
+	return report, nil
+}
+
+// CloseRegistry close the registry session once.
+func CloseRegistry() {
+	regCloseOnce.Do(func() {
+		if err := reg.Close(); err != nil {
+			Logger.Error("reg.Close() error", logger.Err(err))
+		}
+	})
+}
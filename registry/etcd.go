@@ -0,0 +1,413 @@
+// Copyright © 2014 Terry Mao All rights reserved.
+// This file is part of gosnowflake.
+
+// gosnowflake is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// gosnowflake is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with gosnowflake.  If not, see <http://www.gnu.org/licenses/>.
+
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/Terry-Mao/gosnowflake/logger"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+   etcd v3
+   ============
+   /gosnowflake-servers/
+   .../datacenterId # value: the cluster owns the datacenter
+   .../datacenterId/
+       .../workerId # value: high-water timestamp
+       .../workerId/leaseId # value: peer, attached to the session lease
+       .../1/
+            .../694d7a1b0c6e2f01 # leader (smallest create revision)
+            .../694d7a1b0c6e2f0c # standby
+       .../2/
+            .../694d7a1b0c6e2f0c # leader
+       .../claims/
+            .../4 # attached to the session lease, auto allocated workerId
+
+    1. a process grants one lease and keeps it alive, all of its worker keys
+       are attached to the lease, so they disappear when the process dies like
+       the zookeeper ephemeral nodes.
+    2. the key's create revision replaces the zookeeper sequence, the smallest
+       revision of a worker is the leader.
+    3. once the lease expired, the session state turns expired and a new lease
+       is granted, the claimed worker ids are claimed again with it, then the
+       state turns open. the registered keys are gone with the old lease, the
+       caller must register the workers again (see StateChanged).
+*/
+
+const (
+	etcdMinTTL     = 1               // etcd lease min ttl seconds
+	etcdRenewDelay = 1 * time.Second // delay between the lease grant retries
+)
+
+// Etcd is a registry stored in the etcd v3 cluster.
+type Etcd struct {
+	cli     *clientv3.Client
+	path    string
+	timeout time.Duration
+	ttl     int64
+	lease   int64 // clientv3.LeaseID, replaced once expired
+	ctx     context.Context
+	cancel  context.CancelFunc
+	expired int32
+	mutex   sync.Mutex
+	claims  map[int64]bool // claimed worker ids
+}
+
+// NewEtcd connect the etcd cluster, grant the session lease and keep it
+// alive, the lease ttl is the timeout.
+func NewEtcd(addrs []string, root string, timeout time.Duration) (*Etcd, error) {
+	cli, err := clientv3.New(clientv3.Config{Endpoints: addrs, DialTimeout: timeout})
+	if err != nil {
+		log.Error("clientv3.New() error", logger.F("addrs", addrs), logger.F("timeout", timeout), logger.Err(err))
+		return nil, err
+	}
+	e := &Etcd{cli: cli, path: strings.TrimSuffix(root, "/"), timeout: timeout, claims: map[int64]bool{}}
+	e.ctx, e.cancel = context.WithCancel(context.Background())
+	e.ttl = int64(timeout / time.Second)
+	if e.ttl < etcdMinTTL {
+		e.ttl = etcdMinTTL
+	}
+	ka, err := e.grant()
+	if err != nil {
+		e.cancel()
+		cli.Close()
+		return nil, err
+	}
+	StateChanged(BackendEtcd, StateOpen)
+	go e.keepAlive(ka)
+	return e, nil
+}
+
+// grant grant a new session lease and keep it alive.
+func (e *Etcd) grant() (<-chan *clientv3.LeaseKeepAliveResponse, error) {
+	ctx, cancel := context.WithTimeout(e.ctx, e.timeout)
+	resp, err := e.cli.Grant(ctx, e.ttl)
+	cancel()
+	if err != nil {
+		log.Error("etcd.Grant() error", logger.F("ttl", e.ttl), logger.Err(err))
+		return nil, err
+	}
+	ka, err := e.cli.KeepAlive(e.ctx, resp.ID)
+	if err != nil {
+		log.Error("etcd.KeepAlive() error", logger.F("lease", fmt.Sprintf("%x", int64(resp.ID))), logger.Err(err))
+		return nil, err
+	}
+	atomic.StoreInt64(&e.lease, int64(resp.ID))
+	return ka, nil
+}
+
+// keepAlive consume the keepalive responses, once the lease expired, grant a
+// new lease and claim the claimed worker ids again until succeeded.
+func (e *Etcd) keepAlive(ka <-chan *clientv3.LeaseKeepAliveResponse) {
+	for {
+		for range ka {
+		}
+		select {
+		case <-e.ctx.Done():
+			log.Info("etcd lease keepalive stop", logger.F("lease", fmt.Sprintf("%x", e.leaseId())))
+			return
+		default:
+		}
+		atomic.StoreInt32(&e.expired, 1)
+		StateChanged(BackendEtcd, StateExpired)
+		log.Error("etcd lease expired, all workers are dropped", logger.F("lease", fmt.Sprintf("%x", e.leaseId())))
+		for {
+			var err error
+			if ka, err = e.renew(); err == nil {
+				break
+			}
+			select {
+			case <-e.ctx.Done():
+				return
+			case <-time.After(etcdRenewDelay):
+			}
+		}
+		atomic.StoreInt32(&e.expired, 0)
+		log.Info("etcd lease renewed", logger.F("lease", fmt.Sprintf("%x", e.leaseId())))
+		StateChanged(BackendEtcd, StateOpen)
+	}
+}
+
+// renew grant a new lease and claim the claimed worker ids again, the lease
+// is revoked if any claim fails.
+func (e *Etcd) renew() (<-chan *clientv3.LeaseKeepAliveResponse, error) {
+	ka, err := e.grant()
+	if err != nil {
+		return nil, err
+	}
+	e.mutex.Lock()
+	claims := make([]int64, 0, len(e.claims))
+	for workerId := range e.claims {
+		claims = append(claims, workerId)
+	}
+	e.mutex.Unlock()
+	for _, workerId := range claims {
+		if err = e.Claim(workerId); err != nil {
+			// a claim taken by another process is never given back
+			log.Error("claim the worker id again error, stay expired", logger.F("worker_id", workerId), logger.Err(err))
+			ctx, cancel := context.WithTimeout(e.ctx, e.timeout)
+			e.cli.Revoke(ctx, e.leaseId())
+			cancel()
+			return nil, err
+		}
+	}
+	return ka, nil
+}
+
+// leaseId get the current session lease.
+func (e *Etcd) leaseId() clientv3.LeaseID {
+	return clientv3.LeaseID(atomic.LoadInt64(&e.lease))
+}
+
+// workerKey get the worker key.
+func (e *Etcd) workerKey(workerId int64) string {
+	return fmt.Sprintf("%s/%d", e.path, workerId)
+}
+
+// nodeKey get the key of the session under the worker key.
+func (e *Etcd) nodeKey(workerId int64) string {
+	return fmt.Sprintf("%s/%x", e.workerKey(workerId), int64(e.leaseId()))
+}
+
+// Register put the peer under the worker key with the session lease.
+func (e *Etcd) Register(workerId int64, peer *Peer) error {
+	d, err := json.Marshal(peer)
+	if err != nil {
+		log.Error("json.Marshal() error", logger.Err(err))
+		return err
+	}
+	key := e.nodeKey(workerId)
+	ctx, cancel := context.WithTimeout(e.ctx, e.timeout)
+	defer cancel()
+	if _, err = e.cli.Put(ctx, key, string(d), clientv3.WithLease(e.leaseId())); err != nil {
+		log.Error("etcd.Put() error", logger.F("key", key), logger.Err(err))
+		return err
+	}
+	return nil
+}
+
+// Deregister delete the worker key put by Register.
+func (e *Etcd) Deregister(workerId int64) error {
+	key := e.nodeKey(workerId)
+	ctx, cancel := context.WithTimeout(e.ctx, e.timeout)
+	defer cancel()
+	if _, err := e.cli.Delete(ctx, key); err != nil {
+		log.Error("etcd.Delete() error", logger.F("key", key), logger.Err(err))
+		return err
+	}
+	return nil
+}
+
+// State get the session lease state.
+func (e *Etcd) State() string {
+	if e.ctx.Err() != nil {
+		return StateClosed
+	}
+	if atomic.LoadInt32(&e.expired) == 1 {
+		return StateExpired
+	}
+	return StateOpen
+}
+
+// Role get the role of the key put by the session, the smallest create
+// revision key is the leader.
+func (e *Etcd) Role(workerId int64) (string, error) {
+	prefix := e.workerKey(workerId) + "/"
+	ctx, cancel := context.WithTimeout(e.ctx, e.timeout)
+	defer cancel()
+	resp, err := e.cli.Get(ctx, prefix, clientv3.WithFirstCreate()...)
+	if err != nil {
+		log.Error("etcd.Get() error", logger.F("key", prefix), logger.Err(err))
+		return "", err
+	}
+	key := e.nodeKey(workerId)
+	if len(resp.Kvs) > 0 && string(resp.Kvs[0].Key) == key {
+		return RoleLeader, nil
+	}
+	if resp, err = e.cli.Get(ctx, key, clientv3.WithCountOnly()); err != nil {
+		log.Error("etcd.Get() error", logger.F("key", key), logger.Err(err))
+		return "", err
+	}
+	if resp.Count > 0 {
+		return RoleStandby, nil
+	}
+	return RoleNone, nil
+}
+
+// Peers get all workers' peers under the root path.
+func (e *Etcd) Peers() (map[int64][]*Peer, error) {
+	prefix := e.path + "/"
+	ctx, cancel := context.WithTimeout(e.ctx, e.timeout)
+	defer cancel()
+	resp, err := e.cli.Get(ctx, prefix, clientv3.WithPrefix(), clientv3.WithSort(clientv3.SortByCreateRevision, clientv3.SortAscend))
+	if err != nil {
+		log.Error("etcd.Get() error", logger.F("key", prefix), logger.Err(err))
+		return nil, err
+	}
+	res := map[int64][]*Peer{}
+	for _, kv := range resp.Kvs {
+		// skip the high-water and claim keys
+		ks := strings.Split(strings.TrimPrefix(string(kv.Key), prefix), "/")
+		if len(ks) != 2 || ks[0] == claimsNode {
+			continue
+		}
+		id, err := strconv.ParseInt(ks[0], 10, 64)
+		if err != nil {
+			log.Error("strconv.ParseInt() error", logger.F("worker", ks[0]), logger.Err(err))
+			return nil, err
+		}
+		peer := &Peer{}
+		if err = json.Unmarshal(kv.Value, peer); err != nil {
+			log.Error("json.Unmarshal(peer) error", logger.F("data", string(kv.Value)), logger.Err(err))
+			return nil, err
+		}
+		res[id] = append(res[id], peer)
+	}
+	return res, nil
+}
+
+// WatchWorker get the smallest create revision key as the leader and watch
+// the worker's keys after the read revision.
+func (e *Etcd) WatchWorker(workerId int64) (*Node, <-chan struct{}, error) {
+	prefix := e.workerKey(workerId) + "/"
+	ctx, cancel := context.WithTimeout(e.ctx, e.timeout)
+	resp, err := e.cli.Get(ctx, prefix, clientv3.WithFirstCreate()...)
+	cancel()
+	if err != nil {
+		log.Error("etcd.Get() error", logger.F("key", prefix), logger.Err(err))
+		return nil, nil, err
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, nil, ErrNoNode
+	}
+	kv := resp.Kvs[0]
+	peer := &Peer{}
+	if err = json.Unmarshal(kv.Value, peer); err != nil {
+		log.Error("json.Unmarshal(peer) error", logger.F("data", string(kv.Value)), logger.Err(err))
+		return nil, nil, err
+	}
+	event := make(chan struct{})
+	wctx, wcancel := context.WithCancel(e.ctx)
+	watch := e.cli.Watch(wctx, prefix, clientv3.WithPrefix(), clientv3.WithRev(resp.Header.Revision+1))
+	go func() {
+		defer wcancel()
+		if w, ok := <-watch; ok && w.Err() != nil {
+			log.Error("etcd.Watch() error", logger.F("key", prefix), logger.Err(w.Err()))
+		}
+		log.Info("etcd key changed", logger.F("key", prefix))
+		close(event)
+	}()
+	return &Node{Name: string(kv.Key), Peer: peer}, event, nil
+}
+
+// ClaimDatacenter put the cluster as the datacenter key if it doesn't exist.
+func (e *Etcd) ClaimDatacenter(cluster string) error {
+	ctx, cancel := context.WithTimeout(e.ctx, e.timeout)
+	defer cancel()
+	resp, err := e.cli.Txn(ctx).
+		If(clientv3.Compare(clientv3.CreateRevision(e.path), "=", 0)).
+		Then(clientv3.OpPut(e.path, cluster)).
+		Else(clientv3.OpGet(e.path)).
+		Commit()
+	if err != nil {
+		log.Error("etcd.Txn() error", logger.F("key", e.path), logger.Err(err))
+		return err
+	}
+	if resp.Succeeded {
+		return nil
+	}
+	if kvs := resp.Responses[0].GetResponseRange().Kvs; len(kvs) > 0 && string(kvs[0].Value) != cluster {
+		log.Error("datacenter owned by another cluster", logger.F("path", e.path), logger.F("owner", string(kvs[0].Value)), logger.F("cluster", cluster))
+		return ErrDatacenter
+	}
+	return nil
+}
+
+// Claim put the claim key with the session lease only if it doesn't exist.
+func (e *Etcd) Claim(workerId int64) error {
+	key := fmt.Sprintf("%s/%s/%d", e.path, claimsNode, workerId)
+	ctx, cancel := context.WithTimeout(e.ctx, e.timeout)
+	defer cancel()
+	resp, err := e.cli.Txn(ctx).
+		If(clientv3.Compare(clientv3.CreateRevision(key), "=", 0)).
+		Then(clientv3.OpPut(key, "", clientv3.WithLease(e.leaseId()))).
+		Commit()
+	if err != nil {
+		log.Error("etcd.Txn() error", logger.F("key", key), logger.Err(err))
+		return err
+	}
+	if !resp.Succeeded {
+		return ErrClaimed
+	}
+	e.mutex.Lock()
+	e.claims[workerId] = true
+	e.mutex.Unlock()
+	return nil
+}
+
+// HighWater get the timestamp stored in the worker key.
+func (e *Etcd) HighWater(workerId int64) (int64, error) {
+	key := e.workerKey(workerId)
+	ctx, cancel := context.WithTimeout(e.ctx, e.timeout)
+	defer cancel()
+	resp, err := e.cli.Get(ctx, key)
+	if err != nil {
+		log.Error("etcd.Get() error", logger.F("key", key), logger.Err(err))
+		return 0, err
+	}
+	if len(resp.Kvs) == 0 {
+		return 0, nil
+	}
+	timestamp, err := strconv.ParseInt(string(resp.Kvs[0].Value), 10, 64)
+	if err != nil {
+		log.Error("strconv.ParseInt() error", logger.F("data", string(resp.Kvs[0].Value)), logger.Err(err))
+		return 0, err
+	}
+	return timestamp, nil
+}
+
+// SetHighWater store the timestamp in the worker key.
+func (e *Etcd) SetHighWater(workerId int64, timestamp int64) error {
+	key := e.workerKey(workerId)
+	ctx, cancel := context.WithTimeout(e.ctx, e.timeout)
+	defer cancel()
+	if _, err := e.cli.Put(ctx, key, strconv.FormatInt(timestamp, 10)); err != nil {
+		log.Error("etcd.Put() error", logger.F("key", key), logger.F("timestamp", timestamp), logger.Err(err))
+		return err
+	}
+	return nil
+}
+
+// Close revoke the session lease, then close the etcd connection.
+func (e *Etcd) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), e.timeout)
+	defer cancel()
+	// stop renewing before revoking
+	e.cancel()
+	if _, err := e.cli.Revoke(ctx, e.leaseId()); err != nil {
+		log.Error("etcd.Revoke() error", logger.F("lease", fmt.Sprintf("%x", e.leaseId())), logger.Err(err))
+	}
+	return e.cli.Close()
+}
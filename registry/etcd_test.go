@@ -0,0 +1,152 @@
+// Copyright © 2014 Terry Mao All rights reserved.
+// This file is part of gosnowflake.
+
+// gosnowflake is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// gosnowflake is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with gosnowflake.  If not, see <http://www.gnu.org/licenses/>.
+
+package registry
+
+import (
+	"context"
+	"go.etcd.io/etcd/server/v3/embed"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+)
+
+// freeURL get a free local http url.
+func freeURL(t *testing.T) url.URL {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return url.URL{Scheme: "http", Host: l.Addr().String()}
+}
+
+// startEtcd start a single member embedded etcd server.
+func startEtcd(t *testing.T) (*embed.Etcd, string) {
+	dir, err := ioutil.TempDir("", "gosnowflake-etcd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := embed.NewConfig()
+	cfg.Dir = dir
+	cfg.LogLevel = "error"
+	clientURL, peerURL := freeURL(t), freeURL(t)
+	cfg.ListenClientUrls = []url.URL{clientURL}
+	cfg.AdvertiseClientUrls = []url.URL{clientURL}
+	cfg.ListenPeerUrls = []url.URL{peerURL}
+	cfg.AdvertisePeerUrls = []url.URL{peerURL}
+	cfg.InitialCluster = cfg.InitialClusterFromName(cfg.Name)
+	e, err := embed.StartEtcd(cfg)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	select {
+	case <-e.Server.ReadyNotify():
+	case <-time.After(10 * time.Second):
+		e.Close()
+		os.RemoveAll(dir)
+		t.Fatal("embedded etcd not ready")
+	}
+	return e, clientURL.Host
+}
+
+func TestEtcd(t *testing.T) {
+	e, addr := startEtcd(t)
+	defer e.Close()
+	leader, err := NewEtcd([]string{addr}, "/gosnowflake-test", 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	standby, err := NewEtcd([]string{addr}, "/gosnowflake-test", 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer standby.Close()
+	if err = leader.Register(1, &Peer{RPC: []string{"leader:8080"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err = standby.Register(1, &Peer{RPC: []string{"standby:8080"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err = standby.SetHighWater(1, 1000); err != nil {
+		t.Fatal(err)
+	}
+	peers, err := standby.Peers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(peers) != 1 || len(peers[1]) != 2 {
+		t.Fatalf("peers: %v, expected 2 peers of worker 1", peers)
+	}
+	node, watch, err := standby.WatchWorker(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if node.Peer.RPC[0] != "leader:8080" {
+		t.Fatalf("leader: %s, expected leader:8080", node.Peer.RPC[0])
+	}
+	if role, err := standby.Role(1); err != nil || role != RoleStandby {
+		t.Fatalf("Role(1) = %s, error(%v), expected %s", role, err, RoleStandby)
+	}
+	// leader lease revoked, standby takes over
+	leader.Close()
+	if state := leader.State(); state != StateClosed {
+		t.Fatalf("State() = %s, expected %s", state, StateClosed)
+	}
+	select {
+	case <-watch:
+	case <-time.After(5 * time.Second):
+		t.Fatal("watch event not fired")
+	}
+	if node, _, err = standby.WatchWorker(1); err != nil {
+		t.Fatal(err)
+	}
+	if node.Peer.RPC[0] != "standby:8080" {
+		t.Fatalf("leader: %s, expected standby:8080", node.Peer.RPC[0])
+	}
+	if role, err := standby.Role(1); err != nil || role != RoleLeader {
+		t.Fatalf("Role(1) = %s, error(%v), expected %s", role, err, RoleLeader)
+	}
+	if hw, err := standby.HighWater(1); err != nil || hw != 1000 {
+		t.Fatalf("high-water: %d error(%v), expected 1000", hw, err)
+	}
+	// the expired lease is renewed with the claims
+	if err = standby.Claim(2); err != nil {
+		t.Fatal(err)
+	}
+	lease := standby.leaseId()
+	other, err := NewEtcd([]string{addr}, "/gosnowflake-test", 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	if _, err = other.cli.Revoke(context.Background(), lease); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; standby.leaseId() == lease || standby.State() != StateOpen; i++ {
+		if i > 100 {
+			t.Fatalf("lease not renewed, state: %s", standby.State())
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if err = other.Claim(2); err != ErrClaimed {
+		t.Fatalf("Claim(2) of the renewed claim error(%v), expected %v", err, ErrClaimed)
+	}
+}
@@ -0,0 +1,253 @@
+// Copyright © 2014 Terry Mao All rights reserved.
+// This file is part of gosnowflake.
+
+// gosnowflake is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// gosnowflake is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with gosnowflake.  If not, see <http://www.gnu.org/licenses/>.
+
+package registry
+
+import (
+	"fmt"
+	"sync"
+)
+
+var (
+	// DefaultMemory is the process wide store used by the "memory" backend.
+	DefaultMemory = NewMemoryStore()
+)
+
+type memoryNode struct {
+	name    string
+	session int64
+	peer    *Peer
+}
+
+// MemoryStore is an in-process registry store of one datacenter, every
+// session of the store acts as a zookeeper session: the nodes are dropped
+// when it is closed.
+type MemoryStore struct {
+	mutex     sync.Mutex
+	cluster   string
+	seq       int64
+	session   int64
+	nodes     map[int64][]*memoryNode
+	claims    map[int64]int64 // workerId => session
+	highWater map[int64]int64
+	watchers  map[int64][]chan struct{}
+}
+
+// NewMemoryStore new a empty in-process registry store.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		nodes:     map[int64][]*memoryNode{},
+		claims:    map[int64]int64{},
+		highWater: map[int64]int64{},
+		watchers:  map[int64][]chan struct{}{},
+	}
+}
+
+// Session open a new registry session on the store.
+func (s *MemoryStore) Session() *Memory {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.session++
+	return &Memory{store: s, session: s.session}
+}
+
+// notify wake up all the watchers of the worker, must hold the mutex.
+func (s *MemoryStore) notify(workerId int64) {
+	for _, w := range s.watchers[workerId] {
+		close(w)
+	}
+	delete(s.watchers, workerId)
+}
+
+// Memory is a session of the in-process registry, used by tests and single
+// process deployments.
+type Memory struct {
+	store   *MemoryStore
+	session int64
+	closed  bool
+}
+
+// Register append a node to the worker, ordered by a store wide sequence.
+func (m *Memory) Register(workerId int64, peer *Peer) error {
+	s := m.store
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if m.closed {
+		return ErrRegistryClosed
+	}
+	if workerId < 0 {
+		return ErrInvalidWorkerId
+	}
+	s.seq++
+	s.nodes[workerId] = append(s.nodes[workerId], &memoryNode{
+		name:    fmt.Sprintf("%010d", s.seq),
+		session: m.session,
+		peer:    peer,
+	})
+	s.notify(workerId)
+	return nil
+}
+
+// Deregister drop the nodes of the worker registered by the session.
+func (m *Memory) Deregister(workerId int64) error {
+	s := m.store
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	m.drop(workerId)
+	return nil
+}
+
+// drop drop the session nodes of the worker, must hold the mutex.
+func (m *Memory) drop(workerId int64) {
+	s := m.store
+	nodes := s.nodes[workerId]
+	left := make([]*memoryNode, 0, len(nodes))
+	for _, node := range nodes {
+		if node.session != m.session {
+			left = append(left, node)
+		}
+	}
+	if len(left) == len(nodes) {
+		return
+	}
+	if len(left) == 0 {
+		delete(s.nodes, workerId)
+	} else {
+		s.nodes[workerId] = left
+	}
+	s.notify(workerId)
+}
+
+// State get the session state.
+func (m *Memory) State() string {
+	s := m.store
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if m.closed {
+		return StateClosed
+	}
+	return StateOpen
+}
+
+// Role get the role of the session's node, the first node is the leader.
+func (m *Memory) Role(workerId int64) (string, error) {
+	s := m.store
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for i, node := range s.nodes[workerId] {
+		if node.session == m.session {
+			if i == 0 {
+				return RoleLeader, nil
+			}
+			return RoleStandby, nil
+		}
+	}
+	return RoleNone, nil
+}
+
+// Peers get all workers' registered peers.
+func (m *Memory) Peers() (map[int64][]*Peer, error) {
+	s := m.store
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	res := make(map[int64][]*Peer, len(s.nodes))
+	for id, nodes := range s.nodes {
+		for _, node := range nodes {
+			res[id] = append(res[id], node.peer)
+		}
+	}
+	return res, nil
+}
+
+// WatchWorker get the first registered node as the leader, nodes are
+// appended in sequence order.
+func (m *Memory) WatchWorker(workerId int64) (*Node, <-chan struct{}, error) {
+	s := m.store
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	nodes := s.nodes[workerId]
+	if len(nodes) == 0 {
+		return nil, nil, ErrNoNode
+	}
+	event := make(chan struct{})
+	s.watchers[workerId] = append(s.watchers[workerId], event)
+	return &Node{Name: nodes[0].name, Peer: nodes[0].peer}, event, nil
+}
+
+// ClaimDatacenter set the store cluster if it's empty.
+func (m *Memory) ClaimDatacenter(cluster string) error {
+	s := m.store
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.cluster == "" {
+		s.cluster = cluster
+	} else if s.cluster != cluster {
+		return ErrDatacenter
+	}
+	return nil
+}
+
+// Claim claim the workerId for the session.
+func (m *Memory) Claim(workerId int64) error {
+	s := m.store
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if m.closed {
+		return ErrRegistryClosed
+	}
+	if _, ok := s.claims[workerId]; ok {
+		return ErrClaimed
+	}
+	s.claims[workerId] = m.session
+	return nil
+}
+
+// HighWater get the last persisted timestamp of the worker.
+func (m *Memory) HighWater(workerId int64) (int64, error) {
+	s := m.store
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.highWater[workerId], nil
+}
+
+// SetHighWater persist the timestamp of the worker in the store.
+func (m *Memory) SetHighWater(workerId int64, timestamp int64) error {
+	s := m.store
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.highWater[workerId] = timestamp
+	return nil
+}
+
+// Close drop all the nodes and claims of the session.
+func (m *Memory) Close() error {
+	s := m.store
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if m.closed {
+		return nil
+	}
+	m.closed = true
+	for id, session := range s.claims {
+		if session == m.session {
+			delete(s.claims, id)
+		}
+	}
+	for id := range s.nodes {
+		m.drop(id)
+	}
+	return nil
+}
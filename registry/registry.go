@@ -0,0 +1,252 @@
+// Copyright © 2014 Terry Mao All rights reserved.
+// This file is part of gosnowflake.
+
+// gosnowflake is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// gosnowflake is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with gosnowflake.  If not, see <http://www.gnu.org/licenses/>.
+
+package registry
+
+import (
+	"errors"
+	"fmt"
+	"github.com/Terry-Mao/gosnowflake/logger"
+	"path"
+	"strconv"
+	"time"
+)
+
+const (
+	// PeerVersion is the current schema version of the registered peer data,
+	// peers registered by old versions have no schema version (0).
+	PeerVersion = 1
+	// served protocols
+	ProtocolRPC    = "rpc"
+	ProtocolThrift = "thrift"
+	// ProtocolTrace is served along with rpc by the peers continuing the
+	// caller's trace (SnowflakeRPC.TracedNextId).
+	ProtocolTrace = "rpc.trace"
+
+	BackendZookeeper = "zookeeper"
+	BackendEtcd      = "etcd"
+	BackendStatic    = "static"
+	BackendMemory    = "memory"
+
+	// the roles of a registered worker node
+	RoleLeader  = "leader"  // the clients use it
+	RoleStandby = "standby" // takes over when the leader's node is dropped
+	RoleNone    = "none"    // not registered by the session
+
+	// the session states, the native states of the backends are mapped to
+	StateOpen       = "open"
+	StateExpired    = "expired"
+	StateClosed     = "closed"
+	StateConnecting = "connecting" // (re)connecting, the session may be alive
+)
+
+var (
+	ErrNoNode          = errors.New("registry: worker has no node")
+	ErrUnknownBackend  = errors.New("registry: unknown backend")
+	ErrNotRegistered   = errors.New("registry: worker not in static registry")
+	ErrRegistryClosed  = errors.New("registry: closed")
+	ErrInvalidWorkerId = errors.New("registry: invalid worker id")
+	ErrClaimed         = errors.New("registry: worker id already claimed")
+	ErrNotSupported    = errors.New("registry: not supported by the backend")
+	ErrDatacenter      = errors.New("registry: datacenter id claimed by another cluster")
+	ErrPeerVersion     = errors.New("registry: peer schema version unsupported")
+	ErrPeerNoRPC       = errors.New("registry: peer serves no rpc")
+	ErrPeerLayout      = errors.New("registry: peer bit layout mismatch")
+	ErrPeerEpoch       = errors.New("registry: peer epoch mismatch")
+	ErrPeerDatacenter  = errors.New("registry: peer datacenter mismatch")
+	ErrSessionExpired  = errors.New("registry: session expired, workers dropped")
+	ErrLegacyWorker    = errors.New("registry: worker still registered in the legacy layout")
+	ErrLegacyPath      = errors.New("registry: legacy path is the root path")
+
+	// StateChanged is called when a session state of the backend changes,
+	// e.g. to count the transitions.
+	StateChanged = func(backend, state string) {}
+
+	// log is the registry logger, see SetLogger.
+	log logger.Logger = logger.Log4go{}
+
+	// DefaultLayout is the twitter snowflake bit layout.
+	DefaultLayout = Layout{WorkerIdBits: 5, DatacenterIdBits: 5, SequenceBits: 12}
+)
+
+const (
+	// claimsNode is the child of the root path which holds the claimed
+	// worker ids, it's not a worker.
+	claimsNode = "claims"
+)
+
+// SetLogger set the logger of the registry, a nil logger discards the
+// messages. It must be called before creating the registry.
+func SetLogger(l logger.Logger) {
+	if l == nil {
+		l = logger.Nop{}
+	}
+	log = l
+}
+
+// Layout is the snowflake id bit layout.
+type Layout struct {
+	WorkerIdBits     uint `json:"worker_id_bits"`
+	DatacenterIdBits uint `json:"datacenter_id_bits"`
+	SequenceBits     uint `json:"sequence_bits"`
+}
+
+// String format the layout as "datacenter/worker/sequence" bits.
+func (l Layout) String() string {
+	return fmt.Sprintf("%d/%d/%d", l.DatacenterIdBits, l.WorkerIdBits, l.SequenceBits)
+}
+
+// Peer store data in the registry.
+type Peer struct {
+	Version    int      `json:"version"`
+	RPC        []string `json:"rpc"`
+	Thrift     []string `json:"thrift"`
+	Datacenter int64    `json:"datacenter"`
+	Hostname   string   `json:"hostname"`
+	Start      int64    `json:"start"` // process start unix milliseconds
+	Build      string   `json:"build"`
+	Layout     Layout   `json:"layout"`
+	Epoch      int64    `json:"epoch"` // twepoch unix milliseconds
+	Protocols  []string `json:"protocols"`
+}
+
+// Serve check the peer serves the protocol, old peers only serve rpc.
+func (p *Peer) Serve(protocol string) bool {
+	if p.Version == 0 {
+		return protocol == ProtocolRPC && len(p.RPC) > 0
+	}
+	for _, proto := range p.Protocols {
+		if proto == protocol {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate check the peer data can be talked to by golang rpc.
+func (p *Peer) Validate() error {
+	if p.Version > PeerVersion {
+		return fmt.Errorf("%v: %d, max %d", ErrPeerVersion, p.Version, PeerVersion)
+	}
+	if !p.Serve(ProtocolRPC) || len(p.RPC) == 0 {
+		return ErrPeerNoRPC
+	}
+	return nil
+}
+
+// Compatible check the peer issues ids in the same way as the expected one,
+// old peers without schema version only can be checked by rpc.
+func (p *Peer) Compatible(e *Peer) error {
+	if p.Version == 0 {
+		return nil
+	}
+	if p.Layout != e.Layout {
+		return fmt.Errorf("%v: %s, expected %s", ErrPeerLayout, p.Layout, e.Layout)
+	}
+	if p.Epoch != e.Epoch {
+		return fmt.Errorf("%v: %d, expected %d", ErrPeerEpoch, p.Epoch, e.Epoch)
+	}
+	if p.Datacenter != e.Datacenter {
+		return fmt.Errorf("%v: %d, expected %d", ErrPeerDatacenter, p.Datacenter, e.Datacenter)
+	}
+	return nil
+}
+
+// Node is a registered peer of a worker, Name is ordered by registration so
+// the first node is the leader.
+type Node struct {
+	Name string
+	Peer *Peer
+}
+
+// Registry is the coordination backend of gosnowflake, the server registers
+// its workers and checks peers, the client watches the worker leader.
+type Registry interface {
+	// Register register the peer as a leader or standby of the workerId, the
+	// node lives as long as the registry session.
+	Register(workerId int64, peer *Peer) error
+	// Deregister drop the peer registered by the session for the workerId,
+	// the claim of the workerId is kept.
+	Deregister(workerId int64) error
+	// Peers get all workers' registered peers.
+	Peers() (map[int64][]*Peer, error)
+	// WatchWorker get the leader node of the workerId and a channel which is
+	// closed when the worker's nodes change.
+	WatchWorker(workerId int64) (*Node, <-chan struct{}, error)
+	// ClaimDatacenter claim the registry datacenter for the cluster, the
+	// first cluster owns it, ErrDatacenter if owned by another cluster.
+	ClaimDatacenter(cluster string) error
+	// Claim exclusively claim the workerId with an atomic create, the claim
+	// lives as long as the registry session, ErrClaimed if already claimed.
+	Claim(workerId int64) error
+	// HighWater get the last persisted timestamp of the workerId, 0 if none.
+	HighWater(workerId int64) (int64, error)
+	// SetHighWater persist the last issued timestamp of the workerId.
+	SetHighWater(workerId int64, timestamp int64) error
+	// State get the registry session state, e.g. the zookeeper connection
+	// state.
+	State() string
+	// Role get the role of the session's node of the workerId: RoleLeader,
+	// RoleStandby or RoleNone.
+	Role(workerId int64) (string, error)
+	// Close close the registry session, all the registered nodes are dropped.
+	Close() error
+}
+
+// Config is the registry backend configuration.
+type Config struct {
+	Backend     string
+	Datacenter  int64
+	ZKAddr      []string
+	ZKTimeout   time.Duration
+	ZKPath      string
+	ZKLegacy    string
+	EtcdAddr    []string
+	EtcdTimeout time.Duration
+	EtcdPath    string
+	StaticFile  string
+}
+
+// New new a registry by the backend name.
+func New(c *Config) (Registry, error) {
+	switch c.Backend {
+	case BackendZookeeper, "":
+		// both layouts under one root mix the worker and datacenter nodes
+		if c.ZKLegacy != "" && path.Clean(c.ZKLegacy) == path.Clean(c.ZKPath) {
+			return nil, ErrLegacyPath
+		}
+		z, err := NewZookeeper(c.ZKAddr, DatacenterPath(c.ZKPath, c.Datacenter), c.ZKTimeout)
+		if err != nil {
+			return nil, err
+		}
+		z.SetLegacy(c.ZKLegacy)
+		return z, nil
+	case BackendEtcd:
+		return NewEtcd(c.EtcdAddr, DatacenterPath(c.EtcdPath, c.Datacenter), c.EtcdTimeout)
+	case BackendStatic:
+		return NewStatic(c.StaticFile)
+	case BackendMemory:
+		return DefaultMemory.Session(), nil
+	default:
+		return nil, fmt.Errorf("%v: \"%s\"", ErrUnknownBackend, c.Backend)
+	}
+}
+
+// DatacenterPath get the registry path of the datacenter, every datacenter
+// has its own namespace under the root path.
+func DatacenterPath(root string, datacenterId int64) string {
+	return path.Join(root, strconv.FormatInt(datacenterId, 10))
+}
@@ -0,0 +1,189 @@
+// Copyright © 2014 Terry Mao All rights reserved.
+// This file is part of gosnowflake.
+
+// gosnowflake is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// gosnowflake is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with gosnowflake.  If not, see <http://www.gnu.org/licenses/>.
+
+package registry
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMemory(t *testing.T) {
+	store := NewMemoryStore()
+	leader, standby := store.Session(), store.Session()
+	if err := leader.Register(1, &Peer{RPC: []string{"leader:8080"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := standby.Register(1, &Peer{RPC: []string{"standby:8080"}}); err != nil {
+		t.Fatal(err)
+	}
+	peers, err := standby.Peers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(peers[1]) != 2 {
+		t.Fatalf("peers[1] length: %d, expected 2", len(peers[1]))
+	}
+	node, watch, err := standby.WatchWorker(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if node.Peer.RPC[0] != "leader:8080" {
+		t.Fatalf("leader: %s, expected leader:8080", node.Peer.RPC[0])
+	}
+	for s, expected := range map[*Memory]string{leader: RoleLeader, standby: RoleStandby, store.Session(): RoleNone} {
+		if role, err := s.Role(1); err != nil || role != expected {
+			t.Fatalf("Role(1) = %s, error(%v), expected %s", role, err, expected)
+		}
+	}
+	// leader session expired, standby takes over
+	leader.Close()
+	if state := leader.State(); state != StateClosed {
+		t.Fatalf("State() = %s, expected %s", state, StateClosed)
+	}
+	select {
+	case <-watch:
+	case <-time.After(time.Second):
+		t.Fatal("watch event not fired")
+	}
+	if node, _, err = standby.WatchWorker(1); err != nil {
+		t.Fatal(err)
+	}
+	if node.Peer.RPC[0] != "standby:8080" {
+		t.Fatalf("leader: %s, expected standby:8080", node.Peer.RPC[0])
+	}
+	if role, err := standby.Role(1); err != nil || role != RoleLeader {
+		t.Fatalf("Role(1) = %s, error(%v), expected %s", role, err, RoleLeader)
+	}
+	standby.Close()
+	if _, _, err = store.Session().WatchWorker(1); err != ErrNoNode {
+		t.Fatalf("WatchWorker error(%v), expected %v", err, ErrNoNode)
+	}
+	// claims are exclusive and dropped with the session
+	claimer := store.Session()
+	if err = claimer.Claim(2); err != nil {
+		t.Fatal(err)
+	}
+	if err = store.Session().Claim(2); err != ErrClaimed {
+		t.Fatalf("Claim(2) error(%v), expected %v", err, ErrClaimed)
+	}
+	claimer.Close()
+	if err = store.Session().Claim(2); err != nil {
+		t.Fatal(err)
+	}
+	// datacenter owned by the first cluster
+	if err = store.Session().ClaimDatacenter("idc1"); err != nil {
+		t.Fatal(err)
+	}
+	if err = store.Session().ClaimDatacenter("idc1"); err != nil {
+		t.Fatal(err)
+	}
+	if err = store.Session().ClaimDatacenter("idc2"); err != ErrDatacenter {
+		t.Fatalf("ClaimDatacenter(\"idc2\") error(%v), expected %v", err, ErrDatacenter)
+	}
+	// high-water survives sessions
+	if err = standby.SetHighWater(1, 1000); err != nil {
+		t.Fatal(err)
+	}
+	if hw, _ := store.Session().HighWater(1); hw != 1000 {
+		t.Fatalf("high-water: %d, expected 1000", hw)
+	}
+}
+
+func TestStatic(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gosnowflake")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "peers.json")
+	if err = ioutil.WriteFile(file, []byte(`{"0": [{"rpc": ["a:8080"]}, {"rpc": ["b:8080"]}]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewStatic(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if err = s.Register(0, &Peer{}); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Register(1, &Peer{}); err != ErrNotRegistered {
+		t.Fatalf("Register(1) error(%v), expected %v", err, ErrNotRegistered)
+	}
+	node, _, err := s.WatchWorker(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if node.Peer.RPC[0] != "a:8080" {
+		t.Fatalf("leader: %s, expected a:8080", node.Peer.RPC[0])
+	}
+}
+
+func TestPeer(t *testing.T) {
+	local := &Peer{Version: PeerVersion, RPC: []string{"a:8080"}, Layout: DefaultLayout, Epoch: 1288834974657, Datacenter: 1, Protocols: []string{ProtocolRPC}}
+	if err := local.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	// old peers only serve rpc and can't be checked
+	legacy := &Peer{RPC: []string{"b:8080"}}
+	if err := legacy.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := legacy.Compatible(local); err != nil {
+		t.Fatal(err)
+	}
+	// the trace is continued only by the peers advertising it
+	if legacy.Serve(ProtocolTrace) || local.Serve(ProtocolTrace) {
+		t.Fatal("Serve(ProtocolTrace) expected false without advertised")
+	}
+	if traced := (&Peer{Version: PeerVersion, RPC: []string{"a:8080"}, Protocols: []string{ProtocolRPC, ProtocolTrace}}); !traced.Serve(ProtocolTrace) {
+		t.Fatal("Serve(ProtocolTrace) expected true")
+	}
+	thrift := &Peer{Version: PeerVersion, Thrift: []string{"c:8081"}, Protocols: []string{ProtocolThrift}}
+	if err := thrift.Validate(); err != ErrPeerNoRPC {
+		t.Fatalf("Validate() error(%v), expected %v", err, ErrPeerNoRPC)
+	}
+	future := &Peer{Version: PeerVersion + 1, RPC: []string{"d:8080"}, Protocols: []string{ProtocolRPC}}
+	if err := future.Validate(); err == nil {
+		t.Fatal("Validate() expected schema version error")
+	}
+	peer := *local
+	peer.Layout.SequenceBits = 10
+	if err := peer.Compatible(local); err == nil {
+		t.Fatal("Compatible() expected layout error")
+	}
+	peer = *local
+	peer.Epoch = 0
+	if err := peer.Compatible(local); err == nil {
+		t.Fatal("Compatible() expected epoch error")
+	}
+	peer = *local
+	peer.Datacenter = 2
+	if err := peer.Compatible(local); err == nil {
+		t.Fatal("Compatible() expected datacenter error")
+	}
+}
+
+func TestNewLegacyPath(t *testing.T) {
+	c := &Config{Backend: BackendZookeeper, ZKPath: "/gosnowflake-servers", ZKLegacy: "/gosnowflake-servers/"}
+	if _, err := New(c); err != ErrLegacyPath {
+		t.Fatalf("New() error(%v), expected %v", err, ErrLegacyPath)
+	}
+}
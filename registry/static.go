@@ -0,0 +1,192 @@
+// Copyright © 2014 Terry Mao All rights reserved.
+// This file is part of gosnowflake.
+
+// gosnowflake is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// gosnowflake is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with gosnowflake.  If not, see <http://www.gnu.org/licenses/>.
+
+package registry
+
+import (
+	"encoding/json"
+	"github.com/Terry-Mao/gosnowflake/logger"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+   static registry file, workerId => peers, the first peer is the leader:
+
+   {
+       "0": [{"rpc": ["10.0.0.1:8080"], "thrift": []}],
+       "1": [{"rpc": ["10.0.0.2:8080"], "thrift": []}, {"rpc": ["10.0.0.3:8080"]}]
+   }
+*/
+
+const (
+	staticWatchInterval = 3 * time.Second // static file modify check interval
+)
+
+// Static is a registry read from a json file, used by small deployments
+// without a coordination service. High-water timestamps are only kept in the
+// process memory.
+type Static struct {
+	file      string
+	mutex     sync.Mutex
+	highWater map[int64]int64
+	stop      chan bool
+}
+
+// NewStatic new a static registry, the file must be a valid registry file.
+func NewStatic(file string) (*Static, error) {
+	s := &Static{
+		file:      file,
+		highWater: map[int64]int64{},
+		stop:      make(chan bool),
+	}
+	if _, err := s.Peers(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Register check the workerId is listed in the static file.
+func (s *Static) Register(workerId int64, peer *Peer) error {
+	peers, err := s.Peers()
+	if err != nil {
+		return err
+	}
+	if len(peers[workerId]) == 0 {
+		log.Error("worker not in static registry", logger.F("worker_id", workerId), logger.F("file", s.file))
+		return ErrNotRegistered
+	}
+	return nil
+}
+
+// Deregister do nothing, the static file is not changed by processes.
+func (s *Static) Deregister(workerId int64) error {
+	return nil
+}
+
+// State get the session state, the static file has no session.
+func (s *Static) State() string {
+	select {
+	case <-s.stop:
+		return StateClosed
+	default:
+		return StateOpen
+	}
+}
+
+// Role is not supported, the static file doesn't know which peer is the
+// process.
+func (s *Static) Role(workerId int64) (string, error) {
+	return "", ErrNotSupported
+}
+
+// Peers read all workers' peers from the static file.
+func (s *Static) Peers() (map[int64][]*Peer, error) {
+	d, err := ioutil.ReadFile(s.file)
+	if err != nil {
+		log.Error("ioutil.ReadFile() error", logger.F("file", s.file), logger.Err(err))
+		return nil, err
+	}
+	workers := map[string][]*Peer{}
+	if err = json.Unmarshal(d, &workers); err != nil {
+		log.Error("json.Unmarshal() error", logger.F("data", string(d)), logger.Err(err))
+		return nil, err
+	}
+	res := make(map[int64][]*Peer, len(workers))
+	for worker, peers := range workers {
+		id, err := strconv.ParseInt(worker, 10, 64)
+		if err != nil {
+			log.Error("strconv.ParseInt() error", logger.F("worker", worker), logger.Err(err))
+			return nil, err
+		}
+		res[id] = peers
+	}
+	return res, nil
+}
+
+// WatchWorker get the first listed peer as the leader, the event fires when
+// the static file is modified.
+func (s *Static) WatchWorker(workerId int64) (*Node, <-chan struct{}, error) {
+	fi, err := os.Stat(s.file)
+	if err != nil {
+		log.Error("os.Stat() error", logger.F("file", s.file), logger.Err(err))
+		return nil, nil, err
+	}
+	peers, err := s.Peers()
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(peers[workerId]) == 0 {
+		return nil, nil, ErrNoNode
+	}
+	event := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-s.stop:
+				return
+			case <-time.After(staticWatchInterval):
+			}
+			if nfi, err := os.Stat(s.file); err == nil && !nfi.ModTime().Equal(fi.ModTime()) {
+				close(event)
+				return
+			}
+		}
+	}()
+	leader := peers[workerId][0]
+	return &Node{Name: strings.Join(leader.RPC, ","), Peer: leader}, event, nil
+}
+
+// ClaimDatacenter always succeeds, the static file belongs to one cluster.
+func (s *Static) ClaimDatacenter(cluster string) error {
+	return nil
+}
+
+// Claim is not supported, the static file can't be shared by processes.
+func (s *Static) Claim(workerId int64) error {
+	return ErrNotSupported
+}
+
+// HighWater get the timestamp set by this process.
+func (s *Static) HighWater(workerId int64) (int64, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.highWater[workerId], nil
+}
+
+// SetHighWater keep the timestamp in the process memory.
+func (s *Static) SetHighWater(workerId int64, timestamp int64) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.highWater[workerId] = timestamp
+	return nil
+}
+
+// Close stop all the file watchers.
+func (s *Static) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	select {
+	case <-s.stop:
+	default:
+		close(s.stop)
+	}
+	return nil
+}
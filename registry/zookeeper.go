@@ -0,0 +1,469 @@
+// Copyright © 2014 Terry Mao All rights reserved.
+// This file is part of gosnowflake.
+
+// gosnowflake is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// gosnowflake is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with gosnowflake.  If not, see <http://www.gnu.org/licenses/>.
+
+package registry
+
+import (
+	"encoding/json"
+	"github.com/Terry-Mao/gosnowflake/logger"
+	"github.com/samuel/go-zookeeper/zk"
+	"path"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+   zookeeper
+   ============
+   /gosnowflake-servers/
+   .../datacenterId/ # data: the cluster owns the datacenter
+       .../workerId/ # data: high-water timestamp
+       .../1/ # watcher
+            .../ephemeral|sequence
+            .../1 # leader
+            .../2 # standby
+       .../2/
+            .../1 # leader
+       .../3/
+            .../1 # leader
+       .../claims/
+            .../4 # ephemeral, auto allocated workerId
+
+    1. peers: get all worker path's children, such as /gosnowflake-servers/0/1/1.
+    2. Register: register current process as a standby or leader, this will
+       cause all watchers receive a node add event then start leader selection.
+    3. when process exit, the zk ephemeral node will disappear, then trigger a
+       node del event to all watchers, start leader selection.
+    4. legacy: before the datacenter layout the workers were registered right
+       under the root path, such as /gosnowflake-servers/1/1. both layouts
+       can't share a root, the legacy root is only read: the watchers fall
+       back to it if the worker has no node in the datacenter, Register
+       refuses a worker still registered there.
+    5. once the session expired, the ephemeral nodes are gone. the client
+       connects a new session, the claimed worker ids are claimed again with
+       it, then the state turns open, the caller must register the workers
+       again (see StateChanged).
+*/
+
+// Zookeeper is a registry stored in the zookeeper cluster.
+type Zookeeper struct {
+	conn    *zk.Conn
+	path    string
+	legacy  string // the legacy root path, "" if none
+	expired int32  // the session expired, until the claims are taken again
+	closed  int32
+	mutex   sync.Mutex
+	nodes   map[int64]string // workerId => registered node path
+	claims  map[int64]bool   // claimed worker ids
+}
+
+// NewZookeeper connect the zookeeper cluster and create the root path, the
+// root is the datacenter path.
+func NewZookeeper(addrs []string, root string, timeout time.Duration) (*Zookeeper, error) {
+	z, err := connectZookeeper(addrs, root, timeout)
+	if err != nil {
+		return nil, err
+	}
+	// create the root path and its parents
+	for i := 1; i <= len(root); i++ {
+		if i == len(root) || root[i] == '/' {
+			if err = z.create(root[:i], []byte("")); err != nil {
+				z.conn.Close()
+				return nil, err
+			}
+		}
+	}
+	if err = z.create(path.Join(root, claimsNode), []byte("")); err != nil {
+		z.conn.Close()
+		return nil, err
+	}
+	return z, nil
+}
+
+// NewZookeeperWatcher connect the zookeeper cluster only to watch the workers
+// under the root path, nothing is created. the workers which have no node
+// under the root are watched under the legacy root path if it's not "".
+func NewZookeeperWatcher(addrs []string, root, legacy string, timeout time.Duration) (*Zookeeper, error) {
+	z, err := connectZookeeper(addrs, root, timeout)
+	if err != nil {
+		return nil, err
+	}
+	z.legacy = legacy
+	return z, nil
+}
+
+// connectZookeeper connect the zookeeper cluster and report the session
+// events.
+func connectZookeeper(addrs []string, root string, timeout time.Duration) (*Zookeeper, error) {
+	conn, session, err := zk.Connect(addrs, timeout)
+	if err != nil {
+		log.Error("zk.Connect() error", logger.F("addrs", addrs), logger.F("timeout", timeout), logger.Err(err))
+		return nil, err
+	}
+	z := &Zookeeper{conn: conn, path: root, nodes: map[int64]string{}, claims: map[int64]bool{}}
+	go z.watchSession(session)
+	return z, nil
+}
+
+// watchSession report the session state changes as the registry states.
+// once the session expired, the state stays expired until the claimed worker
+// ids are claimed again on a new session.
+func (z *Zookeeper) watchSession(session <-chan zk.Event) {
+	last := ""
+	for event := range session {
+		log.Info("zookeeper get a event", logger.F("state", event.State.String()))
+		state := zkState(event.State)
+		switch {
+		case state == StateExpired:
+			atomic.StoreInt32(&z.expired, 1)
+			log.Error("zookeeper session expired, all workers are dropped")
+		case state == StateOpen && atomic.LoadInt32(&z.expired) == 1:
+			if err := z.reclaim(); err != nil {
+				state = StateExpired
+				break
+			}
+			atomic.StoreInt32(&z.expired, 0)
+			log.Info("zookeeper session renewed")
+		}
+		if state != last {
+			last = state
+			StateChanged(BackendZookeeper, state)
+		}
+	}
+}
+
+// zkState map the zookeeper connection state to the registry session state.
+func zkState(state zk.State) string {
+	switch state {
+	case zk.StateHasSession:
+		return StateOpen
+	case zk.StateExpired:
+		return StateExpired
+	default:
+		return StateConnecting
+	}
+}
+
+// reclaim claim the claimed worker ids again on the new session.
+func (z *Zookeeper) reclaim() error {
+	z.mutex.Lock()
+	claims := make([]int64, 0, len(z.claims))
+	for workerId := range z.claims {
+		claims = append(claims, workerId)
+	}
+	z.mutex.Unlock()
+	for _, workerId := range claims {
+		if err := z.Claim(workerId); err != nil {
+			// a claim taken by another process is never given back
+			log.Error("claim the worker id again error, stay expired", logger.F("worker_id", workerId), logger.Err(err))
+			return err
+		}
+	}
+	return nil
+}
+
+// SetLegacy set the legacy root path, the workers registered there by the
+// services of the legacy layout are refused by Register.
+func (z *Zookeeper) SetLegacy(legacy string) {
+	z.legacy = legacy
+}
+
+// create create a persistent node, ignore if the node exists.
+func (z *Zookeeper) create(nodePath string, data []byte) error {
+	if _, err := z.conn.Create(nodePath, data, 0, zk.WorldACL(zk.PermAll)); err != nil {
+		if err == zk.ErrNodeExists {
+			log.Warn("zk.create() exists", logger.F("path", nodePath))
+		} else {
+			log.Error("zk.create() error", logger.F("path", nodePath), logger.Err(err))
+			return err
+		}
+	}
+	return nil
+}
+
+// workerPath get the worker path.
+func (z *Zookeeper) workerPath(workerId int64) string {
+	return path.Join(z.path, strconv.FormatInt(workerId, 10))
+}
+
+// Register create a ephemeral sequence node under the worker path.
+func (z *Zookeeper) Register(workerId int64, peer *Peer) (err error) {
+	if z.legacy != "" {
+		legacyPath := path.Join(z.legacy, strconv.FormatInt(workerId, 10))
+		nodes, _, err := z.conn.Children(legacyPath)
+		if err != nil && err != zk.ErrNoNode {
+			log.Error("zk.Children() error", logger.F("path", legacyPath), logger.Err(err))
+			return err
+		}
+		if len(nodes) > 0 {
+			log.Error("worker registered in the legacy layout", logger.F("path", legacyPath), logger.F("nodes", nodes))
+			return ErrLegacyWorker
+		}
+	}
+	workerIdPath := z.workerPath(workerId)
+	if err = z.create(workerIdPath, []byte("")); err != nil {
+		return
+	}
+	d, err := json.Marshal(peer)
+	if err != nil {
+		log.Error("json.Marshal() error", logger.Err(err))
+		return
+	}
+	workerIdPath += "/"
+	nodePath, err := z.conn.Create(workerIdPath, d, zk.FlagEphemeral|zk.FlagSequence, zk.WorldACL(zk.PermAll))
+	if err != nil {
+		log.Error("zk.create() error", logger.F("path", workerIdPath), logger.Err(err))
+		return
+	}
+	z.mutex.Lock()
+	z.nodes[workerId] = nodePath
+	z.mutex.Unlock()
+	return
+}
+
+// Deregister delete the ephemeral node created by Register.
+func (z *Zookeeper) Deregister(workerId int64) error {
+	z.mutex.Lock()
+	nodePath, ok := z.nodes[workerId]
+	delete(z.nodes, workerId)
+	z.mutex.Unlock()
+	if !ok {
+		return nil
+	}
+	if err := z.conn.Delete(nodePath, -1); err != nil && err != zk.ErrNoNode {
+		log.Error("zk.Delete() error", logger.F("path", nodePath), logger.Err(err))
+		return err
+	}
+	return nil
+}
+
+// State get the zookeeper session state, expired until the claims are taken
+// again on the new session.
+func (z *Zookeeper) State() string {
+	if atomic.LoadInt32(&z.closed) == 1 {
+		return StateClosed
+	}
+	if atomic.LoadInt32(&z.expired) == 1 {
+		return StateExpired
+	}
+	return zkState(z.conn.State())
+}
+
+// Role get the role of the node registered by the session, the smallest
+// sequence node is the leader.
+func (z *Zookeeper) Role(workerId int64) (string, error) {
+	z.mutex.Lock()
+	nodePath, ok := z.nodes[workerId]
+	z.mutex.Unlock()
+	if !ok {
+		return RoleNone, nil
+	}
+	workerIdPath := z.workerPath(workerId)
+	nodes, _, err := z.conn.Children(workerIdPath)
+	if err != nil {
+		log.Error("zk.Children() error", logger.F("path", workerIdPath), logger.Err(err))
+		return "", err
+	}
+	sort.Strings(nodes)
+	name := path.Base(nodePath)
+	for i, node := range nodes {
+		if node == name {
+			if i == 0 {
+				return RoleLeader, nil
+			}
+			return RoleStandby, nil
+		}
+	}
+	// dropped with an expired session
+	return RoleNone, nil
+}
+
+// Peers get workers all children in zookeeper.
+func (z *Zookeeper) Peers() (map[int64][]*Peer, error) {
+	workers, _, err := z.conn.Children(z.path)
+	if err != nil {
+		log.Error("zk.Children() error", logger.F("path", z.path), logger.Err(err))
+		return nil, err
+	}
+	res := make(map[int64][]*Peer, len(workers))
+	for _, worker := range workers {
+		if worker == claimsNode {
+			continue
+		}
+		id, err := strconv.ParseInt(worker, 10, 64)
+		if err != nil {
+			log.Error("strconv.ParseInt() error", logger.F("worker", worker), logger.Err(err))
+			return nil, err
+		}
+		workerIdPath := path.Join(z.path, worker)
+		// get all worker's nodes
+		nodes, _, err := z.conn.Children(workerIdPath)
+		if err != nil {
+			log.Error("zk.Children() error", logger.F("path", workerIdPath), logger.Err(err))
+			return nil, err
+		}
+		for _, node := range nodes {
+			peer, err := z.peer(path.Join(workerIdPath, node))
+			if err != nil {
+				return nil, err
+			}
+			res[id] = append(res[id], peer)
+		}
+	}
+	return res, nil
+}
+
+// peer get golang rpc & thrift address of the node.
+func (z *Zookeeper) peer(nodePath string) (*Peer, error) {
+	d, _, err := z.conn.Get(nodePath)
+	if err != nil {
+		log.Error("zk.Get() error", logger.F("path", nodePath), logger.Err(err))
+		return nil, err
+	}
+	peer := &Peer{}
+	if err = json.Unmarshal(d, peer); err != nil {
+		log.Error("json.Unmarshal(peer) error", logger.F("data", string(d)), logger.Err(err))
+		return nil, err
+	}
+	return peer, nil
+}
+
+// WatchWorker get the smallest sequence node as the leader and watch the
+// worker's children, the legacy root is watched if the worker has no node.
+func (z *Zookeeper) WatchWorker(workerId int64) (*Node, <-chan struct{}, error) {
+	node, event, err := z.watchWorker(z.workerPath(workerId))
+	if err == ErrNoNode && z.legacy != "" {
+		return z.watchWorker(path.Join(z.legacy, strconv.FormatInt(workerId, 10)))
+	}
+	return node, event, err
+}
+
+// watchWorker watch the children of the worker path.
+func (z *Zookeeper) watchWorker(workerIdPath string) (*Node, <-chan struct{}, error) {
+	nodes, _, watch, err := z.conn.ChildrenW(workerIdPath)
+	if err != nil {
+		if err == zk.ErrNoNode {
+			return nil, nil, ErrNoNode
+		}
+		log.Error("zk.ChildrenW() error", logger.F("path", workerIdPath), logger.Err(err))
+		return nil, nil, err
+	}
+	if len(nodes) == 0 {
+		return nil, nil, ErrNoNode
+	}
+	// leader selection
+	sort.Strings(nodes)
+	peer, err := z.peer(path.Join(workerIdPath, nodes[0]))
+	if err != nil {
+		return nil, nil, err
+	}
+	event := make(chan struct{})
+	go func() {
+		e := <-watch
+		log.Info("zk node changed", logger.F("path", workerIdPath), logger.F("event", e.Type.String()))
+		close(event)
+	}()
+	return &Node{Name: nodes[0], Peer: peer}, event, nil
+}
+
+// ClaimDatacenter set the cluster as the datacenter path data if it's empty.
+func (z *Zookeeper) ClaimDatacenter(cluster string) error {
+	for {
+		d, stat, err := z.conn.Get(z.path)
+		if err != nil {
+			log.Error("zk.Get() error", logger.F("path", z.path), logger.Err(err))
+			return err
+		}
+		if len(d) > 0 {
+			if string(d) != cluster {
+				log.Error("datacenter owned by another cluster", logger.F("path", z.path), logger.F("owner", string(d)), logger.F("cluster", cluster))
+				return ErrDatacenter
+			}
+			return nil
+		}
+		if _, err = z.conn.Set(z.path, []byte(cluster), stat.Version); err != nil {
+			if err == zk.ErrBadVersion {
+				// another cluster set it, check again
+				continue
+			}
+			log.Error("zk.Set() error", logger.F("path", z.path), logger.F("cluster", cluster), logger.Err(err))
+			return err
+		}
+		return nil
+	}
+}
+
+// Claim create a ephemeral node under the claims path.
+func (z *Zookeeper) Claim(workerId int64) error {
+	claimPath := path.Join(z.path, claimsNode, strconv.FormatInt(workerId, 10))
+	if _, err := z.conn.Create(claimPath, []byte(""), zk.FlagEphemeral, zk.WorldACL(zk.PermAll)); err != nil {
+		if err == zk.ErrNodeExists {
+			return ErrClaimed
+		}
+		log.Error("zk.create() error", logger.F("path", claimPath), logger.Err(err))
+		return err
+	}
+	z.mutex.Lock()
+	z.claims[workerId] = true
+	z.mutex.Unlock()
+	return nil
+}
+
+// HighWater get the timestamp stored in the worker path.
+func (z *Zookeeper) HighWater(workerId int64) (int64, error) {
+	workerIdPath := z.workerPath(workerId)
+	d, _, err := z.conn.Get(workerIdPath)
+	if err != nil {
+		if err == zk.ErrNoNode {
+			return 0, nil
+		}
+		log.Error("zk.Get() error", logger.F("path", workerIdPath), logger.Err(err))
+		return 0, err
+	}
+	if len(d) == 0 {
+		return 0, nil
+	}
+	timestamp, err := strconv.ParseInt(string(d), 10, 64)
+	if err != nil {
+		log.Error("strconv.ParseInt() error", logger.F("data", string(d)), logger.Err(err))
+		return 0, err
+	}
+	return timestamp, nil
+}
+
+// SetHighWater store the timestamp in the worker path.
+func (z *Zookeeper) SetHighWater(workerId int64, timestamp int64) error {
+	workerIdPath := z.workerPath(workerId)
+	d := []byte(strconv.FormatInt(timestamp, 10))
+	if _, err := z.conn.Set(workerIdPath, d, -1); err != nil {
+		if err != zk.ErrNoNode {
+			log.Error("zk.Set() error", logger.F("path", workerIdPath), logger.F("data", string(d)), logger.Err(err))
+			return err
+		}
+		return z.create(workerIdPath, d)
+	}
+	return nil
+}
+
+// Close close the zookeeper connection.
+func (z *Zookeeper) Close() error {
+	atomic.StoreInt32(&z.closed, 1)
+	z.conn.Close()
+	return nil
+}
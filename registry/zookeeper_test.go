@@ -0,0 +1,81 @@
+// Copyright © 2014 Terry Mao All rights reserved.
+// This file is part of gosnowflake.
+
+// gosnowflake is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// gosnowflake is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with gosnowflake.  If not, see <http://www.gnu.org/licenses/>.
+
+package registry
+
+import (
+	"github.com/samuel/go-zookeeper/zk"
+	"testing"
+	"time"
+)
+
+func TestZookeeperSession(t *testing.T) {
+	stateChanged := StateChanged
+	defer func() { StateChanged = stateChanged }()
+	states := []string{}
+	StateChanged = func(backend, state string) {
+		if backend != BackendZookeeper {
+			t.Fatalf("backend: %s, expected %s", backend, BackendZookeeper)
+		}
+		states = append(states, state)
+	}
+	z := &Zookeeper{nodes: map[int64]string{}, claims: map[int64]bool{}}
+	// connect, expire, then connect a new session
+	session := make(chan zk.Event, 8)
+	for _, state := range []zk.State{zk.StateConnecting, zk.StateConnected, zk.StateHasSession, zk.StateDisconnected, zk.StateExpired, zk.StateConnecting, zk.StateConnected, zk.StateHasSession} {
+		session <- zk.Event{Type: zk.EventSession, State: state}
+	}
+	close(session)
+	z.watchSession(session)
+	expected := []string{StateConnecting, StateOpen, StateConnecting, StateExpired, StateConnecting, StateOpen}
+	if len(states) != len(expected) {
+		t.Fatalf("states: %v, expected %v", states, expected)
+	}
+	for i := range expected {
+		if states[i] != expected[i] {
+			t.Fatalf("states: %v, expected %v", states, expected)
+		}
+	}
+	if z.expired != 0 {
+		t.Fatal("session still expired after renewed")
+	}
+}
+
+func TestZookeeperState(t *testing.T) {
+	for state, expected := range map[zk.State]string{
+		zk.StateHasSession:   StateOpen,
+		zk.StateExpired:      StateExpired,
+		zk.StateConnected:    StateConnecting,
+		zk.StateConnecting:   StateConnecting,
+		zk.StateDisconnected: StateConnecting,
+	} {
+		if s := zkState(state); s != expected {
+			t.Fatalf("zkState(%s) = %s, expected %s", state, s, expected)
+		}
+	}
+	// no zookeeper listens, the session is never open
+	z, err := NewZookeeperWatcher([]string{"127.0.0.1:1"}, "/gosnowflake-test", "", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := z.State(); s != StateConnecting {
+		t.Fatalf("State() = %s, expected %s", s, StateConnecting)
+	}
+	z.Close()
+	if s := z.State(); s != StateClosed {
+		t.Fatalf("State() after closed = %s, expected %s", s, StateClosed)
+	}
+}
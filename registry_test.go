@@ -0,0 +1,101 @@
+// Copyright © 2014 Terry Mao All rights reserved.
+// This file is part of gosnowflake.
+
+// gosnowflake is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// gosnowflake is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with gosnowflake.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"github.com/Terry-Mao/gosnowflake/registry"
+	"testing"
+)
+
+func TestGuardRegistryState(t *testing.T) {
+	SetConf(&Config{Registry: registry.BackendMemory, WorkerId: []int64{0}, Twepoch: twepoch})
+	reg = registry.NewMemoryStore().Session()
+	defer reg.Close()
+	workers, err := NewWorkers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	clockGuard = NewClockGuard()
+	defer func() { clockGuard = NewClockGuard() }()
+	clockGuard.SetWorkers(workers)
+	stateChanged := registry.StateChanged
+	defer func() { registry.StateChanged = stateChanged }()
+	guardRegistryState()
+	// the expired session dropped the workers, stop serving
+	registry.StateChanged(registry.BackendEtcd, registry.StateExpired)
+	if err = clockGuard.Err(); err != registry.ErrSessionExpired {
+		t.Fatalf("clock guard error(%v), expected %v", err, registry.ErrSessionExpired)
+	}
+	if role, _ := reg.Role(0); role != registry.RoleNone {
+		t.Fatalf("role of the expired session: %s, expected %s", role, registry.RoleNone)
+	}
+	// the renewed session registers the workers again
+	registry.StateChanged(registry.BackendEtcd, registry.StateOpen)
+	if err = clockGuard.Err(); err != nil {
+		t.Fatalf("clock guard error(%v) after renewed", err)
+	}
+	if role, _ := reg.Role(0); role != registry.RoleLeader {
+		t.Fatalf("role of the renewed session: %s, expected %s", role, registry.RoleLeader)
+	}
+}
+
+func TestGetPeers(t *testing.T) {
+	conf, oldReg := Conf(), reg
+	defer func() {
+		SetConf(conf)
+		reg = oldReg
+	}()
+	SetConf(&Config{RPCBind: []string{"127.0.0.1:0"}, Twepoch: twepoch})
+	store := registry.NewMemoryStore()
+	reg = store.Session()
+	defer reg.Close()
+	// a future schema peer can't be talked to, but holds the worker
+	future := localPeer()
+	future.Version = registry.PeerVersion + 1
+	if err := store.Session().Register(1, future); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Session().Register(2, localPeer()); err != nil {
+		t.Fatal(err)
+	}
+	peers, err := getPeers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if workers, ok := peers[1]; !ok || len(workers) != 0 {
+		t.Fatalf("peers of worker 1: %d, registered: %t, expected 0 and registered", len(workers), ok)
+	}
+	if len(peers[2]) != 1 {
+		t.Fatalf("peers of worker 2: %d, expected 1", len(peers[2]))
+	}
+	ids, err := ClaimWorkerIds(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 2 || ids[0] != 0 || ids[1] != 3 {
+		t.Fatalf("claimed workerIds: %v, expected [0 3]", ids)
+	}
+	// a peer of another epoch issues colliding ids
+	misconfigured := localPeer()
+	misconfigured.Epoch++
+	if err = store.Session().Register(4, misconfigured); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = getPeers(); err == nil {
+		t.Fatal("getPeers() expected misconfigured peer error")
+	}
+}
@@ -0,0 +1,245 @@
+// Copyright © 2014 Terry Mao All rights reserved.
+// This file is part of gosnowflake.
+
+// gosnowflake is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// gosnowflake is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with gosnowflake.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	log "github.com/alecthomas/log4go"
+	"fmt"
+	"github.com/Terry-Mao/gosnowflake/logger"
+	"os"
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
+)
+
+/*
+   SIGHUP reload
+   ============
+   1. parse the config file again, if it's invalid, keep the old config.
+   2. reject the changes can't be applied safely: the datacenter, the start
+      (epoch), the cluster, the registry and the derived or auto workers, the
+      bit layout is compiled in and never changes.
+   3. the pid, dir, user, group, log format and level, admin bind, stat.bind,
+      pprof.bind, audit and trace changes need a restart, they are kept with a
+      warning.
+   4. apply: open the new rpc binds, reload the log configuration, add and
+      register the new workers, deregister and remove the dropped workers,
+      close the dropped rpc binds, restart the changed clock monitors.
+*/
+
+// ReloadConfig reload the config file and apply the changes live.
+func ReloadConfig(workers *Workers) error {
+	gc, err := goConf.Reload()
+	if err != nil {
+		Logger.Error("goConf.Reload() error, keep the old config", logger.Err(err))
+		return err
+	}
+	c, err := loadConfig(gc)
+	if err != nil {
+		Logger.Error("loadConfig() error, keep the old config", logger.Err(err))
+		return err
+	}
+	if _, err = os.Stat(c.Log); err != nil && Conf().LogFormat == logFormatLog4go {
+		Logger.Error("log config error, keep the old config", logger.F("file", c.Log), logger.Err(err))
+		return err
+	}
+	old := Conf()
+	if err = checkReload(old, c); err != nil {
+		Logger.Error("reload rejected, keep the old config", logger.Err(err))
+		return err
+	}
+	// open the new rpc binds first, nothing changed if any fails
+	added, removed := diffStrings(old.RPCBind, c.RPCBind)
+	for i, bind := range added {
+		Logger.Info("start listen rpc addr", logger.F("addr", bind))
+		if err = rpcServer.Listen(bind); err != nil {
+			for _, opened := range added[:i] {
+				rpcServer.Unlisten(opened)
+			}
+			Logger.Error("reload rejected, rpc.bind error, keep the old config", logger.F("addr", bind), logger.Err(err))
+			return err
+		}
+	}
+	goConf = gc
+	SetConf(c)
+	if c.LogFormat == logFormatLog4go {
+		log.LoadConfiguration(c.Log)
+	}
+	Logger.Info("gosnowflake config reloaded", logger.F("version", Version), logger.F("datacenter_id", c.DatacenterId))
+	if c.MaxProc != old.MaxProc {
+		runtime.GOMAXPROCS(c.MaxProc)
+	}
+	if c.MaxBorrow != old.MaxBorrow {
+		workers.SetMaxBorrow(c.MaxBorrow)
+	}
+	reloadWorkers(old, c, workers)
+	for _, bind := range removed {
+		Logger.Info("stop listen rpc addr", logger.F("addr", bind))
+		rpcServer.Unlisten(bind)
+	}
+	reloadClock(old, c)
+	return nil
+}
+
+// checkReload check the changes can be applied, keep the changes need a
+// restart.
+func checkReload(old, c *Config) error {
+	rejected := []string{}
+	for name, changed := range map[string]bool{
+		"snowflake:datacenter":     c.DatacenterId != old.DatacenterId,
+		"snowflake:start":          c.Twepoch != old.Twepoch,
+		"snowflake:cluster":        c.Cluster != old.Cluster,
+		"snowflake:worker(auto)":   c.AutoWorker != old.AutoWorker,
+		"snowflake:worker(derive)": !reflect.DeepEqual(c.DeriveWorker, old.DeriveWorker),
+		"registry":                 c.Registry != old.Registry || c.StaticFile != old.StaticFile,
+		"zookeeper":                !reflect.DeepEqual(c.ZKAddr, old.ZKAddr) || c.ZKTimeout != old.ZKTimeout || c.ZKPath != old.ZKPath || c.ZKLegacy != old.ZKLegacy,
+		"etcd":                     !reflect.DeepEqual(c.EtcdAddr, old.EtcdAddr) || c.EtcdTimeout != old.EtcdTimeout || c.EtcdPath != old.EtcdPath,
+	} {
+		if changed {
+			rejected = append(rejected, name)
+		}
+	}
+	if len(rejected) > 0 {
+		sort.Strings(rejected)
+		return fmt.Errorf("%s can't be changed without a restart", strings.Join(rejected, ", "))
+	}
+	if c.PidFile != old.PidFile {
+		Logger.Warn("base:pid change needs a restart", logger.F("keep", old.PidFile))
+		c.PidFile = old.PidFile
+	}
+	if c.Dir != old.Dir {
+		Logger.Warn("base:dir change needs a restart", logger.F("keep", old.Dir))
+		c.Dir = old.Dir
+	}
+	if c.User != old.User || c.Group != old.Group {
+		Logger.Warn("base:user and base:group change needs a restart", logger.F("keep_user", old.User), logger.F("keep_group", old.Group))
+		c.User, c.Group = old.User, old.Group
+	}
+	if c.LogFormat != old.LogFormat || c.LogLevel != old.LogLevel {
+		Logger.Warn("base:log.format and base:log.level change needs a restart", logger.F("keep_format", old.LogFormat), logger.F("keep_level", old.LogLevel))
+		c.LogFormat, c.LogLevel = old.LogFormat, old.LogLevel
+	}
+	if !reflect.DeepEqual(c.AdminBind, old.AdminBind) {
+		Logger.Warn("admin:bind change needs a restart", logger.F("keep", old.AdminBind))
+		c.AdminBind = old.AdminBind
+	}
+	if !reflect.DeepEqual(c.StatBind, old.StatBind) {
+		Logger.Warn("base:stat.bind change needs a restart", logger.F("keep", old.StatBind))
+		c.StatBind = old.StatBind
+	}
+	if !reflect.DeepEqual(c.PprofBind, old.PprofBind) {
+		Logger.Warn("base:pprof.bind change needs a restart", logger.F("keep", old.PprofBind))
+		c.PprofBind = old.PprofBind
+	}
+	if c.AuditFile != old.AuditFile || c.AuditSize != old.AuditSize || c.AuditKeep != old.AuditKeep || c.AuditBuffer != old.AuditBuffer || c.AuditFlush != old.AuditFlush || c.AuditWait != old.AuditWait || c.AuditDrop != old.AuditDrop {
+		Logger.Warn("audit change needs a restart", logger.F("keep", old.AuditFile))
+		c.AuditFile, c.AuditSize, c.AuditKeep, c.AuditBuffer, c.AuditFlush = old.AuditFile, old.AuditSize, old.AuditKeep, old.AuditBuffer, old.AuditFlush
+		c.AuditWait, c.AuditDrop = old.AuditWait, old.AuditDrop
+	}
+	if c.TraceExport != old.TraceExport || c.TraceAddr != old.TraceAddr || c.TraceTLS != old.TraceTLS {
+		Logger.Warn("trace change needs a restart", logger.F("keep", old.TraceExport))
+		c.TraceExport, c.TraceAddr, c.TraceTLS = old.TraceExport, old.TraceAddr, old.TraceTLS
+	}
+	return nil
+}
+
+// reloadWorkers add the new static workers and remove the dropped ones, the
+// kept workers are registered again if the registered addresses changed.
+func reloadWorkers(old, c *Config, workers *Workers) {
+	// the clock guard registers the workers once the clock recovers
+	if clockGuard.Err() == nil && (!reflect.DeepEqual(c.RPCBind, old.RPCBind) || !reflect.DeepEqual(c.ThriftBind, old.ThriftBind)) {
+		for _, workerId := range workers.WorkerIds() {
+			if err := reg.Deregister(workerId); err != nil {
+				Logger.Error("reg.Deregister() error", logger.F("worker_id", workerId), logger.Err(err))
+			}
+			if err := RegWorkerId(workerId); err != nil {
+				Logger.Error("RegWorkerId() error", logger.F("worker_id", workerId), logger.Err(err))
+			}
+		}
+	}
+	added, removed := diffInt64s(old.WorkerId, c.WorkerId)
+	for _, workerId := range removed {
+		Logger.Info("remove the worker id", logger.F("worker_id", workerId))
+		if err := workers.Remove(workerId); err != nil {
+			Logger.Error("workers.Remove() error", logger.F("worker_id", workerId), logger.Err(err))
+		}
+	}
+	for _, workerId := range added {
+		Logger.Info("add the worker id", logger.F("worker_id", workerId))
+		if err := workers.Add(workerId); err != nil {
+			Logger.Error("workers.Add() error", logger.F("worker_id", workerId), logger.Err(err))
+		}
+	}
+}
+
+// reloadClock restart the clock monitors whose config changed, the old
+// monitor returned before its fault is cleared and the new one starts.
+func reloadClock(old, c *Config) {
+	if c.SkewInterval != old.SkewInterval || c.MaxSkew != old.MaxSkew || c.SkewTimeout != old.SkewTimeout {
+		setSkewMonitor(nil)
+		clockGuard.Fault(clockCheckPeers, nil)
+		InitSkewMonitor()
+	}
+	if !reflect.DeepEqual(c.NTPServers, old.NTPServers) || c.NTPInterval != old.NTPInterval || c.NTPMaxOffset != old.NTPMaxOffset || c.NTPTimeout != old.NTPTimeout {
+		setNTPMonitor(nil)
+		clockGuard.Fault(clockCheckNTP, nil)
+		if err := InitNTP(); err != nil {
+			Logger.Error("InitNTP() error", logger.Err(err))
+		}
+	}
+}
+
+// diffStrings get the added and removed strings from old to new.
+func diffStrings(old, new []string) (added, removed []string) {
+	in := map[string]bool{}
+	for _, s := range old {
+		in[s] = true
+	}
+	for _, s := range new {
+		if !in[s] {
+			added = append(added, s)
+		}
+		delete(in, s)
+	}
+	for _, s := range old {
+		if in[s] {
+			removed = append(removed, s)
+		}
+	}
+	return
+}
+
+// diffInt64s get the added and removed ids from old to new.
+func diffInt64s(old, new []int64) (added, removed []int64) {
+	in := map[int64]bool{}
+	for _, i := range old {
+		in[i] = true
+	}
+	for _, i := range new {
+		if !in[i] {
+			added = append(added, i)
+		}
+		delete(in, i)
+	}
+	for _, i := range old {
+		if in[i] {
+			removed = append(removed, i)
+		}
+	}
+	return
+}
@@ -0,0 +1,182 @@
+// Copyright © 2014 Terry Mao All rights reserved.
+// This file is part of gosnowflake.
+
+// gosnowflake is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// gosnowflake is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with gosnowflake.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"github.com/Terry-Mao/goconf"
+	"github.com/Terry-Mao/gosnowflake/registry"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// writeConf write the config file with the rpc bind, datacenter and worker.
+func writeConf(t *testing.T, file, logFile, bind string, datacenter int, worker string) {
+	conf := fmt.Sprintf("[base]\nlog %s\nrpc.bind %s\n[registry]\nbackend memory\n[snowflake]\ndatacenter %d\nworker %s\n", logFile, bind, datacenter, worker)
+	if err := ioutil.WriteFile(file, []byte(conf), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// freeAddr get a free local tcp address.
+func freeAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+func TestReloadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gosnowflake")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	logFile := filepath.Join(dir, "log.xml")
+	if err = ioutil.WriteFile(logFile, []byte("<logging></logging>"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(dir, "gosnowflake.conf")
+	bind := freeAddr(t)
+	writeConf(t, file, logFile, bind, 0, "0")
+	goConf = goconf.New()
+	if err = goConf.Parse(file); err != nil {
+		t.Fatal(err)
+	}
+	c, err := loadConfig(goConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetConf(c)
+	reg = registry.NewMemoryStore().Session()
+	defer reg.Close()
+	workers, err := NewWorkers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rpcServer = NewRPCServer()
+	defer rpcServer.Close(0)
+	if err = rpcServer.Listen(bind); err != nil {
+		t.Fatal(err)
+	}
+	// invalid file keeps the old config
+	old := Conf()
+	writeConf(t, file, logFile, bind, 0, "foo")
+	if err = ReloadConfig(workers); err == nil || Conf() != old {
+		t.Fatal("ReloadConfig() expected invalid worker error")
+	}
+	// datacenter can't be changed
+	writeConf(t, file, logFile, bind, 1, "0")
+	if err = ReloadConfig(workers); err == nil || Conf() != old {
+		t.Fatal("ReloadConfig() expected datacenter change rejected")
+	}
+	// move the rpc bind, replace worker 0 by 1 and 2
+	newBind := freeAddr(t)
+	writeConf(t, file, logFile, newBind, 0, "1,2")
+	// the config is read by the rpc calls meanwhile
+	stop := make(chan bool)
+	read := make(chan bool)
+	go func() {
+		defer close(read)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				localPeer()
+			}
+		}
+	}()
+	err = ReloadConfig(workers)
+	close(stop)
+	<-read
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids := workers.WorkerIds(); !reflect.DeepEqual(ids, []int64{1, 2}) {
+		t.Fatalf("workerIds: %v, expected [1 2]", ids)
+	}
+	peers, err := reg.Peers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(peers[0]) != 0 || len(peers[1]) != 1 || len(peers[2]) != 1 {
+		t.Fatalf("peers: %v, expected workerId 1 and 2 registered", peers)
+	}
+	if peers[1][0].RPC[0] != newBind {
+		t.Fatalf("registered rpc: %v, expected %s", peers[1][0].RPC, newBind)
+	}
+	if addrs := rpcServer.Addrs(); !reflect.DeepEqual(addrs, []string{newBind}) {
+		t.Fatalf("rpc listen: %v, expected [%s]", addrs, newBind)
+	}
+}
+
+func TestReloadClock(t *testing.T) {
+	conf, oldReg := Conf(), reg
+	defer func() {
+		SetConf(conf)
+		reg = oldReg
+	}()
+	reg = registry.NewMemoryStore().Session()
+	defer reg.Close()
+	clockGuard = NewClockGuard()
+	defer func() { clockGuard = NewClockGuard() }()
+	old := &Config{SkewInterval: time.Millisecond, MaxSkew: time.Second, SkewTimeout: time.Second, Twepoch: twepoch}
+	SetConf(old)
+	InitSkewMonitor()
+	defer setSkewMonitor(nil)
+	// the monitor is read by the health checks meanwhile
+	stop := make(chan bool)
+	read := make(chan bool)
+	go func() {
+		defer close(read)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				getSkewMonitor().Healthy()
+			}
+		}
+	}()
+	for i := 0; i < 10; i++ {
+		c := *old
+		c.SkewInterval += time.Millisecond
+		SetConf(&c)
+		prev := getSkewMonitor()
+		reloadClock(old, &c)
+		// the replaced monitor returned before the new one started
+		select {
+		case <-prev.stop:
+		default:
+			t.Fatal("replaced skew monitor not stopped")
+		}
+		if getSkewMonitor() == prev {
+			t.Fatal("skew monitor not replaced")
+		}
+		old = &c
+	}
+	close(stop)
+	<-read
+}
@@ -17,82 +17,396 @@
 package main
 
 import (
-	log "github.com/alecthomas/log4go"
+	"bufio"
+	"context"
+	"encoding/gob"
 	"errors"
+	"github.com/Terry-Mao/gosnowflake/logger"
+	"github.com/Terry-Mao/gosnowflake/registry"
 	myrpc "github.com/Terry-Mao/gosnowflake/rpc"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"io"
 	"net"
 	"net/rpc"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+const (
+	rpcAcceptDelay   = 5 * time.Millisecond
+	rpcDrainInterval = 10 * time.Millisecond
+	// not registered, so net/rpc discards the refused request
+	rpcRefusedMethod = "RPCServer.Closed"
+)
+
+var (
+	ErrRPCClosed = errors.New("rpc server closed, refusing new requests")
+	// global rpc server
+	rpcServer *RPCServer
+)
+
 type SnowflakeRPC struct {
-	workers Workers
+	workers *Workers
 }
 
-// StartRPC start rpc listen.
-func InitRPC(workers Workers) error {
+// InitRPC register the snowflake rpc and listen all rpc binds.
+func InitRPC(workers *Workers) (err error) {
 	s := &SnowflakeRPC{workers: workers}
 	rpc.Register(s)
-	for _, bind := range MyConf.RPCBind {
-		log.Info("start listen rpc addr: \"%s\"", bind)
-		go rpcListen(bind)
+	rpcServer = NewRPCServer()
+	for _, bind := range Conf().RPCBind {
+		Logger.Info("start listen rpc addr", logger.F("addr", bind))
+		if err = rpcServer.Listen(bind); err != nil {
+			return
+		}
 	}
-	return nil
+	return
+}
+
+// RPCServer serve the golang rpc connections, it tracks the connections and
+// the in-flight calls for draining.
+type RPCServer struct {
+	mutex     sync.Mutex
+	listeners map[string]net.Listener // bind => listener
+	codecs    map[*rpcCodec]bool
+	inflight  int64
+	accepted  int64
+	closed    bool
+}
+
+// NewRPCServer new a rpc server.
+func NewRPCServer() *RPCServer {
+	return &RPCServer{listeners: map[string]net.Listener{}, codecs: map[*rpcCodec]bool{}}
 }
 
-// rpcListen start rpc listen.
-func rpcListen(bind string) {
-	l, err := net.Listen("tcp", bind)
+// Listen listen the bind (or take the inherited listener) and accept
+// connections.
+func (s *RPCServer) Listen(bind string) error {
+	l, err := listen(bind)
 	if err != nil {
-		log.Error("net.Listen(\"tcp\", \"%s\") error(%v)", bind, err)
-		panic(err)
+		Logger.Error("listen() error", logger.F("addr", bind), logger.Err(err))
+		return err
 	}
-	// if process exit, then close the rpc bind
-	defer func() {
-		log.Info("rpc addr: \"%s\" close", bind)
-		if err := l.Close(); err != nil {
-			log.Error("listener.Close() error(%v)", err)
+	s.mutex.Lock()
+	s.listeners[bind] = l
+	s.mutex.Unlock()
+	go s.accept(l)
+	return nil
+}
+
+// Unlisten close the listener of the bind, the accepted connections are
+// kept.
+func (s *RPCServer) Unlisten(bind string) {
+	s.mutex.Lock()
+	_, ok := s.listeners[bind]
+	delete(s.listeners, bind)
+	s.mutex.Unlock()
+	if !ok {
+		return
+	}
+	if err := unlisten(bind); err != nil {
+		Logger.Error("listener.Close() error", logger.Err(err))
+	}
+}
+
+// Addrs get all listening addresses.
+func (s *RPCServer) Addrs() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	addrs := make([]string, 0, len(s.listeners))
+	for _, l := range s.listeners {
+		addrs = append(addrs, l.Addr().String())
+	}
+	return addrs
+}
+
+// accept accept connections until the listener closed.
+func (s *RPCServer) accept(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				Logger.Warn("listener.Accept() error", logger.F("addr", l.Addr().String()), logger.Err(err))
+				time.Sleep(rpcAcceptDelay)
+				continue
+			}
+			Logger.Info("rpc addr close", logger.F("addr", l.Addr().String()))
+			return
 		}
-	}()
-	rpc.Accept(l)
+		atomic.AddInt64(&s.accepted, 1)
+		codec := newRPCCodec(s, conn)
+		s.mutex.Lock()
+		if s.closed {
+			s.mutex.Unlock()
+			conn.Close()
+			continue
+		}
+		s.codecs[codec] = true
+		s.mutex.Unlock()
+		go func() {
+			rpc.ServeCodec(codec)
+			s.mutex.Lock()
+			delete(s.codecs, codec)
+			s.mutex.Unlock()
+		}()
+	}
+}
+
+// Conns get the number of the open connections.
+func (s *RPCServer) Conns() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.codecs)
+}
+
+// Accepted get the number of the accepted connections.
+func (s *RPCServer) Accepted() int64 {
+	return atomic.LoadInt64(&s.accepted)
+}
+
+// Closed report whether the server is closed, the new requests are refused.
+func (s *RPCServer) Closed() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.closed
+}
+
+// Inflight get the number of the in-flight calls.
+func (s *RPCServer) Inflight() int64 {
+	return atomic.LoadInt64(&s.inflight)
+}
+
+// Close stop accepting connections and refuse the new requests of the
+// accepted ones, wait the in-flight calls until the timeout, then close all
+// connections.
+func (s *RPCServer) Close(timeout time.Duration) {
+	s.mutex.Lock()
+	s.closed = true
+	listeners := s.listeners
+	s.listeners = map[string]net.Listener{}
+	s.mutex.Unlock()
+	for bind := range listeners {
+		if err := unlisten(bind); err != nil {
+			Logger.Error("listener.Close() error", logger.Err(err))
+		}
+	}
+	deadline := time.Now().Add(timeout)
+	for s.Inflight() > 0 && time.Now().Before(deadline) {
+		time.Sleep(rpcDrainInterval)
+	}
+	if n := s.Inflight(); n > 0 {
+		Logger.Warn("rpc calls still in-flight, cut off", logger.F("inflight", n), logger.F("timeout", timeout))
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for codec := range s.codecs {
+		codec.Close()
+	}
+}
+
+// rpcCodec is the net/rpc gob server codec counting the in-flight calls.
+type rpcCodec struct {
+	server *RPCServer
+	rwc    io.ReadWriteCloser
+	dec    *gob.Decoder
+	enc    *gob.Encoder
+	encBuf *bufio.Writer
+	once   sync.Once
+	mutex  sync.Mutex
+	start  map[uint64]time.Time // seq => request read time
+	denied map[uint64]string    // seq => service method refused after closed
+	caller string               // the remote address for the audit
+}
+
+// newRPCCodec new a gob server codec of the connection.
+func newRPCCodec(server *RPCServer, conn io.ReadWriteCloser) *rpcCodec {
+	buf := bufio.NewWriter(conn)
+	caller := "-"
+	if c, ok := conn.(net.Conn); ok {
+		caller = c.RemoteAddr().String()
+	}
+	return &rpcCodec{
+		server: server,
+		rwc:    conn,
+		dec:    gob.NewDecoder(conn),
+		enc:    gob.NewEncoder(buf),
+		encBuf: buf,
+		start:  map[uint64]time.Time{},
+		denied: map[uint64]string{},
+		caller: caller,
+	}
+}
+
+func (c *rpcCodec) ReadRequestHeader(r *rpc.Request) error {
+	if err := c.dec.Decode(r); err != nil {
+		return err
+	}
+	// every read request gets a response
+	atomic.AddInt64(&c.server.inflight, 1)
+	closed := c.server.Closed()
+	c.mutex.Lock()
+	c.start[r.Seq] = time.Now()
+	if closed {
+		// the in-flight calls finish, the new ones are answered the error
+		c.denied[r.Seq] = r.ServiceMethod
+		r.ServiceMethod = rpcRefusedMethod
+	}
+	c.mutex.Unlock()
+	return nil
+}
+
+func (c *rpcCodec) ReadRequestBody(body interface{}) error {
+	return c.dec.Decode(body)
+}
+
+func (c *rpcCodec) WriteResponse(r *rpc.Response, body interface{}) (err error) {
+	defer atomic.AddInt64(&c.server.inflight, -1)
+	c.mutex.Lock()
+	start, ok := c.start[r.Seq]
+	delete(c.start, r.Seq)
+	if method, refused := c.denied[r.Seq]; refused {
+		delete(c.denied, r.Seq)
+		r.ServiceMethod, r.Error = method, ErrRPCClosed.Error()
+	}
+	c.mutex.Unlock()
+	if ok {
+		metricRPCDuration.Observe(time.Since(start).Seconds(), r.ServiceMethod)
+	}
+	if r.Error == "" && auditWriter != nil {
+		// the ids are issued even if the response can't be written, the ids
+		// can't be recorded are never handed out
+		if err = auditWriter.Record(issuedIds(r.ServiceMethod, body), c.caller); err != nil {
+			r.Error, body = err.Error(), struct{}{}
+		}
+	}
+	if r.Error != "" {
+		metricRPCErrors.Add(1, r.ServiceMethod)
+	}
+	if err = c.enc.Encode(r); err != nil {
+		if c.encBuf.Flush() == nil {
+			// gob couldn't encode the header, shut down the connection
+			Logger.Error("rpc: gob error encoding response", logger.F("peer", c.caller), logger.Err(err))
+			c.Close()
+		}
+		return
+	}
+	if err = c.enc.Encode(body); err != nil {
+		if c.encBuf.Flush() == nil {
+			// the header has been written, shut down the connection to
+			// signal the problem
+			Logger.Error("rpc: gob error encoding body", logger.F("peer", c.caller), logger.Err(err))
+			c.Close()
+		}
+		return
+	}
+	return c.encBuf.Flush()
+}
+
+// issuedIds get the ids issued by the response body of the method.
+func issuedIds(method string, body interface{}) []int64 {
+	switch ids := body.(type) {
+	case *int64:
+		if method == "SnowflakeRPC.NextId" || method == "SnowflakeRPC.TracedNextId" {
+			return []int64{*ids}
+		}
+	case *[]int64:
+		if method == "SnowflakeRPC.NextIds" {
+			return *ids
+		}
+	}
+	return nil
+}
+
+func (c *rpcCodec) Close() (err error) {
+	c.once.Do(func() {
+		err = c.rwc.Close()
+	})
+	return
 }
 
 // NextId generate a id.
 func (s *SnowflakeRPC) NextId(workerId int64, id *int64) error {
-	worker, err := s.workers.Get(workerId)
+	return s.nextId(context.Background(), workerId, id)
+}
+
+// TracedNextId generate a id in the caller's trace.
+func (s *SnowflakeRPC) TracedNextId(args *myrpc.NextIdArgs, id *int64) (err error) {
+	if args == nil {
+		return errors.New("args is nil")
+	}
+	ctx, span := startSpan(traceContext(args.Trace), "SnowflakeRPC.TracedNextId", trace.SpanKindServer, attribute.Int64("snowflake.worker_id", args.WorkerId))
+	err = s.nextId(ctx, args.WorkerId, id)
+	endSpan(span, err)
+	return
+}
+
+// nextId generate a id, traced as spans of ctx.
+func (s *SnowflakeRPC) nextId(ctx context.Context, workerId int64, id *int64) error {
+	if err := clockGuard.Err(); err != nil {
+		return err
+	}
+	worker, err := s.worker(ctx, workerId)
 	if err != nil {
 		return err
 	}
-	if tid, err := worker.NextId(); err != nil {
-		log.Error("worker.NextId() error(%v)", err)
+	if tid, err := worker.NextIdContext(ctx); err != nil {
+		Logger.Error("worker.NextId() error", logger.F("worker_id", workerId), logger.Err(err))
 		return err
 	} else {
+		metricIssued.Add(1, strconv.FormatInt(workerId, 10), registry.ProtocolRPC)
 		*id = tid
 		return nil
 	}
 }
 
-// NextIds generate specified num ids.
-func (s *SnowflakeRPC) NextIds(args *myrpc.NextIdsArgs, ids *[]int64) error {
+// NextIds generate specified num ids, in the caller's trace if any.
+func (s *SnowflakeRPC) NextIds(args *myrpc.NextIdsArgs, ids *[]int64) (err error) {
 	if args == nil {
 		return errors.New("args is nil")
 	}
-	worker, err := s.workers.Get(args.WorkerId)
+	ctx, span := startSpan(traceContext(args.Trace), "SnowflakeRPC.NextIds", trace.SpanKindServer, attribute.Int64("snowflake.worker_id", args.WorkerId), attribute.Int("snowflake.num", args.Num))
+	defer func() {
+		endSpan(span, err)
+	}()
+	if err = clockGuard.Err(); err != nil {
+		return
+	}
+	worker, err := s.worker(ctx, args.WorkerId)
 	if err != nil {
-		return err
+		return
 	}
-	if tids, err := worker.NextIds(args.Num); err != nil {
-		log.Error("worker.NextIds(%d) error(%v)", args.Num, err)
-		return err
-	} else {
-		*ids = tids
-		return nil
+	metricBatchSize.Observe(float64(args.Num))
+	tids, err := worker.NextIdsContext(ctx, args.Num)
+	if err != nil {
+		Logger.Error("worker.NextIds() error", logger.F("worker_id", args.WorkerId), logger.F("num", args.Num), logger.Err(err))
+		return
 	}
+	metricIssued.Add(float64(len(tids)), strconv.FormatInt(args.WorkerId, 10), registry.ProtocolRPC)
+	*ids = tids
+	return
+}
+
+// worker get the served worker, traced as a span of ctx.
+func (s *SnowflakeRPC) worker(ctx context.Context, workerId int64) (worker *IdWorker, err error) {
+	_, span := startSpan(ctx, spanWorkerLookup, trace.SpanKindInternal, attribute.Int64("snowflake.worker_id", workerId))
+	worker, err = s.workers.Get(workerId)
+	endSpan(span, err)
+	return
+}
+
+// WorkerIds return the service's configured and claimed workerIds.
+func (s *SnowflakeRPC) WorkerIds(ignore int, reply *myrpc.WorkerIdsReply) error {
+	reply.Static = Conf().WorkerId
+	reply.Claimed = MyStat.ClaimedWorkerIds()
+	return nil
 }
 
 // DatacenterId return the services's datacenterId.
 func (s *SnowflakeRPC) DatacenterId(ignore int, dataCenterId *int64) error {
-	*dataCenterId = MyConf.DatacenterId
+	*dataCenterId = Conf().DatacenterId
 	return nil
 }
 
@@ -102,8 +416,49 @@ func (s *SnowflakeRPC) Timestamp(ignore int, timestamp *int64) error {
 	return nil
 }
 
-// Ping return the service status.
+// MilliTimestamp return the service current unix milliseconds.
+func (s *SnowflakeRPC) MilliTimestamp(ignore int, timestamp *int64) error {
+	*timestamp = timeGen()
+	return nil
+}
+
+// Info return the service's id issuing: the bit layout, epoch, served workers
+// with their registry roles, clock, build and protocols.
+func (s *SnowflakeRPC) Info(ignore int, reply *myrpc.InfoReply) error {
+	peer := localPeer()
+	reply.Build = peer.Build
+	reply.DatacenterId = peer.Datacenter
+	reply.Layout = peer.Layout
+	reply.Epoch = peer.Epoch
+	reply.Protocols = peer.Protocols
+	reply.Workers = []*myrpc.WorkerInfo{}
+	for _, workerId := range s.workers.WorkerIds() {
+		info := &myrpc.WorkerInfo{WorkerId: workerId}
+		if reg != nil {
+			if role, err := reg.Role(workerId); err == nil {
+				info.Role = role
+			} else if err != registry.ErrNotSupported {
+				Logger.Error("reg.Role() error", logger.F("worker_id", workerId), logger.Err(err))
+			}
+		}
+		reply.Workers = append(reply.Workers, info)
+	}
+	reply.Timestamp = timeGen()
+	return nil
+}
+
+// Ping return the service status, myrpc.PingOK if ready, see Health.
 func (s *SnowflakeRPC) Ping(ignore int, status *int) error {
-	*status = 0
+	if healthCache.Get(s.workers).Ready {
+		*status = myrpc.PingOK
+	} else {
+		*status = myrpc.PingNotReady
+	}
+	return nil
+}
+
+// Health return the service health checks.
+func (s *SnowflakeRPC) Health(ignore int, reply *myrpc.HealthReply) error {
+	*reply = *healthCache.Get(s.workers)
 	return nil
 }
@@ -1,6 +1,61 @@
 package rpc
 
+import (
+	"github.com/Terry-Mao/gosnowflake/registry"
+)
+
+type NextIdArgs struct {
+	WorkerId int64             // snowflake worker id
+	Trace    map[string]string // w3c trace context of the caller, optional
+}
+
 type NextIdsArgs struct {
-	WorkerId int64 // snowflake worker id
-	Num      int   // batch next id number
+	WorkerId int64             // snowflake worker id
+	Num      int               // batch next id number
+	Trace    map[string]string // w3c trace context of the caller, optional
+}
+
+type WorkerIdsReply struct {
+	Static  []int64 // configured snowflake worker ids
+	Claimed []int64 // auto claimed snowflake worker ids
+}
+
+// ping status
+const (
+	PingOK       = 0
+	PingNotReady = 1
+)
+
+// health check status
+const (
+	HealthOK   = "ok"
+	HealthWarn = "warn" // degraded, still ready
+	HealthFail = "fail" // not ready
+)
+
+type HealthCheck struct {
+	Name   string `json:"name"`   // "rpc", "registry", "worker.<id>", "clock" or "epoch"
+	Status string `json:"status"` // HealthOK, HealthWarn or HealthFail
+	Detail string `json:"detail,omitempty"`
+}
+
+type HealthReply struct {
+	Live   bool           `json:"live"`  // serving the rpc
+	Ready  bool           `json:"ready"` // live and no check failed
+	Checks []*HealthCheck `json:"checks"`
+}
+
+type WorkerInfo struct {
+	WorkerId int64
+	Role     string // registry.RoleLeader, RoleStandby, RoleNone or empty if unknown
+}
+
+type InfoReply struct {
+	Build        string          // gosnowflake version
+	DatacenterId int64           // snowflake datacenter id
+	Layout       registry.Layout // snowflake id bit layout
+	Epoch        int64           // twepoch unix milliseconds
+	Timestamp    int64           // service current unix milliseconds
+	Workers      []*WorkerInfo   // served worker ids in order
+	Protocols    []string        // served protocols, see registry.ProtocolRPC
 }
@@ -0,0 +1,124 @@
+// Copyright © 2014 Terry Mao All rights reserved.
+// This file is part of gosnowflake.
+
+// gosnowflake is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// gosnowflake is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with gosnowflake.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"github.com/Terry-Mao/gosnowflake/registry"
+	myrpc "github.com/Terry-Mao/gosnowflake/rpc"
+	"net/rpc"
+	"testing"
+	"time"
+)
+
+// SlowRPC answers after sleeping the milliseconds.
+type SlowRPC struct{}
+
+func (s *SlowRPC) Sleep(ms int64, reply *int64) error {
+	time.Sleep(time.Duration(ms) * time.Millisecond)
+	*reply = ms
+	return nil
+}
+
+func init() {
+	rpc.Register(&SlowRPC{})
+}
+
+// startSlowCall start a rpc server and a slow call in-flight.
+func startSlowCall(t *testing.T, ms int64) (*RPCServer, *rpc.Client, *rpc.Call) {
+	s := NewRPCServer()
+	if err := s.Listen("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	cli, err := rpc.Dial("tcp", s.Addrs()[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply := int64(0)
+	call := cli.Go("SlowRPC.Sleep", ms, &reply, nil)
+	for i := 0; s.Inflight() == 0; i++ {
+		if i > 100 {
+			t.Fatal("call not in-flight")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return s, cli, call
+}
+
+func TestRPCServerDrain(t *testing.T) {
+	s, cli, call := startSlowCall(t, 200)
+	addr := s.Addrs()[0]
+	closed := make(chan bool)
+	go func() {
+		s.Close(time.Second)
+		close(closed)
+	}()
+	for !s.Closed() {
+		time.Sleep(time.Millisecond)
+	}
+	// the new request of the accepted connection is refused while draining
+	reply := int64(0)
+	if err := cli.Call("SlowRPC.Sleep", 0, &reply); err == nil || err.Error() != ErrRPCClosed.Error() {
+		t.Fatalf("call after closed error(%v), expected %v", err, ErrRPCClosed)
+	}
+	<-closed
+	select {
+	case <-call.Done:
+		if call.Error != nil {
+			t.Fatalf("in-flight call error(%v), expected drained", call.Error)
+		}
+	default:
+		t.Fatal("in-flight call not finished after drain")
+	}
+	if _, err := rpc.Dial("tcp", addr); err == nil {
+		t.Fatal("rpc.Dial() expected error after close")
+	}
+	// the call exceeds the deadline is cut off
+	s, _, call = startSlowCall(t, 2000)
+	s.Close(50 * time.Millisecond)
+	select {
+	case <-call.Done:
+		if call.Error == nil {
+			t.Fatal("in-flight call expected error after cut off")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("in-flight call not cut off")
+	}
+}
+
+func TestInfo(t *testing.T) {
+	workers, _ := setupStandby(t, &Config{RPCBind: []string{"127.0.0.1:0"}, Registry: registry.BackendMemory, DatacenterId: 3, WorkerId: []int64{0, 1}, Twepoch: twepoch})
+	info := &myrpc.InfoReply{}
+	before := timeGen()
+	if err := (&SnowflakeRPC{workers: workers}).Info(0, info); err != nil {
+		t.Fatal(err)
+	}
+	if info.Build != Version || info.DatacenterId != 3 || info.Layout != registry.DefaultLayout || info.Epoch != twepoch {
+		t.Fatalf("info: %+v", info)
+	}
+	if info.Timestamp < before || info.Timestamp > timeGen() {
+		t.Fatalf("info timestamp: %d, expected since %d", info.Timestamp, before)
+	}
+	if len(info.Protocols) != 2 || info.Protocols[0] != registry.ProtocolRPC || info.Protocols[1] != registry.ProtocolTrace {
+		t.Fatalf("info protocols: %v", info.Protocols)
+	}
+	if len(info.Workers) != 2 {
+		t.Fatalf("info workers: %d, expected 2", len(info.Workers))
+	}
+	if *info.Workers[0] != (myrpc.WorkerInfo{WorkerId: 0, Role: registry.RoleLeader}) || *info.Workers[1] != (myrpc.WorkerInfo{WorkerId: 1, Role: registry.RoleStandby}) {
+		t.Fatalf("info workers: %+v, %+v", info.Workers[0], info.Workers[1])
+	}
+}
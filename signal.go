@@ -17,31 +17,66 @@
 package main
 
 import (
-	log "github.com/alecthomas/log4go"
+	"errors"
+	"github.com/Terry-Mao/gosnowflake/logger"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
 )
 
+var (
+	ErrSignalNotReady = errors.New("signals not handled yet")
+	ErrSignalBusy     = errors.New("another signal is pending")
+	// the handled signals, the admin actions send to it
+	signalChan  chan os.Signal
+	signalMutex sync.Mutex
+)
+
 // InitSignal register signals handler.
 func InitSignal() chan os.Signal {
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, syscall.SIGHUP, syscall.SIGQUIT, syscall.SIGTERM, syscall.SIGINT, syscall.SIGSTOP)
+	signal.Notify(c, syscall.SIGHUP, syscall.SIGQUIT, syscall.SIGTERM, syscall.SIGINT, syscall.SIGSTOP, syscall.SIGUSR1, syscall.SIGUSR2)
+	signalMutex.Lock()
+	signalChan = c
+	signalMutex.Unlock()
 	return c
 }
 
+// SendSignal send the signal to the signal handler as if it's received.
+func SendSignal(s os.Signal) error {
+	signalMutex.Lock()
+	c := signalChan
+	signalMutex.Unlock()
+	if c == nil {
+		return ErrSignalNotReady
+	}
+	select {
+	case c <- s:
+		return nil
+	default:
+		return ErrSignalBusy
+	}
+}
+
 // HandleSignal fetch signal from chan then do exit or reload.
-func HandleSignal(c chan os.Signal) {
+func HandleSignal(c chan os.Signal, workers *Workers) {
 	// Block until a signal is received.
 	for {
 		s := <-c
-		log.Info("gosnowflake get a signal %s", s.String())
+		Logger.Info("gosnowflake get a signal", logger.F("signal", s.String()))
 		switch s {
 		case syscall.SIGQUIT, syscall.SIGTERM, syscall.SIGSTOP, syscall.SIGINT:
 			return
 		case syscall.SIGHUP:
-			// TODO reload
-			//return
+			ReloadConfig(workers)
+		case syscall.SIGUSR1:
+			ReopenLog()
+		case syscall.SIGUSR2:
+			// the new process is ready, shut down and hand over
+			if err := Upgrade(); err == nil {
+				return
+			}
 		default:
 			return
 		}
@@ -0,0 +1,401 @@
+// Copyright © 2014 Terry Mao All rights reserved.
+// This file is part of gosnowflake.
+
+// gosnowflake is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// gosnowflake is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with gosnowflake.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"errors"
+	"github.com/Terry-Mao/gosnowflake/logger"
+	"github.com/Terry-Mao/gosnowflake/registry"
+	"net"
+	"net/rpc"
+	"sort"
+	"sync"
+	"time"
+)
+
+/*
+   clock skew monitor
+   ============
+   1. every interval, call "SnowflakeRPC.MilliTimestamp" of all registered
+      peers concurrently (deduplicated by rpc address, ourselves excluded),
+      the peer's clock is compensated by half of the round trip time.
+   2. we are skewed only if our clock disagrees by more than
+      "clock:peer.skew" with the majority of the answered peers, so only the
+      outlier stops, never the peers agree with each other. two clocks can't
+      tell which one is wrong, it needs at least 2 answered peers, with less
+      the state is kept and the ntp check (see ntp.go) decides.
+   3. if skewed, the clock guard stops serving (NextId, NextIds return
+      ErrClockSkew) and deregisters all workers, the clients fail over to
+      the standby workers.
+   4. the peers answered the last probe are kept probing even if they are
+      not registered any more, e.g. deregistered by their own clock guard,
+      so a deregistered outlier still has its peers to recover against.
+   5. once the skew recovers, the clock guard registers all workers again
+      and serves, see clock.go.
+*/
+
+const (
+	clockCheckPeers = "peers"
+	// the answered peers needed to judge the clock, a majority of 3 clocks
+	// with ourselves
+	minSkewPeers = 2
+)
+
+var (
+	ErrClockSkew = errors.New("clock skewed from peers, refusing to generate id")
+	// global skew monitor, nil if disabled, replaced by reloading
+	skewMonitor *SkewMonitor
+	skewMutex   sync.RWMutex
+)
+
+// SkewMonitor periodically check the local clock with all peers.
+type SkewMonitor struct {
+	mutex    sync.RWMutex
+	healthy  bool
+	skew     int64                      // last median skew milliseconds, local - peers
+	known    map[int64][]*registry.Peer // the peers answered the last probe
+	interval time.Duration
+	maxSkew  time.Duration
+	timeout  time.Duration
+	stop     chan bool
+	running  sync.WaitGroup
+}
+
+// InitSkewMonitor start the clock skew monitor if "clock:peer.interval" is
+// set.
+func InitSkewMonitor() {
+	conf := Conf()
+	if conf.SkewInterval <= 0 {
+		Logger.Warn("clock peer.interval not set, skip the clock skew monitor")
+		return
+	}
+	m := NewSkewMonitor(conf.SkewInterval, conf.MaxSkew, conf.SkewTimeout)
+	setSkewMonitor(m)
+	m.Start()
+}
+
+// getSkewMonitor get the global skew monitor, nil if disabled.
+func getSkewMonitor() *SkewMonitor {
+	skewMutex.RLock()
+	defer skewMutex.RUnlock()
+	return skewMonitor
+}
+
+// setSkewMonitor replace the global skew monitor, the old one is stopped.
+func setSkewMonitor(m *SkewMonitor) {
+	skewMutex.Lock()
+	old := skewMonitor
+	skewMonitor = m
+	skewMutex.Unlock()
+	old.Stop()
+}
+
+// NewSkewMonitor new a healthy clock skew monitor.
+func NewSkewMonitor(interval, maxSkew, timeout time.Duration) *SkewMonitor {
+	return &SkewMonitor{
+		healthy:  true,
+		interval: interval,
+		maxSkew:  maxSkew,
+		timeout:  timeout,
+		stop:     make(chan bool),
+	}
+}
+
+// Run check the clock skew every interval until stopped.
+func (m *SkewMonitor) Run() {
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			m.Check()
+		case <-m.stop:
+			return
+		}
+	}
+}
+
+// Start run the monitor in a goroutine until stopped.
+func (m *SkewMonitor) Start() {
+	m.running.Add(1)
+	go func() {
+		defer m.running.Done()
+		m.Run()
+	}()
+}
+
+// Stop stop the monitor and wait for the started one to return, so a check
+// in progress never changes the clock guard after stopped.
+func (m *SkewMonitor) Stop() {
+	if m == nil {
+		return
+	}
+	close(m.stop)
+	m.running.Wait()
+}
+
+// Healthy report whether the local clock agrees with the peers, a nil
+// monitor is always healthy.
+func (m *SkewMonitor) Healthy() bool {
+	if m == nil {
+		return true
+	}
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return m.healthy
+}
+
+// Skew get the last median skew milliseconds.
+func (m *SkewMonitor) Skew() int64 {
+	if m == nil {
+		return 0
+	}
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return m.skew
+}
+
+// Check probe all peers once, stop serving if skewed from the majority and
+// rejoin if recovered.
+func (m *SkewMonitor) Check() {
+	maxSkew := int64(m.maxSkew / time.Millisecond)
+	skews, err := m.peersSkew()
+	if err != nil {
+		return
+	}
+	if len(skews) == 0 {
+		// alone, nothing to disagree with
+		skews = []int64{0}
+	}
+	skew := medianSkew(skews)
+	MyStat.SetPeerSkew(skew)
+	outliers := 0
+	for _, s := range skews {
+		if s > maxSkew || s < -maxSkew {
+			outliers++
+		}
+	}
+	if outliers > 0 && len(skews) < minSkewPeers {
+		// can't tell which clock is wrong, keep the current state
+		Logger.Warn("too few peers to judge the clock skew, left to the ntp check", logger.F("skew_ms", skew), logger.F("peers", len(skews)), logger.F("min_peers", minSkewPeers))
+		return
+	}
+	healthy := outliers*2 <= len(skews)
+	m.mutex.Lock()
+	m.skew = skew
+	changed := m.healthy != healthy
+	m.healthy = healthy
+	m.mutex.Unlock()
+	if !changed {
+		return
+	}
+	if healthy {
+		Logger.Info("clock skew from the peers recovered", logger.F("skew_ms", skew))
+		clockGuard.Fault(clockCheckPeers, nil)
+	} else {
+		Logger.Error("clock skew from the peers exceeds the max", logger.F("skew_ms", skew), logger.F("max_ms", maxSkew))
+		clockGuard.Fault(clockCheckPeers, ErrClockSkew)
+	}
+}
+
+// peersSkew get the skew milliseconds of all other registered and last
+// known peers, empty if there is no other peer. the legacy peers only answer
+// seconds, so they are probed but not counted.
+func (m *SkewMonitor) peersSkew() ([]int64, error) {
+	peers, err := reg.Peers()
+	if err != nil {
+		Logger.Error("reg.Peers() error", logger.Err(err))
+		return nil, err
+	}
+	m.mutex.RLock()
+	mergePeers(peers, m.known)
+	m.mutex.RUnlock()
+	reports := probePeers(peers, m.timeout)
+	answered := map[string]bool{}
+	skews := []int64{}
+	for _, r := range reports {
+		if r.err != nil {
+			continue
+		}
+		answered[r.Addr] = true
+		if r.precision > 0 {
+			continue
+		}
+		Logger.Debug("peer clock skew", logger.F("hostname", r.Hostname), logger.F("addr", r.Addr), logger.F("skew_ms", r.Skew), logger.F("rtt_ms", r.RTT))
+		skews = append(skews, r.Skew)
+	}
+	known := map[int64][]*registry.Peer{}
+	for id, workers := range peers {
+		for _, peer := range workers {
+			if len(peer.RPC) > 0 && answered[peer.RPC[0]] {
+				known[id] = append(known[id], peer)
+			}
+		}
+	}
+	m.mutex.Lock()
+	m.known = known
+	m.mutex.Unlock()
+	if len(answered) == 0 && len(reports) > 0 {
+		// can't judge without any answer, keep the current state
+		Logger.Warn("none of the peers answered the clock probe", logger.F("peers", len(reports)))
+		return nil, errors.New("no peer answered")
+	}
+	return skews, nil
+}
+
+// mergePeers add the known peers not registered any more to the peers.
+func mergePeers(peers, known map[int64][]*registry.Peer) {
+	registered := map[string]bool{}
+	for _, workers := range peers {
+		for _, peer := range workers {
+			if len(peer.RPC) > 0 {
+				registered[peer.RPC[0]] = true
+			}
+		}
+	}
+	for id, workers := range known {
+		for _, peer := range workers {
+			if !registered[peer.RPC[0]] {
+				peers[id] = append(peers[id], peer)
+			}
+		}
+	}
+}
+
+// PeerReport is the probe result of a peer.
+type PeerReport struct {
+	WorkerIds    []int64 `json:"worker_ids"`
+	Hostname     string  `json:"hostname"`
+	Addr         string  `json:"addr"`
+	DatacenterId int64   `json:"datacenter_id"`
+	Skew         int64   `json:"skew"` // milliseconds, local - peer
+	RTT          int64   `json:"rtt"`  // milliseconds
+	Error        string  `json:"error,omitempty"`
+	err          error
+	precision    int64 // timestamp precision milliseconds, 0 is exact
+}
+
+// fail mark the peer failed.
+func (r *PeerReport) fail(err error) {
+	r.err = err
+	r.Error = err.Error()
+}
+
+// probe call the peer's datacenterId and clock in one connection, the
+// peer's timestamp is taken at the middle of the round trip.
+func (r *PeerReport) probe(timeout time.Duration) {
+	conn, err := net.DialTimeout("tcp", r.Addr, timeout)
+	if err != nil {
+		Logger.Warn("net.DialTimeout() error", logger.F("addr", r.Addr), logger.Err(err))
+		r.fail(err)
+		return
+	}
+	cli := rpc.NewClient(conn)
+	defer cli.Close()
+	if err = conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		Logger.Warn("conn.SetDeadline() error", logger.F("addr", r.Addr), logger.Err(err))
+		r.fail(err)
+		return
+	}
+	if err = cli.Call("SnowflakeRPC.DatacenterId", 0, &r.DatacenterId); err != nil {
+		Logger.Warn("rpc.Call() error", logger.F("method", "SnowflakeRPC.DatacenterId"), logger.F("addr", r.Addr), logger.Err(err))
+		r.fail(err)
+		return
+	}
+	method := "SnowflakeRPC.MilliTimestamp"
+	if r.precision > 0 {
+		// legacy peers only answer unix seconds
+		method = "SnowflakeRPC.Timestamp"
+	}
+	timestamp := int64(0)
+	start := timeGen()
+	if err = cli.Call(method, 0, &timestamp); err != nil {
+		Logger.Warn("rpc.Call() error", logger.F("method", method), logger.F("addr", r.Addr), logger.Err(err))
+		r.fail(err)
+		return
+	}
+	r.RTT = timeGen() - start
+	if r.precision > 0 {
+		// the middle of the second
+		timestamp = timestamp*r.precision + r.precision/2
+	}
+	r.Skew = start + r.RTT/2 - timestamp
+}
+
+// probePeers probe all other peers concurrently, a peer serves many workers
+// is probed once.
+func probePeers(peers map[int64][]*registry.Peer, timeout time.Duration) []*PeerReport {
+	local := localPeer()
+	probed := map[string]*PeerReport{}
+	reports := []*PeerReport{}
+	for id, workers := range peers {
+		for _, peer := range workers {
+			if isLocalPeer(peer, local) || len(peer.RPC) == 0 {
+				continue
+			}
+			if r, ok := probed[peer.RPC[0]]; ok {
+				r.WorkerIds = append(r.WorkerIds, id)
+				continue
+			}
+			r := &PeerReport{WorkerIds: []int64{id}, Hostname: peer.Hostname, Addr: peer.RPC[0]}
+			if peer.Version == 0 {
+				r.precision = int64(time.Second / time.Millisecond)
+			}
+			probed[r.Addr] = r
+			reports = append(reports, r)
+		}
+	}
+	wg := sync.WaitGroup{}
+	for _, r := range reports {
+		wg.Add(1)
+		go func(r *PeerReport) {
+			defer wg.Done()
+			r.probe(timeout)
+		}(r)
+	}
+	wg.Wait()
+	for _, r := range reports {
+		sort.Slice(r.WorkerIds, func(i, j int) bool { return r.WorkerIds[i] < r.WorkerIds[j] })
+	}
+	sort.Slice(reports, func(i, j int) bool { return reports[i].Addr < reports[j].Addr })
+	return reports
+}
+
+// isLocalPeer check the peer is registered by the current process, the
+// static peers have no hostname, they are matched by the rpc address.
+func isLocalPeer(peer, local *registry.Peer) bool {
+	if peer.Version > 0 && peer.Hostname != "" {
+		return peer.Hostname == local.Hostname && peer.Start == local.Start
+	}
+	for _, addr := range local.RPC {
+		if len(peer.RPC) > 0 && peer.RPC[0] == addr {
+			return true
+		}
+	}
+	return false
+}
+
+// medianSkew get the median of the skews.
+func medianSkew(skews []int64) int64 {
+	s := append([]int64{}, skews...)
+	sort.Slice(s, func(i, j int) bool { return s[i] < s[j] })
+	n := len(s)
+	if n%2 == 1 {
+		return s[n/2]
+	}
+	return (s[n/2-1] + s[n/2]) / 2
+}
@@ -0,0 +1,193 @@
+// Copyright © 2014 Terry Mao All rights reserved.
+// This file is part of gosnowflake.
+
+// gosnowflake is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// gosnowflake is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with gosnowflake.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"github.com/Terry-Mao/gosnowflake/registry"
+	"net"
+	"net/rpc"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// skewedRPC is a peer whose clock is ahead by offset milliseconds.
+type skewedRPC struct {
+	offset       int64
+	datacenterId int64
+}
+
+func (s *skewedRPC) DatacenterId(ignore int, datacenterId *int64) error {
+	*datacenterId = s.datacenterId
+	return nil
+}
+
+func (s *skewedRPC) MilliTimestamp(ignore int, timestamp *int64) error {
+	*timestamp = timeGen() + atomic.LoadInt64(&s.offset)
+	return nil
+}
+
+// startSkewedPeer start a rpc server answers the skewed clock.
+func startSkewedPeer(t *testing.T, peer *skewedRPC) string {
+	server := rpc.NewServer()
+	if err := server.RegisterName("SnowflakeRPC", peer); err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Accept(l)
+	return l.Addr().String()
+}
+
+func TestMedianSkew(t *testing.T) {
+	for _, c := range []struct {
+		skews    []int64
+		expected int64
+	}{
+		{[]int64{5}, 5},
+		{[]int64{30, -2, 1}, 1},
+		{[]int64{4, -10, 2, 8}, 3},
+	} {
+		if skew := medianSkew(c.skews); skew != c.expected {
+			t.Fatalf("medianSkew(%v) = %d, expected %d", c.skews, skew, c.expected)
+		}
+	}
+}
+
+func TestSkewMonitor(t *testing.T) {
+	first, second := &skewedRPC{}, &skewedRPC{}
+	store := registry.NewMemoryStore()
+	reg = store.Session()
+	defer reg.Close()
+	SetConf(&Config{RPCBind: []string{"127.0.0.1:0"}, Twepoch: twepoch})
+	others := store.Session()
+	if err := others.Register(2, &registry.Peer{Version: registry.PeerVersion, RPC: []string{startSkewedPeer(t, first)}, Hostname: "first"}); err != nil {
+		t.Fatal(err)
+	}
+	worker, err := NewIdWorker(1, 0, twepoch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	workers := &Workers{idWorkers: make([]*IdWorker, maxWorkerId+1)}
+	workers.idWorkers[1] = worker
+	if err = RegWorkerId(1); err != nil {
+		t.Fatal(err)
+	}
+	clockGuard = NewClockGuard()
+	defer func() { clockGuard = NewClockGuard() }()
+	clockGuard.SetWorkers(workers)
+	m := NewSkewMonitor(time.Second, time.Second, time.Second)
+	m.Check()
+	if !m.Healthy() {
+		t.Fatalf("skew %dms, expected healthy", m.Skew())
+	}
+	// a pair can't tell which clock is wrong
+	atomic.StoreInt64(&first.offset, 5000)
+	m.Check()
+	if !m.Healthy() || clockGuard.Err() != nil {
+		t.Fatalf("skew %dms from a single peer, expected the state kept", m.Skew())
+	}
+	// the other peer is the outlier
+	if err = others.Register(3, &registry.Peer{Version: registry.PeerVersion, RPC: []string{startSkewedPeer(t, second)}, Hostname: "second"}); err != nil {
+		t.Fatal(err)
+	}
+	m.Check()
+	if !m.Healthy() || clockGuard.Err() != nil {
+		t.Fatalf("skew %dms, expected healthy with an outlier peer", m.Skew())
+	}
+	// the majority runs 5s ahead, stop serving and deregister
+	atomic.StoreInt64(&second.offset, 5000)
+	m.Check()
+	if m.Healthy() {
+		t.Fatalf("skew %dms, expected unhealthy", m.Skew())
+	}
+	if skew := m.Skew(); skew > -4000 {
+		t.Fatalf("skew %dms, expected about -5000ms", skew)
+	}
+	if err = clockGuard.Err(); err != ErrClockSkew {
+		t.Fatalf("clockGuard.Err() = %v, expected %v", err, ErrClockSkew)
+	}
+	peers, err := reg.Peers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(peers[1]) != 0 {
+		t.Fatalf("workerId: 1 has %d peers, expected deregistered", len(peers[1]))
+	}
+	// the deregistered peers are still probed, not alone
+	others.Close()
+	m.Check()
+	if m.Healthy() || clockGuard.Err() != ErrClockSkew {
+		t.Fatalf("skew %dms, expected unhealthy against the deregistered peers", m.Skew())
+	}
+	// recovered, rejoin
+	atomic.StoreInt64(&first.offset, 0)
+	atomic.StoreInt64(&second.offset, 0)
+	m.Check()
+	if !m.Healthy() || clockGuard.Err() != nil {
+		t.Fatalf("skew %dms, expected healthy", m.Skew())
+	}
+	if peers, err = reg.Peers(); err != nil {
+		t.Fatal(err)
+	}
+	if len(peers[1]) != 1 {
+		t.Fatalf("workerId: 1 has %d peers, expected registered", len(peers[1]))
+	}
+}
+
+func TestSanityCheckPeers(t *testing.T) {
+	store := registry.NewMemoryStore()
+	reg = store.Session()
+	defer reg.Close()
+	SetConf(&Config{RPCBind: []string{"127.0.0.1:0"}, Twepoch: twepoch, MaxSkew: time.Second, SkewTimeout: time.Second})
+	// a sane, a skewed and a dead peer
+	skewed := &skewedRPC{offset: 5000}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead := l.Addr().String()
+	l.Close()
+	for workerId, addr := range []string{startSkewedPeer(t, &skewedRPC{}), startSkewedPeer(t, skewed), dead} {
+		peer := localPeer()
+		peer.Hostname = addr
+		peer.RPC = []string{addr}
+		if err = store.Session().Register(int64(workerId), peer); err != nil {
+			t.Fatal(err)
+		}
+	}
+	Conf().PeerQuorum = 30
+	report, err := SanityCheckPeers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Peers) != 3 || report.Passed != 1 || report.Failed != 2 {
+		t.Fatalf("report: %d peers, %d passed, %d failed, expected 3, 1, 2", len(report.Peers), report.Passed, report.Failed)
+	}
+	Conf().PeerQuorum = 50
+	if report, err = SanityCheckPeers(); err == nil || report.Pass {
+		t.Fatal("SanityCheckPeers() expected quorum error")
+	}
+	// other datacenter always fails
+	Conf().PeerQuorum = 0
+	skewed.datacenterId = 1
+	if _, err = SanityCheckPeers(); err == nil {
+		t.Fatal("SanityCheckPeers() expected datacenter error")
+	}
+}
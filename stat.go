@@ -16,4 +16,207 @@
 
 package main
 
-// TODO
+import (
+	"encoding/json"
+	"github.com/Terry-Mao/gosnowflake/logger"
+	"github.com/Terry-Mao/gosnowflake/registry"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	// global stat object
+	MyStat = &Stat{start: time.Now()}
+)
+
+// Stat is the service runtime statistics.
+type Stat struct {
+	mutex   sync.Mutex
+	start   time.Time
+	claimed []int64
+	sanity  *SanityReport
+	// clock
+	peerSkew  int64 // milliseconds, local - peers
+	ntpOffset int64 // milliseconds, ntp servers - local
+}
+
+// Start get the process start time.
+func (s *Stat) Start() time.Time {
+	return s.start
+}
+
+// SetClaimedWorkerIds set the worker ids claimed from the registry.
+func (s *Stat) SetClaimedWorkerIds(ids []int64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.claimed = ids
+}
+
+// ClaimedWorkerIds get the worker ids claimed from the registry.
+func (s *Stat) ClaimedWorkerIds() []int64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.claimed
+}
+
+// SetSanity set the peers sanity check report of the start.
+func (s *Stat) SetSanity(report *SanityReport) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.sanity = report
+}
+
+// Sanity get the peers sanity check report of the start.
+func (s *Stat) Sanity() *SanityReport {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.sanity
+}
+
+// SetPeerSkew set the last median clock skew milliseconds from the peers.
+func (s *Stat) SetPeerSkew(skew int64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.peerSkew = skew
+}
+
+// PeerSkew get the last median clock skew milliseconds from the peers.
+func (s *Stat) PeerSkew() int64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.peerSkew
+}
+
+// SetNTPOffset set the last measured clock offset milliseconds from the ntp
+// servers.
+func (s *Stat) SetNTPOffset(offset int64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.ntpOffset = offset
+}
+
+// NTPOffset get the last measured clock offset milliseconds from the ntp
+// servers.
+func (s *Stat) NTPOffset() int64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.ntpOffset
+}
+
+// WorkerStat is the statistics of a worker.
+type WorkerStat struct {
+	WorkerId      int64  `json:"worker_id"`
+	Role          string `json:"role"` // registry role, empty if unknown
+	Issued        int64  `json:"issued"`
+	Errors        int64  `json:"errors"`
+	Backwards     int64  `json:"clock_backwards"`
+	Exhausted     int64  `json:"sequence_exhausted"`
+	Regressed     int64  `json:"last_clock_backwards"` // unix milliseconds, 0 if never
+	LastTimestamp int64  `json:"last_timestamp"`
+	Sequence      int64  `json:"sequence"`
+}
+
+// RegistryStat is the registry session statistics.
+type RegistryStat struct {
+	Backend string  `json:"backend"`
+	State   string  `json:"state"`
+	Claimed []int64 `json:"claimed"`
+}
+
+// ClockStat is the clock checks statistics.
+type ClockStat struct {
+	PeerSkew  int64  `json:"peer_skew"`  // milliseconds
+	NTPOffset int64  `json:"ntp_offset"` // milliseconds
+	Fault     string `json:"fault,omitempty"`
+}
+
+// RPCStat is the rpc server statistics.
+type RPCStat struct {
+	Addrs    []string `json:"addrs"`
+	Conns    int      `json:"conns"`
+	Accepted int64    `json:"accepted"`
+	Inflight int64    `json:"inflight"`
+}
+
+// Stats is the stat http response.
+type Stats struct {
+	Version      string        `json:"version"`
+	DatacenterId int64         `json:"datacenter_id"`
+	Start        int64         `json:"start"`  // unix seconds
+	Uptime       int64         `json:"uptime"` // seconds
+	Registry     *RegistryStat `json:"registry"`
+	Clock        *ClockStat    `json:"clock"`
+	RPC          *RPCStat      `json:"rpc"`
+	Workers      []*WorkerStat `json:"workers"`
+	Peers        *SanityReport `json:"peers,omitempty"` // the sanity check of the start
+}
+
+// statHandler get the stats in json.
+func statHandler(workers *Workers) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		d, err := json.Marshal(collectStats(workers))
+		if err != nil {
+			Logger.Error("json.Marshal() error", logger.Err(err))
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.Write(d)
+	}
+}
+
+// collectStats collect the stats of the process.
+func collectStats(workers *Workers) *Stats {
+	conf := Conf()
+	now := time.Now()
+	s := &Stats{
+		Version:      Version,
+		DatacenterId: conf.DatacenterId,
+		Start:        MyStat.Start().Unix(),
+		Uptime:       int64(now.Sub(MyStat.Start()) / time.Second),
+		Registry:     &RegistryStat{Backend: conf.Registry, Claimed: MyStat.ClaimedWorkerIds()},
+		Clock:        &ClockStat{PeerSkew: MyStat.PeerSkew(), NTPOffset: MyStat.NTPOffset()},
+		RPC:          &RPCStat{},
+		Workers:      collectWorkerStats(workers),
+		Peers:        MyStat.Sanity(),
+	}
+	if reg != nil {
+		s.Registry.State = reg.State()
+	}
+	if err := clockGuard.Err(); err != nil {
+		s.Clock.Fault = err.Error()
+	}
+	if rpcServer != nil {
+		s.RPC.Addrs = rpcServer.Addrs()
+		s.RPC.Conns = rpcServer.Conns()
+		s.RPC.Accepted = rpcServer.Accepted()
+		s.RPC.Inflight = rpcServer.Inflight()
+	}
+	if reg != nil {
+		for _, ws := range s.Workers {
+			if role, err := reg.Role(ws.WorkerId); err == nil {
+				ws.Role = role
+			} else if err != registry.ErrNotSupported {
+				Logger.Error("reg.Role() error", logger.F("worker_id", ws.WorkerId), logger.Err(err))
+			}
+		}
+	}
+	return s
+}
+
+// collectWorkerStats get the stats of all workers sorted by the workerId,
+// without the role.
+func collectWorkerStats(workers *Workers) []*WorkerStat {
+	stats := []*WorkerStat{}
+	for _, worker := range workers.all() {
+		stats = append(stats, worker.Stat())
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].WorkerId < stats[j].WorkerId })
+	return stats
+}
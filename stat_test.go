@@ -0,0 +1,102 @@
+// Copyright © 2014 Terry Mao All rights reserved.
+// This file is part of gosnowflake.
+
+// gosnowflake is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// gosnowflake is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with gosnowflake.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"github.com/Terry-Mao/gosnowflake/registry"
+	"net/http"
+	"testing"
+)
+
+func TestStatHTTP(t *testing.T) {
+	bind := freeAddr(t)
+	workers, _ := setupStandby(t, &Config{RPCBind: []string{"127.0.0.1:0"}, StatBind: []string{bind}, AdminAllow: []string{"127.0.0.1"}, Registry: registry.BackendMemory, WorkerId: []int64{0, 1}, Twepoch: twepoch})
+	rpcServer = NewRPCServer()
+	defer rpcServer.Close(0)
+	if err := rpcServer.Listen("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	// the deprecated stat.bind is served by the admin http server
+	if err := InitAdmin(workers); err != nil {
+		t.Fatal(err)
+	}
+	defer unlisten(bind)
+	MyStat.SetSanity(&SanityReport{Peers: []*PeerReport{{WorkerIds: []int64{1}, Addr: "10.0.0.1:8080", Skew: 3}}, Passed: 1, Pass: true})
+	defer MyStat.SetSanity(nil)
+	worker, _ := workers.Get(0)
+	for i := 0; i < 3; i++ {
+		if _, err := worker.NextId(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the clock moves backwards within the borrow and the sequence overflows
+	worker.mutex.Lock()
+	worker.maxBorrow = 100
+	worker.lastTimestamp = timeGen() + 5
+	worker.lastWall = worker.lastTimestamp
+	worker.sequence = sequenceMask
+	worker.mutex.Unlock()
+	if _, err := worker.NextId(); err != nil {
+		t.Fatal(err)
+	}
+	// the clock stays behind beyond the borrow, no new regression
+	worker.mutex.Lock()
+	worker.maxBorrow = 0
+	worker.mutex.Unlock()
+	if _, err := worker.NextId(); err == nil {
+		t.Fatal("NextId() must fail while the clock is behind")
+	}
+	resp, err := http.Get("http://" + bind + "/stat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET /stat status: %d", resp.StatusCode)
+	}
+	stats := &Stats{}
+	if err = json.NewDecoder(resp.Body).Decode(stats); err != nil {
+		t.Fatal(err)
+	}
+	if stats.Version != Version || stats.Registry.State != registry.StateOpen || len(stats.RPC.Addrs) != 1 {
+		t.Fatalf("stats: version: %s, registry: %+v, rpc: %+v", stats.Version, stats.Registry, stats.RPC)
+	}
+	if len(stats.Workers) != 2 {
+		t.Fatalf("stats workers: %d, expected 2", len(stats.Workers))
+	}
+	ws := stats.Workers[0]
+	if ws.WorkerId != 0 || ws.Role != registry.RoleLeader || ws.Issued != 4 || ws.Errors != 1 || ws.Backwards != 1 || ws.Exhausted != 1 {
+		t.Fatalf("worker 0 stat: %+v", ws)
+	}
+	if ws.LastTimestamp <= 0 || ws.Sequence != 0 {
+		t.Fatalf("worker 0 stat: %+v", ws)
+	}
+	if ws = stats.Workers[1]; ws.WorkerId != 1 || ws.Role != registry.RoleStandby || ws.Issued != 0 {
+		t.Fatalf("worker 1 stat: %+v", ws)
+	}
+	if stats.Peers == nil || !stats.Peers.Pass || len(stats.Peers.Peers) != 1 || stats.Peers.Peers[0].Skew != 3 {
+		t.Fatalf("stats peers: %+v", stats.Peers)
+	}
+	if resp, err = http.Post("http://"+bind+"/stat", "application/json", nil); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("POST /stat status: %d, expected %d", resp.StatusCode, http.StatusMethodNotAllowed)
+	}
+}
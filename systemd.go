@@ -0,0 +1,202 @@
+// Copyright © 2014 Terry Mao All rights reserved.
+// This file is part of gosnowflake.
+
+// gosnowflake is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// gosnowflake is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with gosnowflake.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"github.com/Terry-Mao/gosnowflake/logger"
+	myrpc "github.com/Terry-Mao/gosnowflake/rpc"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+   systemd
+   ============
+   1. Type=notify: "READY=1" is sent after the workers registered, the peers
+      sanity checked and all listeners bound, "STOPPING=1" when the shutdown
+      starts draining. the upgraded process (SIGUSR2) sends its "MAINPID"
+      before the old process exits, so NotifyAccess=all is required.
+   2. WatchdogSec: "WATCHDOG=1" is sent every half of the timeout while the
+      health checks (see health.go) report live, they block if the registry
+      or a worker is stuck, so the watchdog fires. a deregistered worker for
+      a clock fault or a lost registry session is live, it recovers by
+      itself, the failed checks are reported in "STATUS" (systemctl status).
+   3. socket activation: the passed sockets (LISTEN_FDS) are used by the
+      rpc.bind and admin binds of the same address, the others are closed.
+*/
+
+const (
+	envNotifySocket = "NOTIFY_SOCKET"
+	envWatchdogUsec = "WATCHDOG_USEC"
+	envWatchdogPid  = "WATCHDOG_PID"
+	envSDListenFds  = "LISTEN_FDS"
+	envSDListenPid  = "LISTEN_PID"
+	sdReady         = "READY=1"
+	sdStopping      = "STOPPING=1"
+	sdWatchdog      = "WATCHDOG=1"
+	sdStatus        = "STATUS="
+)
+
+var (
+	// stop the watchdog keepalives
+	sdWatchdogStop chan bool
+)
+
+// InitSystemd inherit the socket activated listeners.
+func InitSystemd() {
+	// a later upgrade passes its own
+	defer func() {
+		os.Unsetenv(envSDListenFds)
+		os.Unsetenv(envSDListenPid)
+	}()
+	n, err := strconv.Atoi(os.Getenv(envSDListenFds))
+	if err != nil || n <= 0 {
+		return
+	}
+	if pid, err := strconv.Atoi(os.Getenv(envSDListenPid)); err != nil || pid != os.Getpid() {
+		return
+	}
+	files := make([]*os.File, 0, n)
+	for i := 0; i < n; i++ {
+		files = append(files, os.NewFile(uintptr(listenFdStart+i), "systemd"))
+	}
+	sdListeners(files)
+}
+
+// sdListeners inherit the listeners of the socket activated files by the
+// listening address, the files are closed.
+func sdListeners(files []*os.File) {
+	listenerMutex.Lock()
+	defer listenerMutex.Unlock()
+	for _, f := range files {
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			// not a listening socket
+			Logger.Warn("net.FileListener() error, skip", logger.F("file", f.Name()), logger.Err(err))
+			continue
+		}
+		Logger.Info("inherit systemd listen addr", logger.F("addr", l.Addr().String()))
+		inherited[l.Addr().String()] = l
+	}
+}
+
+// sdNotify send the state to the systemd notify socket, it's a no-op if not
+// started by systemd.
+func sdNotify(state string) error {
+	socket := os.Getenv(envNotifySocket)
+	if socket == "" {
+		return nil
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		Logger.Error("net.DialUnix() error", logger.F("socket", socket), logger.Err(err))
+		return err
+	}
+	defer conn.Close()
+	if _, err = conn.Write([]byte(state)); err != nil {
+		Logger.Error("sd_notify() error", logger.F("state", state), logger.Err(err))
+		return err
+	}
+	return nil
+}
+
+// sdWatchdogInterval get the watchdog keepalive interval, zero if disabled.
+func sdWatchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv(envWatchdogUsec), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv(envWatchdogPid); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond / 2
+}
+
+// NotifyReady tell systemd the service is ready and start the watchdog.
+func NotifyReady(workers *Workers) error {
+	if err := sdNotify(fmt.Sprintf("%s\nMAINPID=%d", sdReady, os.Getpid())); err != nil {
+		return err
+	}
+	if interval := sdWatchdogInterval(); interval > 0 {
+		Logger.Info("systemd watchdog keepalive", logger.F("interval", interval.String()))
+		sdWatchdogStop = make(chan bool)
+		go sdWatchdogLoop(interval, sdWatchdogStop, func() *myrpc.HealthReply { return checkHealth(workers) })
+	}
+	return nil
+}
+
+// NotifyStopping stop the watchdog, tell systemd the service is stopping
+// unless it's handing over to the upgraded process.
+func NotifyStopping(upgrading bool) {
+	if sdWatchdogStop != nil {
+		close(sdWatchdogStop)
+		sdWatchdogStop = nil
+	}
+	if !upgrading {
+		sdNotify(sdStopping)
+	}
+}
+
+// sdWatchdogLoop send the keepalives while live and the status of the
+// health checks until stopped.
+func sdWatchdogLoop(interval time.Duration, stop chan bool, health func() *myrpc.HealthReply) {
+	for {
+		reply := health()
+		status := sdHealthStatus(reply)
+		if reply.Live {
+			sdNotify(sdWatchdog + "\n" + status)
+		} else {
+			Logger.Warn("gosnowflake not serving, skip the systemd watchdog keepalive")
+			sdNotify(status)
+		}
+		select {
+		case <-stop:
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// sdHealthStatus get the systemd status of the health checks, the failed
+// checks are listed.
+func sdHealthStatus(reply *myrpc.HealthReply) string {
+	if reply.Ready {
+		return sdStatus + "ready"
+	}
+	failed := []string{}
+	for _, c := range reply.Checks {
+		if c.Status == myrpc.HealthFail {
+			failed = append(failed, fmt.Sprintf("%s: %s", c.Name, c.Detail))
+		}
+	}
+	return sdStatus + "not ready, " + strings.Join(failed, ", ")
+}
+
+// serving check the rpc server is listening and the workers are not blocked,
+// it blocks if any worker is.
+func serving(workers *Workers) bool {
+	if rpcServer == nil || len(rpcServer.Addrs()) == 0 {
+		return false
+	}
+	workers.Lead()
+	return true
+}
@@ -0,0 +1,163 @@
+// Copyright © 2014 Terry Mao All rights reserved.
+// This file is part of gosnowflake.
+
+// gosnowflake is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// gosnowflake is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with gosnowflake.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// startNotifySocket start a unix datagram stand-in of the systemd notify
+// socket.
+func startNotifySocket(t *testing.T) (*net.UnixConn, func()) {
+	dir, err := ioutil.TempDir("", "gosnowflake")
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := filepath.Join(dir, "notify")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: name, Net: "unixgram"})
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	os.Setenv(envNotifySocket, name)
+	return conn, func() {
+		os.Unsetenv(envNotifySocket)
+		conn.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// readNotify read a state from the notify socket.
+func readNotify(t *testing.T, conn *net.UnixConn) string {
+	b := make([]byte, 1024)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := conn.Read(b)
+	if err != nil {
+		t.Fatalf("read notify socket error(%v)", err)
+	}
+	return string(b[:n])
+}
+
+func TestSdNotify(t *testing.T) {
+	// no-op without systemd
+	if err := sdNotify(sdReady); err != nil {
+		t.Fatalf("sdNotify() without socket error(%v)", err)
+	}
+	conn, stop := startNotifySocket(t)
+	defer stop()
+	os.Setenv(envWatchdogUsec, "100000")
+	os.Setenv(envWatchdogPid, strconv.Itoa(os.Getpid()))
+	defer os.Unsetenv(envWatchdogUsec)
+	defer os.Unsetenv(envWatchdogPid)
+	if interval := sdWatchdogInterval(); interval != 50*time.Millisecond {
+		t.Fatalf("sdWatchdogInterval() = %s, expected 50ms", interval)
+	}
+	conf, oldReg := Conf(), reg
+	defer func() {
+		SetConf(conf)
+		reg = oldReg
+	}()
+	SetConf(&Config{Twepoch: twepoch})
+	reg = nil
+	// not serving, no keepalive
+	rpcServer = NewRPCServer()
+	workers := &Workers{}
+	if err := NotifyReady(workers); err != nil {
+		t.Fatalf("NotifyReady() error(%v)", err)
+	}
+	if state := readNotify(t, conn); state != sdReady+"\nMAINPID="+strconv.Itoa(os.Getpid()) {
+		t.Fatalf("ready state: \"%s\"", state)
+	}
+	if state := readNotify(t, conn); state != sdStatus+"not ready, rpc: not listening, registry: not initialized" {
+		t.Fatalf("status while not serving: \"%s\"", state)
+	}
+	// the upgrading process stops the keepalives only
+	NotifyStopping(true)
+	// serving
+	if err := rpcServer.Listen("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	defer rpcServer.Close(0)
+	if err := NotifyReady(workers); err != nil {
+		t.Fatalf("NotifyReady() error(%v)", err)
+	}
+	readNotify(t, conn)
+	// live without the registry, the failed check is reported
+	keepalive := sdWatchdog + "\n" + sdStatus + "not ready, registry: not initialized"
+	for i := 0; i < 2; i++ {
+		if state := readNotify(t, conn); state != keepalive {
+			t.Fatalf("keepalive state: \"%s\"", state)
+		}
+	}
+	NotifyStopping(false)
+	for {
+		if state := readNotify(t, conn); state == sdStopping {
+			break
+		} else if state != keepalive {
+			t.Fatalf("stopping state: \"%s\"", state)
+		}
+	}
+	// another pid's watchdog
+	os.Setenv(envWatchdogPid, "1")
+	if interval := sdWatchdogInterval(); interval != 0 {
+		t.Fatalf("sdWatchdogInterval() of another pid = %s, expected 0", interval)
+	}
+}
+
+func TestSdListeners(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := l.(*net.TCPListener).File()
+	l.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	sdListeners([]*os.File{f})
+	// the passed socket of the same address is used
+	bind := "localhost:" + strconv.Itoa(port)
+	sl, err := listen(bind)
+	if err != nil {
+		t.Fatalf("listen(\"%s\") error(%v)", bind, err)
+	}
+	defer unlisten(bind)
+	if sl.Addr().String() != l.Addr().String() {
+		t.Fatalf("listen(\"%s\") = %s, expected the activated %s", bind, sl.Addr(), l.Addr())
+	}
+	for _, c := range []struct {
+		bind, addr string
+		same       bool
+	}{
+		{":8080", "[::]:8080", true},
+		{"0.0.0.0:8080", "[::]:8080", true},
+		{":8080", "127.0.0.1:8080", false},
+		{"127.0.0.1:8080", "127.0.0.1:8081", false},
+		{"127.0.0.1:8080", "127.0.0.1:8080", true},
+	} {
+		if same := sameAddr(c.bind, c.addr); same != c.same {
+			t.Fatalf("sameAddr(\"%s\", \"%s\") = %t, expected %t", c.bind, c.addr, same, c.same)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+// Copyright © 2014 Terry Mao All rights reserved.
+// This file is part of gosnowflake.
+
+// gosnowflake is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// gosnowflake is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with gosnowflake.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/Terry-Mao/gosnowflake/logger"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+	"io"
+	"os"
+	"time"
+)
+
+/*
+   tracing
+   ============
+   the clients send the w3c trace context of Id, Ids in the rpc args (see
+   myrpc.NextIdArgs), the service continues the caller's trace with the
+   spans:
+
+   SnowflakeRPC.TracedNextId, SnowflakeRPC.NextIds  the rpc call
+   snowflake.worker_lookup                          find the served worker
+   snowflake.sequence_wait                          wait the next millisecond after the sequence exhausted
+   snowflake.clock_regression_wait                  wait the wall clock catches up the logical clock after
+                                                    the clock moved backwards, see hlc.borrow
+
+   the calls without a trace context are not traced, the sampling is decided
+   by the caller. the spans are exported to an opentelemetry collector by
+   otlp grpc (trace:exporter otlp) or written to the stdout as json lines
+   (trace:exporter stdout), the client's rpc span minus the service's one is
+   the network time.
+*/
+
+const (
+	traceExporterNone    = "none"
+	traceExporterStdout  = "stdout"
+	traceExporterOTLP    = "otlp"
+	traceShutdownTimeout = 5 * time.Second
+	tracerName           = "github.com/Terry-Mao/gosnowflake"
+	// span names
+	spanWorkerLookup = "snowflake.worker_lookup"
+	spanSequenceWait = "snowflake.sequence_wait"
+	spanClockWait    = "snowflake.clock_regression_wait"
+)
+
+var (
+	// global tracer, does nothing unless InitTrace
+	tracer         trace.Tracer = noop.NewTracerProvider().Tracer(tracerName)
+	tracerProvider *sdktrace.TracerProvider
+	// the trace context carried by the rpc args
+	tracePropagator = propagation.TraceContext{}
+)
+
+// InitTrace start exporting the spans if "trace:exporter" is set.
+func InitTrace() (err error) {
+	conf := Conf()
+	if conf.TraceExport == traceExporterNone {
+		Logger.Info("trace exporter not set, skip the tracing")
+		return
+	}
+	Logger.Info("start tracing", logger.F("exporter", conf.TraceExport), logger.F("endpoint", conf.TraceAddr))
+	if tracerProvider, err = newTracerProvider(conf.TraceExport, conf.TraceAddr, conf.TraceTLS, os.Stdout); err != nil {
+		Logger.Error("newTracerProvider() error", logger.F("exporter", conf.TraceExport), logger.Err(err))
+		return
+	}
+	tracer = tracerProvider.Tracer(tracerName)
+	return
+}
+
+// CloseTrace export the buffered spans and stop the exporter.
+func CloseTrace() {
+	if tracerProvider == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), traceShutdownTimeout)
+	defer cancel()
+	if err := tracerProvider.Shutdown(ctx); err != nil {
+		Logger.Error("tracerProvider.Shutdown() error", logger.Err(err))
+	}
+}
+
+// newTracerProvider new a tracer provider batching the sampled spans to the
+// exporter, the stdout exporter writes to w.
+func newTracerProvider(exporter, endpoint string, tls bool, w io.Writer) (*sdktrace.TracerProvider, error) {
+	var (
+		exp sdktrace.SpanExporter
+		err error
+	)
+	switch exporter {
+	case traceExporterStdout:
+		exp, err = stdouttrace.New(stdouttrace.WithWriter(w))
+	case traceExporterOTLP:
+		opts := []otlptracegrpc.Option{otlptracegrpc.WithEndpoint(endpoint)}
+		if !tls {
+			opts = append(opts, otlptracegrpc.WithInsecure())
+		}
+		// connects lazily
+		exp, err = otlptracegrpc.New(context.Background(), opts...)
+	default:
+		err = fmt.Errorf("trace exporter: \"%s\" is not \"%s\", \"%s\" or \"%s\"", exporter, traceExporterNone, traceExporterStdout, traceExporterOTLP)
+	}
+	if err != nil {
+		return nil, err
+	}
+	res := resource.NewSchemaless(attribute.String("service.name", "gosnowflake"), attribute.String("service.version", Version))
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exp),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.NeverSample())),
+	), nil
+}
+
+// traceContext extract the caller's trace context from the rpc args.
+func traceContext(carrier map[string]string) context.Context {
+	return tracePropagator.Extract(context.Background(), propagation.MapCarrier(carrier))
+}
+
+// startSpan start a child span of the traced call, the call not traced gets
+// the span of ctx which does nothing.
+func startSpan(ctx context.Context, name string, kind trace.SpanKind, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	if !trace.SpanContextFromContext(ctx).IsValid() {
+		return ctx, trace.SpanFromContext(ctx)
+	}
+	return tracer.Start(ctx, name, trace.WithSpanKind(kind), trace.WithAttributes(attrs...))
+}
+
+// endSpan end the span, records the error if any.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
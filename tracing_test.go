@@ -0,0 +1,172 @@
+// Copyright © 2014 Terry Mao All rights reserved.
+// This file is part of gosnowflake.
+
+// gosnowflake is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// gosnowflake is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with gosnowflake.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/Terry-Mao/gosnowflake/registry"
+	myrpc "github.com/Terry-Mao/gosnowflake/rpc"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+	"testing"
+)
+
+// traceSpan is a span written by the stdout exporter.
+type traceSpan struct {
+	Name        string
+	SpanContext struct{ TraceID, SpanID string }
+	Parent      struct{ TraceID, SpanID string }
+	Status      struct{ Code string }
+	Events      []struct{ Name string }
+}
+
+// traceCarrier get the rpc args trace of a remote parent span.
+func traceCarrier(traceId byte, sampled bool) map[string]string {
+	cfg := trace.SpanContextConfig{TraceID: trace.TraceID{traceId}, SpanID: trace.SpanID{1}, Remote: true}
+	if sampled {
+		cfg.TraceFlags = trace.FlagsSampled
+	}
+	carrier := propagation.MapCarrier{}
+	tracePropagator.Inject(trace.ContextWithRemoteSpanContext(context.Background(), trace.NewSpanContext(cfg)), carrier)
+	return carrier
+}
+
+func TestTrace(t *testing.T) {
+	SetConf(&Config{Registry: registry.BackendMemory, WorkerId: []int64{0}, Twepoch: twepoch})
+	reg = registry.NewMemoryStore().Session()
+	defer reg.Close()
+	workers, err := NewWorkers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	worker, _ := workers.Get(0)
+	buf := &bytes.Buffer{}
+	tp, err := newTracerProvider(traceExporterStdout, "", false, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tp.Shutdown(context.Background())
+	tracer = tp.Tracer(tracerName)
+	defer func() {
+		tracer = noop.NewTracerProvider().Tracer(tracerName)
+	}()
+	spans := map[string][]*traceSpan{}
+	flush := func() {
+		if err := tp.ForceFlush(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		for dec := json.NewDecoder(buf); dec.More(); {
+			span := &traceSpan{}
+			if err := dec.Decode(span); err != nil {
+				t.Fatal(err)
+			}
+			spans[span.Name] = append(spans[span.Name], span)
+		}
+	}
+	s := &SnowflakeRPC{workers: workers}
+	id := int64(0)
+	ids := []int64{}
+	// not traced or not sampled by the caller
+	if err = s.NextId(0, &id); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.NextIds(&myrpc.NextIdsArgs{WorkerId: 0, Num: 2}, &ids); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.TracedNextId(&myrpc.NextIdArgs{WorkerId: 0, Trace: traceCarrier(1, false)}, &id); err != nil {
+		t.Fatal(err)
+	}
+	if flush(); len(spans) != 0 {
+		t.Fatalf("spans of the calls not sampled: %v", spans)
+	}
+	// continue the caller's trace
+	if err = s.TracedNextId(&myrpc.NextIdArgs{WorkerId: 0, Trace: traceCarrier(2, true)}, &id); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.NextIds(&myrpc.NextIdsArgs{WorkerId: 0, Num: 2, Trace: traceCarrier(2, true)}, &ids); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.NextIds(&myrpc.NextIdsArgs{WorkerId: 1, Num: 2, Trace: traceCarrier(2, true)}, &ids); err == nil {
+		t.Fatal("NextIds() of a worker not served expected error")
+	}
+	flush()
+	if len(spans["SnowflakeRPC.TracedNextId"]) != 1 || len(spans["SnowflakeRPC.NextIds"]) != 2 || len(spans[spanWorkerLookup]) != 3 {
+		t.Fatalf("spans: %v", spans)
+	}
+	server := spans["SnowflakeRPC.TracedNextId"][0]
+	if server.SpanContext.TraceID != (trace.TraceID{2}).String() || server.Parent.SpanID != (trace.SpanID{1}).String() {
+		t.Fatalf("rpc span: %+v, expected the child of the caller", server)
+	}
+	if lookup := spans[spanWorkerLookup][0]; lookup.SpanContext.TraceID != server.SpanContext.TraceID || lookup.Parent.SpanID != server.SpanContext.SpanID {
+		t.Fatalf("worker lookup span: %+v, expected the child of the rpc span %+v", lookup, server)
+	}
+	if failed := spans["SnowflakeRPC.NextIds"][1]; failed.Status.Code != "Error" || spans[spanWorkerLookup][2].Status.Code != "Error" {
+		t.Fatalf("rpc span of the error: %+v", failed)
+	}
+	// the sequence exhausted in the millisecond waits the next one
+	for i := 0; len(spans[spanSequenceWait]) == 0; i++ {
+		if i > 100 {
+			t.Fatal("no sequence wait span")
+		}
+		worker.mutex.Lock()
+		worker.lastTimestamp = timeGen()
+		worker.sequence = sequenceMask
+		worker.mutex.Unlock()
+		if err = s.TracedNextId(&myrpc.NextIdArgs{WorkerId: 0, Trace: traceCarrier(3, true)}, &id); err != nil {
+			t.Fatal(err)
+		}
+		flush()
+	}
+	// the logical clock borrowed up to the bound waits the wall clock
+	worker.mutex.Lock()
+	worker.maxBorrow = 1
+	worker.mutex.Unlock()
+	for i := 0; len(spans[spanClockWait]) == 0; i++ {
+		if i > 100 {
+			t.Fatal("no clock regression wait span")
+		}
+		worker.mutex.Lock()
+		worker.lastTimestamp = timeGen() + 1
+		worker.sequence = sequenceMask
+		worker.mutex.Unlock()
+		if err = s.TracedNextId(&myrpc.NextIdArgs{WorkerId: 0, Trace: traceCarrier(4, true)}, &id); err != nil {
+			t.Fatal(err)
+		}
+		flush()
+	}
+	if wait := spans[spanClockWait][0]; wait.SpanContext.TraceID != (trace.TraceID{4}).String() {
+		t.Fatalf("clock regression wait span: %+v", wait)
+	}
+	// the rejection is an event of the rpc span
+	worker.mutex.Lock()
+	worker.lastTimestamp = timeGen() + 1000
+	worker.mutex.Unlock()
+	if err = s.TracedNextId(&myrpc.NextIdArgs{WorkerId: 0, Trace: traceCarrier(5, true)}, &id); err == nil {
+		t.Fatal("TracedNextId() expected clock backwards error")
+	}
+	flush()
+	rejected := spans["SnowflakeRPC.TracedNextId"][len(spans["SnowflakeRPC.TracedNextId"])-1]
+	if rejected.Status.Code != "Error" || len(rejected.Events) == 0 || rejected.Events[0].Name != "clock moved backwards" {
+		t.Fatalf("rpc span of the rejection: %+v", rejected)
+	}
+	worker.mutex.Lock()
+	worker.lastTimestamp = timeGen()
+	worker.mutex.Unlock()
+}
@@ -0,0 +1,354 @@
+// Copyright © 2014 Terry Mao All rights reserved.
+// This file is part of gosnowflake.
+
+// gosnowflake is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// gosnowflake is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with gosnowflake.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/Terry-Mao/gosnowflake/logger"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+/*
+   SIGUSR2 binary upgrade
+   ============
+   1. the old process starts the new binary with the same arguments, all
+      listening sockets (rpc.bind, admin binds) are passed as the extra files
+      from fd 3, then the locked pid file, and a socketpair to talk with the
+      new process. the pid file lock is shared, so no other instance can start
+      meanwhile.
+   2. the new process inherits the listeners, inits the registry, checks the
+      peers, then writes "ready".
+   3. the old process shuts down gracefully (deregisters the workers, stops
+      accepting, drains the in-flight calls, publishes the high-water), closes
+      the registry session to release the claims, then writes "drained" and
+      exits. the connections arrive meanwhile wait in the shared listen
+      backlog.
+   4. the new process writes its pid, takes over the workers from the
+      published high-water, registers them and starts accepting.
+
+   if the new process fails before "ready", the old process keeps serving. if
+   the old process doesn't drain within the upgrade timeout plus the drain
+   timeout, the new process exits and releases the inherited listeners.
+
+   note the static registry keeps the high-water only in the process memory,
+   it's not handed over, the new process starts from its own clock.
+*/
+
+const (
+	envListenFds   = "GOSNOWFLAKE_LISTEN_FDS" // the inherited binds, fd from 3
+	envUpgradeFd   = "GOSNOWFLAKE_UPGRADE_FD" // the socketpair to the old process
+	envPidFd       = "GOSNOWFLAKE_PID_FD"     // the locked pid file
+	listenFdStart  = 3
+	upgradeReady   = "ready"
+	upgradeDrained = "drained"
+)
+
+var (
+	ErrUpgrading    = errors.New("upgrade in progress")
+	ErrUpgradeDrain = errors.New("upgrade the old process not drained in time")
+	// the new process answers ready, the old process drains (plus the drain
+	// timeout) within it
+	upgradeTimeout = time.Minute
+	// all listening sockets, bind => listener
+	listeners     = map[string]net.Listener{}
+	inherited     = map[string]net.Listener{}
+	listenerMutex sync.Mutex
+	// the connection to the new process (old) or the old process (new)
+	upgradeConn net.Conn
+)
+
+// InitUpgrade inherit the listeners and the upgrade connection from the old
+// process if started by an upgrade.
+func InitUpgrade() error {
+	if binds := os.Getenv(envListenFds); binds != "" {
+		files := []*os.File{}
+		for i, bind := range strings.Split(binds, ",") {
+			files = append(files, os.NewFile(uintptr(listenFdStart+i), bind))
+		}
+		if err := inheritListeners(strings.Split(binds, ","), files); err != nil {
+			return err
+		}
+	}
+	if fd := os.Getenv(envPidFd); fd != "" {
+		i, err := strconv.Atoi(fd)
+		if err != nil {
+			Logger.Error("strconv.Atoi() error", logger.F("fd", fd), logger.Err(err))
+			return err
+		}
+		pidFile = os.NewFile(uintptr(i), Conf().PidFile)
+	}
+	if fd := os.Getenv(envUpgradeFd); fd != "" {
+		i, err := strconv.Atoi(fd)
+		if err != nil {
+			Logger.Error("strconv.Atoi() error", logger.F("fd", fd), logger.Err(err))
+			return err
+		}
+		f := os.NewFile(uintptr(i), "upgrade")
+		conn, err := net.FileConn(f)
+		f.Close()
+		if err != nil {
+			Logger.Error("net.FileConn() error", logger.Err(err))
+			return err
+		}
+		upgradeConn = conn
+	}
+	// a later upgrade passes its own
+	os.Unsetenv(envListenFds)
+	os.Unsetenv(envUpgradeFd)
+	os.Unsetenv(envPidFd)
+	return nil
+}
+
+// inheritListeners get the listeners of the files, the files are closed.
+func inheritListeners(binds []string, files []*os.File) error {
+	listenerMutex.Lock()
+	defer listenerMutex.Unlock()
+	for i, f := range files {
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			Logger.Error("net.FileListener() error", logger.F("addr", binds[i]), logger.Err(err))
+			return err
+		}
+		Logger.Info("inherit listen addr", logger.F("addr", binds[i]))
+		inherited[binds[i]] = l
+	}
+	return nil
+}
+
+// listen get the inherited listener of the bind, or listen the bind.
+func listen(bind string) (net.Listener, error) {
+	listenerMutex.Lock()
+	defer listenerMutex.Unlock()
+	key := bind
+	l, ok := inherited[key]
+	if !ok {
+		// the socket activated listeners are keyed by the address
+		for addr, il := range inherited {
+			if sameAddr(bind, addr) {
+				l, ok, key = il, true, addr
+				break
+			}
+		}
+	}
+	if ok {
+		delete(inherited, key)
+	} else {
+		var err error
+		if l, err = net.Listen("tcp", bind); err != nil {
+			return nil, err
+		}
+	}
+	listeners[bind] = l
+	return l, nil
+}
+
+// sameAddr check the bind and the listening address are the same, any
+// unspecified ip (":80", "0.0.0.0:80", "[::]:80") is the same.
+func sameAddr(bind, addr string) bool {
+	b, err := net.ResolveTCPAddr("tcp", bind)
+	if err != nil {
+		return false
+	}
+	a, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		return false
+	}
+	if b.Port != a.Port {
+		return false
+	}
+	if len(b.IP) == 0 || b.IP.IsUnspecified() {
+		return len(a.IP) == 0 || a.IP.IsUnspecified()
+	}
+	return b.IP.Equal(a.IP)
+}
+
+// unlisten close the listener of the bind.
+func unlisten(bind string) error {
+	listenerMutex.Lock()
+	l, ok := listeners[bind]
+	delete(listeners, bind)
+	listenerMutex.Unlock()
+	if !ok {
+		return nil
+	}
+	return l.Close()
+}
+
+// CloseInherited close the inherited listeners not used by the new config.
+func CloseInherited() {
+	listenerMutex.Lock()
+	defer listenerMutex.Unlock()
+	for bind, l := range inherited {
+		Logger.Info("close inherited listen addr", logger.F("addr", bind))
+		l.Close()
+		delete(inherited, bind)
+	}
+}
+
+// WaitUpgrade tell the old process the new process is ready, then wait the
+// old process drained all workers.
+func WaitUpgrade() error {
+	if upgradeConn == nil {
+		return nil
+	}
+	defer func() {
+		upgradeConn.Close()
+		upgradeConn = nil
+	}()
+	// systemd tracks the new process before the old process exits
+	sdNotify(fmt.Sprintf("MAINPID=%d", os.Getpid()))
+	if _, err := fmt.Fprintln(upgradeConn, upgradeReady); err != nil {
+		Logger.Error("upgrade write error", logger.F("message", upgradeReady), logger.Err(err))
+		return err
+	}
+	Logger.Info("upgrade ready, waiting the old process drained")
+	timeout := upgradeTimeout + Conf().DrainTimeout
+	upgradeConn.SetReadDeadline(time.Now().Add(timeout))
+	if line, err := bufio.NewReader(upgradeConn).ReadString('\n'); err != nil {
+		if e, ok := err.(net.Error); ok && e.Timeout() {
+			// the old process hangs, never take over its workers meanwhile
+			Logger.Error("upgrade the old process not drained in time", logger.F("timeout", timeout.String()))
+			return ErrUpgradeDrain
+		}
+		// the old process died, its session expires as a crash
+		Logger.Warn("upgrade read error, the old process exited", logger.Err(err))
+	} else {
+		Logger.Info("upgrade the old process answered", logger.F("message", strings.TrimSpace(line)))
+	}
+	if pidFile == nil {
+		return nil
+	}
+	return writePid(pidFile)
+}
+
+// Upgrade start the new binary with all listeners and wait it's ready, the
+// caller then shuts down and calls UpgradeDrained.
+func Upgrade() (err error) {
+	if upgradeConn != nil {
+		return ErrUpgrading
+	}
+	path, err := os.Executable()
+	if err != nil {
+		Logger.Error("os.Executable() error", logger.Err(err))
+		return
+	}
+	binds, files := []string{}, []*os.File{}
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	listenerMutex.Lock()
+	for bind, l := range listeners {
+		tl, ok := l.(*net.TCPListener)
+		if !ok {
+			continue
+		}
+		f, err := tl.File()
+		if err != nil {
+			listenerMutex.Unlock()
+			Logger.Error("listener.File() error", logger.F("addr", bind), logger.Err(err))
+			return err
+		}
+		binds = append(binds, bind)
+		files = append(files, f)
+	}
+	listenerMutex.Unlock()
+	// the new process becomes the systemd main pid
+	env := []string{envListenFds + "=" + strings.Join(binds, ","), envWatchdogPid + "="}
+	if pidFile != nil {
+		// share the lock, not the *os.File closed below
+		fd, err := syscall.Dup(int(pidFile.Fd()))
+		if err != nil {
+			Logger.Error("syscall.Dup(pid file) error", logger.Err(err))
+			return err
+		}
+		env = append(env, envPidFd+"="+strconv.Itoa(listenFdStart+len(files)))
+		files = append(files, os.NewFile(uintptr(fd), Conf().PidFile))
+	}
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		Logger.Error("syscall.Socketpair() error", logger.Err(err))
+		return
+	}
+	parent, child := os.NewFile(uintptr(fds[0]), "upgrade-parent"), os.NewFile(uintptr(fds[1]), "upgrade-child")
+	conn, err := net.FileConn(parent)
+	parent.Close()
+	if err != nil {
+		child.Close()
+		Logger.Error("net.FileConn() error", logger.Err(err))
+		return
+	}
+	env = append(env, envUpgradeFd+"="+strconv.Itoa(listenFdStart+len(files)))
+	files = append(files, child)
+	cmd := exec.Command(path, os.Args[1:]...)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	cmd.ExtraFiles = files
+	cmd.Env = append(os.Environ(), env...)
+	if err = cmd.Start(); err != nil {
+		conn.Close()
+		Logger.Error("exec error", logger.F("path", path), logger.Err(err))
+		return
+	}
+	// reap the new process if it exits before us
+	go cmd.Wait()
+	Logger.Info("upgrade started the new process, waiting it ready", logger.F("pid", cmd.Process.Pid))
+	conn.SetReadDeadline(time.Now().Add(upgradeTimeout))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil || strings.TrimSpace(line) != upgradeReady {
+		conn.Close()
+		cmd.Process.Kill()
+		Logger.Error("upgrade the new process not ready, keep serving", logger.F("pid", cmd.Process.Pid), logger.Err(err))
+		if err == nil {
+			err = fmt.Errorf("upgrade bad answer: \"%s\"", strings.TrimSpace(line))
+		}
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+	upgradeConn = conn
+	Logger.Info("upgrade the new process ready", logger.F("pid", cmd.Process.Pid))
+	return nil
+}
+
+// Upgrading check the process is handing the workers to the new process.
+func Upgrading() bool {
+	return upgradeConn != nil
+}
+
+// UpgradeDrained close the registry session to release the claims, then tell
+// the new process to take over the workers.
+func UpgradeDrained() {
+	if upgradeConn == nil {
+		return
+	}
+	CloseRegistry()
+	if _, err := fmt.Fprintln(upgradeConn, upgradeDrained); err != nil {
+		Logger.Error("upgrade write error", logger.F("message", upgradeDrained), logger.Err(err))
+	}
+	upgradeConn.Close()
+	upgradeConn = nil
+}
@@ -0,0 +1,112 @@
+// Copyright © 2014 Terry Mao All rights reserved.
+// This file is part of gosnowflake.
+
+// gosnowflake is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// gosnowflake is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with gosnowflake.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInheritListeners(t *testing.T) {
+	bind := freeAddr(t)
+	l, err := listen(bind)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the old process passes a dup of the socket
+	f, err := l.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = unlisten(bind); err != nil {
+		t.Fatal(err)
+	}
+	if err = inheritListeners([]string{bind}, []*os.File{f}); err != nil {
+		t.Fatal(err)
+	}
+	if l, err = listen(bind); err != nil {
+		t.Fatal(err)
+	}
+	defer unlisten(bind)
+	conn, err := net.DialTimeout("tcp", bind, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if conn, err = l.Accept(); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
+
+func TestWaitUpgrade(t *testing.T) {
+	conf, timeout := Conf(), upgradeTimeout
+	defer func() {
+		SetConf(conf)
+		upgradeTimeout = timeout
+	}()
+	SetConf(&Config{DrainTimeout: 10 * time.Millisecond})
+	conn, old := net.Pipe()
+	upgradeConn = conn
+	result := make(chan error, 1)
+	go func() {
+		line, err := bufio.NewReader(old).ReadString('\n')
+		if err == nil && strings.TrimSpace(line) != upgradeReady {
+			err = fmt.Errorf("read \"%s\", expected \"%s\"", line, upgradeReady)
+		}
+		if err == nil {
+			_, err = fmt.Fprintln(old, upgradeDrained)
+		}
+		result <- err
+	}()
+	if err := WaitUpgrade(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-result; err != nil {
+		t.Fatal(err)
+	}
+	if upgradeConn != nil {
+		t.Fatal("upgradeConn expected nil after upgraded")
+	}
+	// the old process died before drained
+	conn, old = net.Pipe()
+	upgradeConn = conn
+	go func() {
+		bufio.NewReader(old).ReadString('\n')
+		old.Close()
+	}()
+	if err := WaitUpgrade(); err != nil {
+		t.Fatal(err)
+	}
+	// the old process hangs while draining
+	upgradeTimeout = 10 * time.Millisecond
+	conn, old = net.Pipe()
+	defer old.Close()
+	upgradeConn = conn
+	go bufio.NewReader(old).ReadString('\n')
+	if err := WaitUpgrade(); err != ErrUpgradeDrain {
+		t.Fatalf("WaitUpgrade() error(%v), expected %v", err, ErrUpgradeDrain)
+	}
+	if upgradeConn != nil {
+		t.Fatal("upgradeConn expected nil after timed out")
+	}
+}
@@ -19,45 +19,196 @@
 package main
 
 import (
-	log "github.com/alecthomas/log4go"
 	"errors"
 	"fmt"
+	"github.com/Terry-Mao/gosnowflake/logger"
+	"sync"
+	"time"
 )
 
-type Workers []*IdWorker
+// Workers is all the id workers served by the process, the workers can be
+// added or removed on reloading.
+type Workers struct {
+	mutex     sync.RWMutex
+	idWorkers []*IdWorker
+}
 
 // NewWorkers new id workers instance.
-func NewWorkers() (Workers, error) {
-	idWorkers := make([]*IdWorker, maxWorkerId)
-	for _, workerId := range MyConf.WorkerId {
-		if t := idWorkers[workerId]; t != nil {
-			log.Error("init workerId: %d already exists", workerId)
-			return nil, fmt.Errorf("init workerId: %d exists", workerId)
-		}
-		idWorker, err := NewIdWorker(workerId, MyConf.DatacenterId, MyConf.Twepoch)
-		if err != nil {
-			log.Error("NewIdWorker(%d, %d) error(%v)", MyConf.DatacenterId, workerId)
-			return nil, err
-		}
-		idWorkers[workerId] = idWorker
-		if err := RegWorkerId(workerId); err != nil {
-			log.Error("RegWorkerId(%d) error(%v)", workerId, err)
+func NewWorkers() (*Workers, error) {
+	conf := Conf()
+	w := &Workers{idWorkers: make([]*IdWorker, maxWorkerId+1)}
+	// derived and auto worker ids
+	if err := ClaimDerivedWorkerIds(conf.DeriveWorker); err != nil {
+		Logger.Error("ClaimDerivedWorkerIds() error", logger.F("derive", conf.DeriveWorker), logger.Err(err))
+		return nil, err
+	}
+	auto, err := ClaimWorkerIds(conf.AutoWorker)
+	if err != nil {
+		Logger.Error("ClaimWorkerIds() error", logger.F("num", conf.AutoWorker), logger.Err(err))
+		return nil, err
+	}
+	claimed := append(append([]int64{}, conf.DeriveWorker...), auto...)
+	MyStat.SetClaimedWorkerIds(claimed)
+	for _, workerId := range append(append([]int64{}, conf.WorkerId...), claimed...) {
+		if err = w.Add(workerId); err != nil {
 			return nil, err
 		}
 	}
-	return Workers(idWorkers), nil
+	return w, nil
+}
+
+// Add new a worker seeded from the persisted high-water, then register it.
+func (w *Workers) Add(workerId int64) error {
+	conf := Conf()
+	if workerId > maxWorkerId || workerId < 0 {
+		Logger.Error("worker id out of range", logger.F("worker_id", workerId), logger.F("max", maxWorkerId))
+		return fmt.Errorf("worker Id: %d error", workerId)
+	}
+	idWorker, err := NewIdWorker(workerId, conf.DatacenterId, conf.Twepoch)
+	if err != nil {
+		Logger.Error("NewIdWorker() error", logger.F("datacenter_id", conf.DatacenterId), logger.F("worker_id", workerId), logger.Err(err))
+		return err
+	}
+	// never issue ids before the last persisted timestamp
+	if timestamp, err := reg.HighWater(workerId); err != nil {
+		Logger.Error("reg.HighWater() error", logger.F("worker_id", workerId), logger.Err(err))
+		return err
+	} else if timestamp > 0 {
+		idWorker.lastTimestamp = timestamp
+		// the next id in the same millisecond waits the next millisecond
+		idWorker.sequence = sequenceMask
+	}
+	idWorker.maxBorrow = int64(conf.MaxBorrow / time.Millisecond)
+	w.mutex.Lock()
+	if t := w.idWorkers[workerId]; t != nil {
+		w.mutex.Unlock()
+		Logger.Error("worker id already exists", logger.F("worker_id", workerId))
+		return fmt.Errorf("init workerId: %d exists", workerId)
+	}
+	w.idWorkers[workerId] = idWorker
+	w.mutex.Unlock()
+	if err = clockGuard.Err(); err != nil {
+		// the clock guard registers it once the clock recovers
+		Logger.Warn("worker id not registered, clock check failed", logger.F("worker_id", workerId), logger.Err(err))
+		return nil
+	}
+	if err = RegWorkerId(workerId); err != nil {
+		Logger.Error("RegWorkerId() error", logger.F("worker_id", workerId), logger.Err(err))
+		return err
+	}
+	return nil
+}
+
+// Remove deregister a worker so the clients fail over, then remove it and
+// persist its high-water.
+func (w *Workers) Remove(workerId int64) error {
+	worker, err := w.Get(workerId)
+	if err != nil {
+		return err
+	}
+	if err = reg.Deregister(workerId); err != nil {
+		Logger.Error("reg.Deregister() error", logger.F("worker_id", workerId), logger.Err(err))
+		return err
+	}
+	w.mutex.Lock()
+	w.idWorkers[workerId] = nil
+	w.mutex.Unlock()
+	saveHighWater(workerId, worker)
+	return nil
 }
 
 // Get get a specified worker by workerId.
-func (w Workers) Get(workerId int64) (*IdWorker, error) {
+func (w *Workers) Get(workerId int64) (*IdWorker, error) {
 	if workerId > maxWorkerId || workerId < 0 {
-		log.Error("worker Id can't be greater than %d or less than 0", maxWorkerId)
+		Logger.Error("worker id out of range", logger.F("worker_id", workerId), logger.F("max", maxWorkerId))
 		return nil, errors.New(fmt.Sprintf("worker Id: %d error", workerId))
 	}
-	if worker := w[workerId]; worker == nil {
-		log.Warn("workerId: %d not register", workerId)
+	w.mutex.RLock()
+	worker := w.idWorkers[workerId]
+	w.mutex.RUnlock()
+	if worker == nil {
+		Logger.Warn("worker id not registered", logger.F("worker_id", workerId))
 		return nil, fmt.Errorf("snowflake workerId: %d don't register in this service", workerId)
-	} else {
-		return worker, nil
+	}
+	return worker, nil
+}
+
+// all get all served workers, workerId => worker.
+func (w *Workers) all() map[int64]*IdWorker {
+	workers := map[int64]*IdWorker{}
+	if w == nil {
+		return workers
+	}
+	w.mutex.RLock()
+	defer w.mutex.RUnlock()
+	for workerId, worker := range w.idWorkers {
+		if worker != nil {
+			workers[int64(workerId)] = worker
+		}
+	}
+	return workers
+}
+
+// WorkerIds get all served worker ids in order.
+func (w *Workers) WorkerIds() []int64 {
+	ids := []int64{}
+	if w == nil {
+		return ids
+	}
+	w.mutex.RLock()
+	defer w.mutex.RUnlock()
+	for workerId, worker := range w.idWorkers {
+		if worker != nil {
+			ids = append(ids, int64(workerId))
+		}
+	}
+	return ids
+}
+
+// SetMaxBorrow set all workers' hybrid logical clock max lead.
+func (w *Workers) SetMaxBorrow(maxBorrow time.Duration) {
+	for _, worker := range w.all() {
+		worker.mutex.Lock()
+		worker.maxBorrow = int64(maxBorrow / time.Millisecond)
+		worker.mutex.Unlock()
+	}
+}
+
+// Lead get all workers' milliseconds running ahead of the wall clock.
+func (w *Workers) Lead() map[int64]int64 {
+	leads := map[int64]int64{}
+	for workerId, worker := range w.all() {
+		leads[workerId] = worker.Lead()
+	}
+	return leads
+}
+
+// Deregister deregister all workers from the registry.
+func (w *Workers) Deregister() {
+	for _, workerId := range w.WorkerIds() {
+		if err := reg.Deregister(workerId); err != nil {
+			Logger.Error("reg.Deregister() error", logger.F("worker_id", workerId), logger.Err(err))
+		}
+	}
+}
+
+// SaveHighWater persist all workers' last timestamp in the registry.
+func (w *Workers) SaveHighWater() {
+	for workerId, worker := range w.all() {
+		saveHighWater(workerId, worker)
+	}
+}
+
+// saveHighWater persist the worker's last timestamp in the registry.
+func saveHighWater(workerId int64, worker *IdWorker) {
+	worker.mutex.Lock()
+	timestamp := worker.lastTimestamp
+	worker.mutex.Unlock()
+	// a standby worker may lag behind the leader's persisted timestamp
+	if hw, err := reg.HighWater(workerId); err != nil || timestamp <= hw {
+		return
+	}
+	if err := reg.SetHighWater(workerId, timestamp); err != nil {
+		Logger.Error("reg.SetHighWater() error", logger.F("worker_id", workerId), logger.F("timestamp", timestamp), logger.Err(err))
 	}
 }